@@ -1,37 +1,279 @@
 package crafttask
 
 import (
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/gorilla/mux"
 )
 
 type API struct {
-	store Store
+	documents DocumentStore
 }
 
-func NewAPI(store Store) API {
+func NewAPI(documents DocumentStore) API {
 	return API{
-		store,
+		documents,
 	}
 }
 
-// InsertBlocks inserts a list of new blocks to the document
+// RegisterRoutes registers every endpoint; block and export routes are scoped to a document
+func (s API) RegisterRoutes(r *mux.Router) {
+	r.HandleFunc("/documents", s.CreateDocument).Methods("POST")
+	r.HandleFunc("/documents", s.ListDocuments).Methods("GET")
+	r.HandleFunc("/documents/{docId}", s.FetchDocument).Methods("GET")
+	r.HandleFunc("/documents/{docId}", s.RenameDocument).Methods("PATCH")
+	r.HandleFunc("/documents/{docId}", s.DeleteDocument).Methods("DELETE")
+
+	r.HandleFunc("/documents/{docId}/blocks/bulk-insert", s.InsertBlocks).Methods("POST")
+	r.HandleFunc("/documents/{docId}/blocks", s.DeleteBlocks).Methods("DELETE")
+	r.HandleFunc("/documents/{docId}/blocks", s.FetchBlocksByID).Methods("GET")
+	r.HandleFunc("/documents/{docId}/blocks/{id}", s.UpdateBlock).Methods("PATCH")
+	r.HandleFunc("/documents/{docId}/blocks/{id}/duplicate", s.DuplicateBlock).Methods("POST")
+	r.HandleFunc("/documents/{docId}/blocks/{id}/move", s.MoveBlock).Methods("POST")
+	r.HandleFunc("/documents/{docId}/blocks/{id}/properties/{name}", s.SetProperty).Methods("PUT")
+	r.HandleFunc("/documents/{docId}/blocks/{id}/properties/{name}", s.UnsetProperty).Methods("DELETE")
+	r.HandleFunc("/documents/{docId}/blocks/{id}/backlinks", s.Backlinks).Methods("GET")
+	r.HandleFunc("/documents/{docId}/batch", s.ApplyBatch).Methods("POST")
+	r.HandleFunc("/documents/{docId}/import", s.ImportBlocks).Methods("POST")
+	r.HandleFunc("/documents/{docId}/trash", s.Trash).Methods("GET")
+	r.HandleFunc("/documents/{docId}/trash", s.PurgeTrash).Methods("DELETE")
+	r.HandleFunc("/documents/{docId}/trash/{id}/restore", s.RestoreFromTrash).Methods("POST")
+	r.HandleFunc("/documents/{docId}/undo", s.Undo).Methods("POST")
+	r.HandleFunc("/documents/{docId}/redo", s.Redo).Methods("POST")
+	r.HandleFunc("/documents/{docId}/revisions", s.Revisions).Methods("GET")
+	r.HandleFunc("/documents/{docId}/diff", s.Diff).Methods("GET")
+	r.HandleFunc("/documents/{docId}/export", s.ExportDocument).Methods("GET")
+	r.HandleFunc("/documents/{docId}/search", s.Search).Methods("GET")
+}
+
+func (s API) CreateDocument(w http.ResponseWriter, r *http.Request) {
+	var documentPayload documentRequest
+	decodeErr := json.NewDecoder(r.Body).Decode(&documentPayload)
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+	document, err := s.documents.CreateDocument(documentPayload.Name)
+	if err != nil {
+		if errors.Is(err, errInvalidDocumentName) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "unexpected error occured", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(documentToResponse(document))
+}
+
+func (s API) ListDocuments(w http.ResponseWriter, r *http.Request) {
+	documents := s.documents.ListDocuments()
+	toReturn := make([]documentResponse, 0, len(documents))
+	for _, document := range documents {
+		toReturn = append(toReturn, documentToResponse(document))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(toReturn)
+}
+
+func (s API) FetchDocument(w http.ResponseWriter, r *http.Request) {
+	documentId, ok := documentIdFromRequest(w, r)
+	if !ok {
+		return
+	}
+	document, err := s.documents.FetchDocument(documentId)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(documentToResponse(document))
+}
+
+func (s API) RenameDocument(w http.ResponseWriter, r *http.Request) {
+	documentId, ok := documentIdFromRequest(w, r)
+	if !ok {
+		return
+	}
+	var documentPayload documentRequest
+	decodeErr := json.NewDecoder(r.Body).Decode(&documentPayload)
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+	document, err := s.documents.RenameDocument(documentId, documentPayload.Name)
+	if err != nil {
+		if errors.Is(err, errInvalidDocumentName) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeDocumentError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(documentToResponse(document))
+}
+
+func (s API) DeleteDocument(w http.ResponseWriter, r *http.Request) {
+	documentId, ok := documentIdFromRequest(w, r)
+	if !ok {
+		return
+	}
+	err := s.documents.DeleteDocument(documentId)
+	if err != nil {
+		writeDocumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeOperationErrors reports every invalid operation of a rejected bulk request, ordered by position in the request
+func writeOperationErrors(w http.ResponseWriter, invalidOperations operationErrors) {
+	toReturn := make([]operationResult, 0, len(invalidOperations))
+	for i, err := range invalidOperations {
+		toReturn = append(toReturn, operationErrorResult(i, err))
+	}
+	sort.Slice(toReturn, func(i, j int) bool { return toReturn[i].Index < toReturn[j].Index })
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(toReturn)
+}
+
+func operationErrorResult(index int, err error) operationResult {
+	return operationResult{
+		Index:     index,
+		ErrorCode: errorCode(err),
+		Error:     err.Error(),
+	}
+}
+
+// errorCode is the machine readable name of an error reported per operation
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, errParentBlockDoesNotExist):
+		return "parent_not_found"
+	case errors.Is(err, errBlockDoesNotExist):
+		return "block_not_found"
+	case errors.Is(err, errBlockMovedToItsChild):
+		return "moved_to_child"
+	case errors.Is(err, errInvalidIndex):
+		return "invalid_index"
+	case errors.Is(err, errUnknownRef):
+		return "unknown_ref"
+	case errors.Is(err, errDuplicateRef):
+		return "duplicate_ref"
+	case errors.Is(err, errUnknownOperation):
+		return "unknown_operation"
+	case errors.Is(err, errUnknownBlockType):
+		return "unknown_block_type"
+	case isInvalidBlockTypeFields(err):
+		return "invalid_block_type_fields"
+	case isInvalidProperty(err):
+		return "invalid_property"
+	case isInvalidRichText(err):
+		return "invalid_rich_text"
+	case errors.Is(err, errReferenceTargetDoesNotExist):
+		return "reference_target_not_found"
+	case errors.Is(err, errReferenceCycle):
+		return "reference_cycle"
+	case errors.Is(err, errDocumentDoesNotExist):
+		return "document_not_found"
+	}
+	return "internal_error"
+}
+
+func documentIdFromRequest(w http.ResponseWriter, r *http.Request) (id, bool) {
+	documentId, err := idFromString(mux.Vars(r)["docId"])
+	if err != nil {
+		http.Error(w, "document id parameter not an id", http.StatusBadRequest)
+		return 0, false
+	}
+	return documentId, true
+}
+
+// writeDocumentError answers 404 when the document doesn't exist, or was deleted while the request was using it,
+// and 500 for any other error
+func writeDocumentError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errDocumentDoesNotExist) {
+		http.Error(w, "document does not exist", http.StatusNotFound)
+		return
+	}
+	http.Error(w, "unexpected error occured", http.StatusInternalServerError)
+}
+
+// documentStore looks up the store of the document the request is scoped to, writing the error response if there is none
+func (s API) documentStore(w http.ResponseWriter, r *http.Request) (Store, bool) {
+	documentId, ok := documentIdFromRequest(w, r)
+	if !ok {
+		return nil, false
+	}
+	store, err := s.documents.Document(documentId)
+	if err != nil {
+		writeDocumentError(w, err)
+		return nil, false
+	}
+	return store, true
+}
+
+// InsertBlocks inserts a list of new blocks to the document: all of them, or none if any operation is invalid.
+// With ?mode=partial every valid operation is applied and the result of each one is reported instead.
 func (s API) InsertBlocks(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != "partial" {
+		http.Error(w, "mode parameter must be partial or empty", http.StatusBadRequest)
+		return
+	}
 	var insertPayload []insertOperation
 	decodeErr := json.NewDecoder(r.Body).Decode(&insertPayload)
 	if decodeErr != nil {
 		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
 		return
 	}
-	// validate payload
-	blocks, insertErr := s.store.InsertBlocks(insertPayload)
+
+	if mode == "partial" {
+		results := store.InsertBlocksPartially(insertPayload)
+		toReturn := make([]operationResult, 0, len(results))
+		for i, result := range results {
+			if result.err != nil {
+				toReturn = append(toReturn, operationErrorResult(i, result.err))
+				continue
+			}
+			response := blockToResponse(result.block)
+			toReturn = append(toReturn, operationResult{Index: i, Block: &response})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMultiStatus)
+		json.NewEncoder(w).Encode(toReturn)
+		return
+	}
+
+	blocks, insertErr := store.InsertBlocks(insertPayload)
 	if insertErr != nil {
-		http.Error(w, insertErr.Error(), http.StatusInternalServerError)
+		var invalidOperations operationErrors
+		if errors.As(insertErr, &invalidOperations) {
+			writeOperationErrors(w, invalidOperations)
+			return
+		}
+		writeDocumentError(w, insertErr)
 		return
 	}
 
@@ -41,6 +283,10 @@ func (s API) InsertBlocks(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s API) DeleteBlocks(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
 	idsRaw := r.URL.Query().Get("blockIds")
 	idsSplit := strings.Split(idsRaw, ",")
 	ids := make([]id, len(idsSplit))
@@ -53,12 +299,22 @@ func (s API) DeleteBlocks(w http.ResponseWriter, r *http.Request) {
 		ids = append(ids, id)
 	}
 	// validate payload
-	s.store.DeleteBlocks(ids)
+	deleteErr := store.DeleteBlocks(ids)
+	if deleteErr != nil {
+		writeDocumentError(w, deleteErr)
+		return
+	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// FetchBlocksByID returns the blocks with the ?blockIds= and their subblocks, with references resolved to the content
+// of their targets
 func (s API) FetchBlocksByID(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
 	idsRaw := r.URL.Query().Get("blockIds")
 	idsSplit := strings.Split(idsRaw, ",")
 	ids := make([]id, len(idsSplit))
@@ -70,7 +326,11 @@ func (s API) FetchBlocksByID(w http.ResponseWriter, r *http.Request) {
 		}
 		ids = append(ids, id)
 	}
-	blocks := s.store.FetchBlocks(ids)
+	reader, ok := documentReaderAtRevision(w, r, store)
+	if !ok {
+		return
+	}
+	blocks := reader.FetchBlocks(ids)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
@@ -78,6 +338,10 @@ func (s API) FetchBlocksByID(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s API) DuplicateBlock(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
 	idRaw := mux.Vars(r)["id"]
 	id, err := idFromString(idRaw)
 	if err != nil {
@@ -86,13 +350,13 @@ func (s API) DuplicateBlock(w http.ResponseWriter, r *http.Request) {
 	}
 	// validate payload
 
-	block, err := s.store.DuplicateBlock(id)
+	block, err := store.DuplicateBlock(id)
 	if err != nil {
 		if errors.Is(err, errBlockDoesNotExist) {
 			http.Error(w, "block to duplicate does not exist", http.StatusNotFound)
 			return
 		}
-		http.Error(w, "unexpected error occured", http.StatusInternalServerError)
+		writeDocumentError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
@@ -100,6 +364,10 @@ func (s API) DuplicateBlock(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s API) MoveBlock(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
 	idRaw := mux.Vars(r)["id"]
 	id, parseErr := idFromString(idRaw)
 	if parseErr != nil {
@@ -115,7 +383,7 @@ func (s API) MoveBlock(w http.ResponseWriter, r *http.Request) {
 	// validate payload
 	// also validate blockToMove != newParentId
 
-	err := s.store.MoveBlock(id, movePayload)
+	err := store.MoveBlock(id, movePayload)
 	if err != nil {
 		if errors.Is(err, errBlockDoesNotExist) {
 			http.Error(w, "block to move does not exist", http.StatusNotFound)
@@ -126,15 +394,688 @@ func (s API) MoveBlock(w http.ResponseWriter, r *http.Request) {
 		} else if errors.Is(err, errBlockMovedToItsChild) {
 			http.Error(w, "block to move is a parent of the block to move to", http.StatusBadRequest)
 			return
+		} else if errors.Is(err, errInvalidIndex) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		writeDocumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UpdateBlock replaces the content of a block, and its type when the payload has one, keeping its id, position and subblocks
+func (s API) UpdateBlock(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	idRaw := mux.Vars(r)["id"]
+	id, parseErr := idFromString(idRaw)
+	if parseErr != nil {
+		http.Error(w, "block id paramter", http.StatusBadRequest)
+		return
+	}
+	var updatePayload updatePayload
+	decodingErr := json.NewDecoder(r.Body).Decode(&updatePayload)
+	if decodingErr != nil {
+		http.Error(w, decodingErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	block, err := store.UpdateBlock(id, updatePayload)
+	if err != nil {
+		if errors.Is(err, errBlockDoesNotExist) {
+			http.Error(w, "block to update does not exist", http.StatusNotFound)
+			return
+		} else if errors.Is(err, errUnknownBlockType) || isInvalidBlockTypeFields(err) || isInvalidRichText(err) ||
+			errors.Is(err, errReferenceTargetDoesNotExist) || errors.Is(err, errReferenceCycle) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeDocumentError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(blockToResponse(block))
+}
+
+// Backlinks lists the blocks that link to the block, through references or links in their rich text, each with the
+// path of blocks down to it
+func (s API) Backlinks(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	id, parseErr := idFromString(mux.Vars(r)["id"])
+	if parseErr != nil {
+		http.Error(w, "block id parameter not an id", http.StatusBadRequest)
+		return
+	}
+	backlinks, err := store.Backlinks(id)
+	if err != nil {
+		if errors.Is(err, errBlockDoesNotExist) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeDocumentError(w, err)
+		return
+	}
+	response := make([]backlinkResponse, 0, len(backlinks))
+	for _, backlink := range backlinks {
+		response = append(response, backlinkResponse{
+			Id:      backlink.block.id,
+			Type:    backlink.block.blockType,
+			Content: backlink.block.content,
+			Path:    pathToResponse(backlink.path),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Search finds the blocks whose content matches the ?q= query, the most relevant first. The query's words all have to
+// match; "quoted phrases" match words right after each other, and words ending in * match the words they start.
+// ?limit= caps the hits, 20 by default and 100 at most.
+func (s API) Search(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultSearchLimit
+	if limitRaw := r.URL.Query().Get("limit"); limitRaw != "" {
+		var parseErr error
+		limit, parseErr = strconv.Atoi(limitRaw)
+		if parseErr != nil || limit < 1 || limit > maxSearchLimit {
+			http.Error(w, "limit parameter not a number from 1 to 100", http.StatusBadRequest)
+			return
+		}
+	}
+	hits, err := store.Search(r.URL.Query().Get("q"), limit)
+	if err != nil {
+		if errors.Is(err, errEmptySearchQuery) || errors.Is(err, errUnclosedSearchPhrase) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeDocumentError(w, err)
+		return
+	}
+	response := make([]searchHitResponse, 0, len(hits))
+	for _, hit := range hits {
+		snippets := make([][]snippetPartResponse, 0, len(hit.snippets))
+		for _, snippet := range hit.snippets {
+			parts := make([]snippetPartResponse, 0, len(snippet))
+			for _, part := range snippet {
+				parts = append(parts, snippetPartResponse{Text: part.text, Highlighted: part.highlighted})
+			}
+			snippets = append(snippets, parts)
+		}
+		response = append(response, searchHitResponse{
+			Id:       hit.block.id,
+			Type:     hit.block.blockType,
+			Content:  hit.block.content,
+			Score:    hit.score,
+			Snippets: snippets,
+			Path:     pathToResponse(hit.path),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+func pathToResponse(path []block) []breadcrumbResponse {
+	toReturn := make([]breadcrumbResponse, 0, len(path))
+	for _, ancestor := range path {
+		toReturn = append(toReturn, breadcrumbResponse{Id: ancestor.id, Content: ancestor.content})
+	}
+	return toReturn
+}
+
+// SetProperty sets one property of a block to the value in the body, e.g. {"Type":"string","Value":"Ana"}
+func (s API) SetProperty(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	id, parseErr := idFromString(mux.Vars(r)["id"])
+	if parseErr != nil {
+		http.Error(w, "block id parameter not an id", http.StatusBadRequest)
+		return
+	}
+	var propertyPayload propertyPayload
+	decodingErr := json.NewDecoder(r.Body).Decode(&propertyPayload)
+	if decodingErr != nil {
+		http.Error(w, decodingErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	block, err := store.SetProperty(id, mux.Vars(r)["name"], propertyPayload)
+	if err != nil {
+		if errors.Is(err, errBlockDoesNotExist) {
+			http.Error(w, "block to set the property of does not exist", http.StatusNotFound)
+			return
+		} else if isInvalidProperty(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeDocumentError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(blockToResponse(block))
+}
+
+// UnsetProperty removes one property of a block, if it has it
+func (s API) UnsetProperty(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	id, parseErr := idFromString(mux.Vars(r)["id"])
+	if parseErr != nil {
+		http.Error(w, "block id parameter not an id", http.StatusBadRequest)
+		return
+	}
+
+	err := store.UnsetProperty(id, mux.Vars(r)["name"])
+	if err != nil {
+		if errors.Is(err, errBlockDoesNotExist) {
+			http.Error(w, "block to unset the property of does not exist", http.StatusNotFound)
+			return
+		}
+		writeDocumentError(w, err)
+		return
 	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// ApplyBatch applies an ordered list of mixed operations atomically
+func (s API) ApplyBatch(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	var batchPayload []batchOperation
+	decodeErr := json.NewDecoder(r.Body).Decode(&batchPayload)
+	if decodeErr != nil {
+		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := store.ApplyBatch(batchPayload)
+	if err != nil {
+		var invalidOperations operationErrors
+		if errors.As(err, &invalidOperations) {
+			writeOperationErrors(w, invalidOperations)
+			return
+		}
+		writeDocumentError(w, err)
+		return
+	}
+	response := batchResponse{
+		Results: make([]operationResult, 0, len(result.blocks)),
+		Refs:    result.refs,
+	}
+	for i, changedBlock := range result.blocks {
+		operationResult := operationResult{Index: i}
+		if changedBlock != nil {
+			blockResponse := blockToResponse(*changedBlock)
+			operationResult.Block = &blockResponse
+		}
+		response.Results = append(response.Results, operationResult)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// Undo reverts the latest operation on the document
+func (s API) Undo(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	err := store.Undo()
+	if err != nil {
+		if errors.Is(err, errNothingToUndo) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeDocumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Redo applies the latest undone operation on the document again
+func (s API) Redo(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	err := store.Redo()
+	if err != nil {
+		if errors.Is(err, errNothingToRedo) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeDocumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ImportBlocks parses the body in the ?format= (plain text by default), the same formats exports are in,
+// and inserts the blocks under ?parentBlockId= at ?index= (both 0 by default), all of them or, if one can't be, none.
+// With ?ids=keep the blocks keep the ids of a JSON export instead of getting new ones.
+func (s API) ImportBlocks(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = defaultExportFormat
+	}
+	importer, ok := importFormats[formatName]
+	if !ok {
+		http.Error(w, "format has to be one of "+strings.Join(importFormatNames(), ", "), http.StatusBadRequest)
+		return
+	}
+	parentId := root
+	if parentIdRaw := r.URL.Query().Get("parentBlockId"); parentIdRaw != "" {
+		var parseErr error
+		parentId, parseErr = idFromString(parentIdRaw)
+		if parseErr != nil {
+			http.Error(w, "parent block id parameter not an id", http.StatusBadRequest)
+			return
+		}
+	}
+	index := 0
+	if indexRaw := r.URL.Query().Get("index"); indexRaw != "" {
+		var parseErr error
+		index, parseErr = strconv.Atoi(indexRaw)
+		if parseErr != nil {
+			http.Error(w, "index parameter not a number", http.StatusBadRequest)
+			return
+		}
+	}
+	idsMode := r.URL.Query().Get("ids")
+	if idsMode != "" && idsMode != "keep" && idsMode != "new" {
+		http.Error(w, "ids parameter must be keep, new or empty", http.StatusBadRequest)
+		return
+	}
+	text, readErr := io.ReadAll(r.Body)
+	if readErr != nil {
+		http.Error(w, readErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	blocksToImport, parseErr := importer(string(text))
+	if parseErr != nil {
+		var malformedLines lineErrors
+		if errors.As(parseErr, &malformedLines) {
+			toReturn := make([]lineErrorResponse, 0, len(malformedLines))
+			for _, malformedLine := range malformedLines {
+				toReturn = append(toReturn, lineErrorResponse{Line: malformedLine.line, Error: malformedLine.message})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(toReturn)
+			return
+		}
+		http.Error(w, parseErr.Error(), http.StatusBadRequest)
+		return
+	}
+	blocks, insertErr := store.ImportBlocks(insertOperationsAt(parentId, index, blocksToImport), idsMode == "keep")
+	if insertErr != nil {
+		var invalidOperations operationErrors
+		if errors.As(insertErr, &invalidOperations) {
+			err := invalidOperations.first()
+			if errors.Is(err, errBlockIdTaken) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeDocumentError(w, insertErr)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(blocksToResponse(blocks))
+}
+
+// Trash lists the deleted subtrees that can still be restored, in the order they were deleted
+func (s API) Trash(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	trash := store.Trash()
+	toReturn := make([]trashedBlockResponse, 0, len(trash))
+	for _, trashed := range trash {
+		toReturn = append(toReturn, trashedBlockResponse{
+			Block:         blockToResponse(trashed.block),
+			ParentBlockId: trashed.parentId,
+			Index:         trashed.index,
+			DeletedAt:     trashed.deletedAt,
+			PurgeAt:       trashed.purgeAt(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(toReturn)
+}
+
+// RestoreFromTrash puts a deleted subtree back where it was deleted from;
+// a body with a NewParentId restores it there instead, e.g. when the original parent is gone too
+func (s API) RestoreFromTrash(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	idRaw := mux.Vars(r)["id"]
+	id, parseErr := idFromString(idRaw)
+	if parseErr != nil {
+		http.Error(w, "block id paramter", http.StatusBadRequest)
+		return
+	}
+	var restorePayload restorePayload
+	decodingErr := json.NewDecoder(r.Body).Decode(&restorePayload)
+	if decodingErr != nil && !errors.Is(decodingErr, io.EOF) { // the body is optional
+		http.Error(w, decodingErr.Error(), http.StatusBadRequest)
+		return
+	}
+
+	block, err := store.RestoreFromTrash(id, restorePayload)
+	if err != nil {
+		if errors.Is(err, errBlockNotInTrash) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if errors.Is(err, errOriginalParentDoesNotExist) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if errors.Is(err, errParentBlockDoesNotExist) {
+			http.Error(w, "parent block to restore to is invalid or does not exist", http.StatusBadRequest)
+			return
+		} else if errors.Is(err, errInvalidIndex) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeDocumentError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(blockToResponse(block))
+}
+
+// PurgeTrash deletes the ?blockIds= subtrees from the trash for good
+func (s API) PurgeTrash(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	idsSplit := strings.Split(r.URL.Query().Get("blockIds"), ",")
+	ids := make([]id, 0, len(idsSplit))
+	for _, idRaw := range idsSplit {
+		id, err := idFromString(idRaw)
+		if err != nil {
+			http.Error(w, "block id parameter not an id", http.StatusBadRequest)
+			return
+		}
+		ids = append(ids, id)
+	}
+	err := store.PurgeTrash(ids)
+	if err != nil {
+		if errors.Is(err, errBlockNotInTrash) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeDocumentError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Revisions lists the document's revisions that can still be rebuilt, oldest first
+func (s API) Revisions(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	revisions := store.Revisions()
+	toReturn := make([]revisionResponse, 0, len(revisions))
+	for _, revision := range revisions {
+		toReturn = append(toReturn, revisionResponse{
+			Revision:  revision.number,
+			Timestamp: revision.timestamp,
+			Summary:   revision.summary,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(toReturn)
+}
+
+// documentReaderAtRevision returns the document as of the ?revision= parameter, or the current one without it,
+// writing the error response if that revision can't be read
+func documentReaderAtRevision(w http.ResponseWriter, r *http.Request, store Store) (documentReader, bool) {
+	revisionRaw := r.URL.Query().Get("revision")
+	if revisionRaw == "" {
+		return store, true
+	}
+	revision, err := strconv.ParseUint(revisionRaw, 10, 64)
+	if err != nil {
+		http.Error(w, "revision parameter not a revision number", http.StatusBadRequest)
+		return nil, false
+	}
+	reader, err := store.AtRevision(revision)
+	if err != nil {
+		writeRevisionError(w, err)
+		return nil, false
+	}
+	return reader, true
+}
+
+func writeRevisionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errRevisionDoesNotExist) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if errors.Is(err, errRevisionNotAvailable) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	} else if errors.Is(err, errInvalidRevisionRange) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeDocumentError(w, err)
+}
+
+// Diff lists the block-level changes between the ?from= and ?to= revisions,
+// or with ?format=unified shows the change of the export as a unified diff
+func (s API) Diff(w http.ResponseWriter, r *http.Request) {
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	fromRevision, fromErr := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	toRevision, toErr := strconv.ParseUint(r.URL.Query().Get("to"), 10, 64)
+	if fromErr != nil || toErr != nil {
+		http.Error(w, "from and to parameters have to be revision numbers", http.StatusBadRequest)
+		return
+	}
+	diff, err := store.Diff(fromRevision, toRevision)
+	if err != nil {
+		writeRevisionError(w, err)
+		return
+	}
+	if r.URL.Query().Get("format") == "unified" {
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, diff.unified)
+		return
+	}
+	toReturn := diffResponse{
+		From:    diff.from,
+		To:      diff.to,
+		Changes: make([]blockChangeResponse, 0, len(diff.changes)),
+	}
+	for _, change := range diff.changes {
+		toReturn.Changes = append(toReturn.Changes, blockChangeToResponse(change))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(toReturn)
+}
+
+func blockChangeToResponse(change blockChange) blockChangeResponse {
+	response := blockChangeResponse{
+		Change:      change.kind,
+		BlockId:     change.blockId,
+		DuplicateOf: change.duplicateOf,
+	}
+	if change.oldPosition != nil {
+		response.OldPosition = &blockPositionResponse{ParentId: change.oldPosition.parentId, Index: change.oldPosition.index}
+	}
+	if change.newPosition != nil {
+		response.NewPosition = &blockPositionResponse{ParentId: change.newPosition.parentId, Index: change.newPosition.index}
+	}
+	switch change.kind {
+	case changeDeleted:
+		response.OldContent = &change.oldContent
+	case changeInserted, changeDuplicated:
+		response.NewContent = &change.newContent
+	case changeContentChanged:
+		response.OldContent = &change.oldContent
+		response.NewContent = &change.newContent
+		response.OldRichText = richTextToPayloads(change.oldRichText)
+		response.NewRichText = richTextToPayloads(change.newRichText)
+	case changeTypeChanged:
+		response.OldType = &change.oldType
+		response.NewType = &change.newType
+	case changePropertiesChanged:
+		response.OldProperties = propertiesToPayloads(change.oldProperties)
+		response.NewProperties = propertiesToPayloads(change.newProperties)
+	}
+	return response
+}
+
+// ExportDocument streams the document in the ?format= (see the package comment), optionally as of a ?revision=,
+// from a ?root= block and down to a ?maxDepth=
 func (s API) ExportDocument(w http.ResponseWriter, r *http.Request) {
-	content := s.store.Export()
-	w.Header().Set("Content-Type", "text/plain")
-	fmt.Fprint(w, content)
+	store, ok := s.documentStore(w, r)
+	if !ok {
+		return
+	}
+	formatName := r.URL.Query().Get("format")
+	if formatName == "" {
+		formatName = defaultExportFormat
+	}
+	format, ok := exportFormats[formatName]
+	if !ok {
+		http.Error(w, "format has to be one of "+strings.Join(exportFormatNames(), ", "), http.StatusBadRequest)
+		return
+	}
+	exporter, err := format.newExporter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scope := wholeDocument
+	if rootIdRaw := r.URL.Query().Get("root"); rootIdRaw != "" {
+		var parseErr error
+		scope.rootId, parseErr = idFromString(rootIdRaw)
+		if parseErr != nil {
+			http.Error(w, "root parameter not an id", http.StatusBadRequest)
+			return
+		}
+	}
+	if maxDepthRaw := r.URL.Query().Get("maxDepth"); maxDepthRaw != "" {
+		var parseErr error
+		scope.maxDepth, parseErr = strconv.Atoi(maxDepthRaw)
+		if parseErr != nil || scope.maxDepth < 0 {
+			http.Error(w, "maxDepth parameter not a number from 0 up", http.StatusBadRequest)
+			return
+		}
+	}
+	reader, ok := documentReaderAtRevision(w, r, store)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Vary", "Accept-Encoding")
+	output := io.Writer(w)
+	var gzipWriter *gzip.Writer
+	if acceptsGzip(r) {
+		w.Header().Set("Content-Encoding", "gzip")
+		gzipWriter = gzip.NewWriter(w)
+		output = gzipWriter
+	}
+	err = reader.ExportTo(r.Context(), output, exporter, scope)
+	if errors.Is(err, errBlockDoesNotExist) {
+		w.Header().Del("Content-Encoding") // nothing was written yet
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logExportError(err) // not closing the gzip stream, so the client can tell the export is incomplete
+		return
+	}
+	if gzipWriter != nil {
+		if err := gzipWriter.Close(); err != nil {
+			logExportError(err)
+		}
+	}
+}
+
+// logExportError logs why an export stopped short; the response has started, so the client only gets part of it.
+// Clients going away are expected and not logged.
+func logExportError(err error) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+		return
+	}
+	log.Printf("exporting document: %v", err)
+}
+
+// acceptsGzip tells whether the request's Accept-Encoding allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(header, ",") {
+			name, parameters, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+			if strings.EqualFold(strings.TrimSpace(name), "gzip") && strings.ReplaceAll(parameters, " ", "") != "q=0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isInvalidBlockTypeFields tells whether the error is about type specific fields that don't fit the block's type
+func isInvalidBlockTypeFields(err error) bool {
+	return errors.Is(err, errFieldNotOfBlockType) || errors.Is(err, errInvalidHeadingLevel) ||
+		errors.Is(err, errInvalidCodeLanguage) || errors.Is(err, errDividerWithContent) ||
+		errors.Is(err, errMissingBlockType) || errors.Is(err, errFormattedCode) ||
+		errors.Is(err, errMissingReferenceTarget) || errors.Is(err, errReferenceWithContent)
+}
+
+// isInvalidRichText tells whether the error is about rich text that isn't valid or doesn't match the content
+func isInvalidRichText(err error) bool {
+	return errors.Is(err, errEmptyTextRun) || errors.Is(err, errUnknownTextMark) || errors.Is(err, errInvalidCodeMark) ||
+		errors.Is(err, errInvalidLink) || errors.Is(err, errRichTextMismatch)
+}
+
+// isInvalidProperty tells whether the error is about a property's name, type or value
+func isInvalidProperty(err error) bool {
+	return errors.Is(err, errInvalidPropertyName) || errors.Is(err, errUnknownPropertyType) ||
+		errors.Is(err, errInvalidPropertyValue)
 }
 
 func blocksToResponse(blocks []block) []blockResponse {
@@ -147,9 +1088,30 @@ func blocksToResponse(blocks []block) []blockResponse {
 }
 
 func blockToResponse(block block) blockResponse {
-	return blockResponse{
-		Id:        block.id,
-		Content:   block.content,
-		Subblocks: blocksToResponse(block.subblocks.OrderedValues()),
+	response := blockResponse{
+		Id:         block.id,
+		Type:       block.blockType,
+		Level:      block.level,
+		Language:   block.language,
+		Target:     block.target,
+		Content:    block.content,
+		RichText:   richTextToPayloads(block.richText),
+		Properties: propertiesToPayloads(block.properties),
+		Subblocks:  blocksToResponse(block.subblocks.OrderedValues()),
+	}
+	if block.blockType == blockTypeTodo {
+		checked := block.checked
+		response.Checked = &checked
+	}
+	if block.broken != nil {
+		response.Broken = errorCode(block.broken)
+	}
+	return response
+}
+
+func documentToResponse(document documentInfo) documentResponse {
+	return documentResponse{
+		Id:   document.id,
+		Name: document.name,
 	}
 }
@@ -0,0 +1,135 @@
+package crafttask
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRouter() *mux.Router {
+	r := mux.NewRouter()
+	NewAPI(NewInMemoryDocuments()).RegisterRoutes(r)
+	return r
+}
+
+func doRequest(t *testing.T, handler http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	var bodyReader io.Reader
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+	request := httptest.NewRequest(method, path, bodyReader)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func createTestDocument(t *testing.T, handler http.Handler, name string) documentResponse {
+	response := doRequest(t, handler, "POST", "/documents", `{"Name":"`+name+`"}`)
+	require.Equal(t, http.StatusCreated, response.Code)
+	var document documentResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&document))
+	return document
+}
+
+func TestAPI_DocumentScopedRoutes(t *testing.T) {
+	r := newTestRouter()
+	document1 := createTestDocument(t, r, "Document 1")
+	document2 := createTestDocument(t, r, "Document 2")
+
+	response := doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block 1"}}]`)
+	require.Equal(t, http.StatusCreated, response.Code)
+	response = doRequest(t, r, "POST", "/documents/2/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Other Block 1"}}]`)
+	require.Equal(t, http.StatusCreated, response.Code)
+
+	response = doRequest(t, r, "GET", "/documents/1/export", "")
+	assert.Equal(t, "Block 1\n", response.Body.String())
+	response = doRequest(t, r, "GET", "/documents/2/export", "")
+	assert.Equal(t, "Other Block 1\n", response.Body.String())
+
+	response = doRequest(t, r, "GET", "/documents/3/export", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = doRequest(t, r, "PATCH", "/documents/1", `{"Name":"Renamed"}`)
+	require.Equal(t, http.StatusOK, response.Code)
+	response = doRequest(t, r, "DELETE", "/documents/2", "")
+	require.Equal(t, http.StatusNoContent, response.Code)
+
+	response = doRequest(t, r, "GET", "/documents", "")
+	var documents []documentResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&documents))
+	assert.Equal(t, []documentResponse{{Id: document1.Id, Name: "Renamed"}}, documents)
+	assert.NotEqual(t, document1.Id, document2.Id)
+}
+
+func TestAPI_InsertBlocksReportsInvalidOperations(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+
+	response := doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert",
+		`[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block 1"}},{"ParentBlockId":7,"Index":0,"Block":{"Content":"Orphan Block"}}]`)
+	require.Equal(t, http.StatusBadRequest, response.Code)
+	var results []operationResult
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&results))
+	assert.Equal(t, []operationResult{{Index: 1, ErrorCode: "parent_not_found", Error: errParentBlockDoesNotExist.Error()}}, results)
+
+	response = doRequest(t, r, "GET", "/documents/1/export", "")
+	assert.Equal(t, "", response.Body.String())
+
+	response = doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert?mode=partial",
+		`[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block 1"}},{"ParentBlockId":7,"Index":0,"Block":{"Content":"Orphan Block"}}]`)
+	require.Equal(t, http.StatusMultiStatus, response.Code)
+	results = nil
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&results))
+	require.Len(t, results, 2)
+	require.NotNil(t, results[0].Block)
+	assert.Equal(t, id(1), results[0].Block.Id)
+	assert.Equal(t, "parent_not_found", results[1].ErrorCode)
+	assert.Nil(t, results[1].Block)
+}
+
+func TestAPI_MoveBlock(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert",
+		`[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block 1"}},{"ParentBlockId":0,"Index":1,"Block":{"Content":"Block 2"}}]`)
+
+	response := doRequest(t, r, "POST", "/documents/1/blocks/2/move", `{"NewParentId":0,"Index":-1}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Equal(t, errInvalidIndex.Error()+"\n", response.Body.String())
+	response = doRequest(t, r, "POST", "/documents/1/blocks/2/move", `{"NewParentId":1,"Index":0}`)
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = doRequest(t, r, "GET", "/documents/1/export", "")
+	assert.Equal(t, "Block 1\n  Block 2\n", response.Body.String())
+}
+
+func TestAPI_ApplyBatch(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+
+	response := doRequest(t, r, "POST", "/documents/1/batch",
+		`[{"Operation":"insert","ParentBlockId":0,"Block":{"Content":"Block 1"},"Ref":"first"},`+
+			`{"Operation":"insert","ParentRef":"first","Block":{"Content":"Child Block 1"}}]`)
+	require.Equal(t, http.StatusOK, response.Code)
+	var result batchResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&result))
+	assert.Equal(t, map[string]id{"first": 1}, result.Refs)
+	require.Len(t, result.Results, 2)
+	assert.Equal(t, id(2), result.Results[1].Block.Id)
+
+	response = doRequest(t, r, "POST", "/documents/1/batch",
+		`[{"Operation":"delete","BlockId":2},{"Operation":"explode","BlockId":1}]`)
+	require.Equal(t, http.StatusBadRequest, response.Code)
+	var results []operationResult
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&results))
+	assert.Equal(t, []operationResult{{Index: 1, ErrorCode: "unknown_operation", Error: errUnknownOperation.Error()}}, results)
+
+	response = doRequest(t, r, "GET", "/documents/1/export", "")
+	assert.Equal(t, "Block 1\n  Child Block 1\n", response.Body.String())
+}
@@ -0,0 +1,104 @@
+package crafttask
+
+import (
+	"sort"
+)
+
+// backlinks maps every block linked to, by a reference or a link in rich text, to the blocks linking to it.
+// The mutations keep it up to date.
+type backlinks map[id]map[id]bool
+
+// linksOf lists the blocks the block links to, the same one as often as it links to it
+func linksOf(b block) []id {
+	var links []id
+	if b.blockType == blockTypeReference {
+		links = append(links, b.target)
+	}
+	for _, run := range b.richText {
+		if linkedBlockId, isBlockLink := linkedBlockId(run.link); isBlockLink {
+			links = append(links, linkedBlockId)
+		}
+	}
+	return links
+}
+
+func (index backlinks) add(b block) {
+	for _, target := range linksOf(b) {
+		if index[target] == nil {
+			index[target] = make(map[id]bool)
+		}
+		index[target][b.id] = true
+	}
+}
+
+func (index backlinks) remove(b block) {
+	for _, target := range linksOf(b) {
+		delete(index[target], b.id)
+		if len(index[target]) == 0 {
+			delete(index, target)
+		}
+	}
+}
+
+func (index backlinks) addSubtree(subtree block) {
+	index.add(subtree)
+	for _, subblock := range subtree.subblocks.OrderedValues() {
+		index.addSubtree(subblock)
+	}
+}
+
+func (index backlinks) removeSubtree(subtree block) {
+	index.remove(subtree)
+	for _, subblock := range subtree.subblocks.OrderedValues() {
+		index.removeSubtree(subblock)
+	}
+}
+
+// backlink is a block linking to another one, with the path down to it: its ancestors, the top level one first
+type backlink struct {
+	block block
+	path  []block
+}
+
+// Backlinks lists the blocks linking to the block, by id. The blocks are handed out without their subblocks.
+func (st *InMemoryStore) Backlinks(blockId id) ([]backlink, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	if _, exists := st.parentsCache[blockId]; !exists {
+		return nil, errBlockDoesNotExist
+	}
+	linkingIds := make([]id, 0, len(st.backlinks[blockId]))
+	for linkingId := range st.backlinks[blockId] {
+		linkingIds = append(linkingIds, linkingId)
+	}
+	sort.Slice(linkingIds, func(i, j int) bool { return linkingIds[i] < linkingIds[j] })
+	toReturn := make([]backlink, 0, len(linkingIds))
+	for _, linkingId := range linkingIds {
+		toReturn = append(toReturn, backlink{block: st.handedOutFields(linkingId), path: st.breadcrumbs(linkingId)})
+	}
+	return toReturn, nil
+}
+
+// breadcrumbs are the ancestors of the block, the top level one first
+func (st *InMemoryStore) breadcrumbs(blockId id) []block {
+	ancestorIds, err := st.pathToNode(st.parentsCache[blockId])
+	if err != nil {
+		panic("inconsistent internal state") // the parents of a block in the tree are too
+	}
+	toReturn := make([]block, 0, len(ancestorIds))
+	for i := len(ancestorIds) - 1; i >= 0; i-- {
+		toReturn = append(toReturn, st.handedOutFields(ancestorIds[i]))
+	}
+	return toReturn
+}
+
+// handedOutFields is the block in the tree without its subblocks, with its reference resolved
+func (st *InMemoryStore) handedOutFields(blockId id) block {
+	b, _, _, err := st.findBlockById(blockId)
+	if err != nil {
+		panic("inconsistent internal state") // every block the index or the parents cache has is in the tree
+	}
+	resolved := st.resolveReference(b.fields())
+	resolved.subblocks = NewOrderedMapOfBlocks()
+	return resolved
+}
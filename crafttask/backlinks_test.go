@@ -0,0 +1,146 @@
+package crafttask
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func blockLinkTo(text string, target id) []textRunPayload {
+	return []textRunPayload{{Text: text, Link: blockLink(target)}}
+}
+
+func backlinkIds(t *testing.T, store Store, blockId id) []id {
+	t.Helper()
+	backlinks, err := store.Backlinks(blockId)
+	require.NoError(t, err)
+	ids := make([]id, 0, len(backlinks))
+	for _, backlink := range backlinks {
+		ids = append(ids, backlink.block.id)
+	}
+	return ids
+}
+
+func TestLinkedBlockId(t *testing.T) {
+	linkedId, isBlockLink := linkedBlockId("#block-12")
+	assert.True(t, isBlockLink)
+	assert.Equal(t, id(12), linkedId)
+	for _, notABlockLink := range []string{"#block-0", "#block-012", "#block-", "#block-1x", "https://example.com/#block-1"} {
+		_, isBlockLink := linkedBlockId(notABlockLink)
+		assert.False(t, isBlockLink, notABlockLink)
+	}
+	assert.False(t, validLink("#block-0"))
+}
+
+func TestInMemoryStore_Backlinks(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: 5, Index: 1, Block: reference(3)}})
+	require.NoError(t, err)
+	_, err = store.UpdateBlock(4, updatePayload{RichText: blockLinkTo("see", 3)})
+	require.NoError(t, err)
+
+	backlinks, err := store.Backlinks(3)
+	require.NoError(t, err)
+	require.Len(t, backlinks, 2)
+	assert.Equal(t, id(4), backlinks[0].block.id)
+	assert.Equal(t, "see", backlinks[0].block.content)
+	require.Len(t, backlinks[0].path, 1)
+	assert.Equal(t, "Block 1", backlinks[0].path[0].content)
+	assert.Equal(t, id(7), backlinks[1].block.id)
+	assert.Equal(t, "Grandchild Block 3", backlinks[1].block.content)
+	assertConsistent(t, store)
+
+	require.NoError(t, store.MoveBlock(7, movePayload{NewParentId: 2, Index: 0}))
+	backlinks, err = store.Backlinks(3)
+	require.NoError(t, err)
+	assert.Equal(t, []block{store.FetchBlocks([]id{1})[0].fields(), store.FetchBlocks([]id{2})[0].fields()},
+		[]block{backlinks[1].path[0].fields(), backlinks[1].path[1].fields()})
+
+	// the copies link to 3 too: 10 is the copy of the reference, 12 the copy of 4
+	_, err = store.DuplicateBlock(1)
+	require.NoError(t, err)
+	assert.Equal(t, []id{4, 7, 10, 12}, backlinkIds(t, store, 3))
+	assertConsistent(t, store)
+
+	require.NoError(t, store.DeleteBlocks([]id{8}))
+	assert.Equal(t, []id{4, 7}, backlinkIds(t, store, 3))
+	_, err = store.UpdateBlock(4, updatePayload{Content: "no link"})
+	require.NoError(t, err)
+	assert.Equal(t, []id{7}, backlinkIds(t, store, 3))
+	assertConsistent(t, store)
+
+	require.NoError(t, store.Undo())
+	require.NoError(t, store.Undo())
+	assert.Equal(t, []id{4, 7, 10, 12}, backlinkIds(t, store, 3))
+	assertConsistent(t, store)
+
+	require.NoError(t, store.DeleteBlocks([]id{3}))
+	_, err = store.Backlinks(3)
+	assert.Equal(t, errBlockDoesNotExist, err)
+	_, err = store.RestoreFromTrash(3, restorePayload{})
+	require.NoError(t, err)
+	assert.Equal(t, []id{4, 7, 10, 12}, backlinkIds(t, store, 3), "links stay while the block is in the trash")
+	assertConsistent(t, store)
+}
+
+func TestInMemoryStore_ImportRetargetsBlockLinks(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.ImportBlocks(insertOperationsAt(root, 0, []blockRequest{
+		{Id: 20, Content: "Target"},
+		{Id: 21, RichText: blockLinkTo("to target", 20)},
+	}), false)
+	require.NoError(t, err)
+	blocks := store.FetchBlocks([]id{2})
+	assert.Equal(t, []textRun{{text: "to target", link: "#block-1"}}, blocks[0].richText)
+	assert.Equal(t, []id{2}, backlinkIds(t, store, 1))
+}
+
+func TestFileStore_RebuildsBacklinks(t *testing.T) {
+	for name, options := range map[string]FileStoreOptions{"replayed": {}, "from a snapshot": {SnapshotEvery: 1}} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := NewFileStore(dir, options)
+			require.NoError(t, err)
+			_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Target"}}})
+			require.NoError(t, err)
+			_, err = store.InsertBlocks([]insertOperation{
+				{ParentBlockId: root, Index: 1, Block: reference(1)},
+				{ParentBlockId: root, Index: 2, Block: blockRequest{RichText: blockLinkTo("link", 1)}},
+			})
+			require.NoError(t, err)
+			require.NoError(t, store.Close())
+
+			reopened, err := NewFileStore(dir, options)
+			require.NoError(t, err)
+			defer reopened.Close()
+			assert.Equal(t, []id{2, 3}, backlinkIds(t, reopened, 1))
+		})
+	}
+}
+
+func TestAPI_Backlinks(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Target"}},`+
+		`{"ParentBlockId":0,"Index":1,"Block":{"Content":"Parent","Subblocks":[{"RichText":[{"Text":"see ","Marks":["bold"]},{"Text":"target","Link":"#block-1"}]}]}}]`)
+
+	response := doRequest(t, r, "GET", "/documents/1/blocks/1/backlinks", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `[{"Id":3,"Type":"paragraph","Content":"see target","Path":[{"Id":2,"Content":"Parent"}]}]`, response.Body.String())
+
+	response = doRequest(t, r, "GET", "/documents/1/blocks/2/backlinks", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `[]`, response.Body.String())
+	response = doRequest(t, r, "GET", "/documents/1/blocks/9/backlinks", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
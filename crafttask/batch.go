@@ -0,0 +1,120 @@
+package crafttask
+
+import "fmt"
+
+const (
+	batchInsert    = "insert"
+	batchUpdate    = "update"
+	batchMove      = "move"
+	batchDelete    = "delete"
+	batchDuplicate = "duplicate"
+)
+
+// batchResult holds the block each operation of a batch created or updated (nil for moves and deletes)
+// and the ids the batch's temporary refs were resolved to
+type batchResult struct {
+	blocks []*block
+	refs   map[string]id
+}
+
+// ApplyBatch applies the operations in order, all of them or none: if one fails, everything before it is rolled back
+// and the returned operationErrors holds the failing operation. Inserts and duplicates can name the block they
+// create with a ref, which later operations use instead of the id they can't know yet.
+func (st *InMemoryStore) ApplyBatch(batchOperations []batchOperation) (batchResult, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	var tx transaction
+	result := batchResult{
+		blocks: make([]*block, 0, len(batchOperations)),
+		refs:   make(map[string]id),
+	}
+	for i, batchOperation := range batchOperations {
+		changedBlock, err := st.applyBatchOperation(&tx, result.refs, batchOperation)
+		if err != nil {
+			st.rollback(tx)
+			return batchResult{}, operationErrors{i: err}
+		}
+		result.blocks = append(result.blocks, changedBlock)
+	}
+	st.commit(tx, fmt.Sprintf("batch of %s", countOf(len(batchOperations), "operation")))
+	return result, nil
+}
+
+func (st *InMemoryStore) applyBatchOperation(tx *transaction, refs map[string]id, batchOperation batchOperation) (*block, error) {
+	if _, exists := refs[batchOperation.Ref]; exists {
+		return nil, errDuplicateRef
+	}
+	switch batchOperation.Operation {
+	case batchInsert:
+		parentId, err := resolveRef(refs, batchOperation.ParentBlockId, batchOperation.ParentRef)
+		if err != nil {
+			return nil, err
+		}
+		insertOperation := insertOperation{ParentBlockId: parentId, Index: batchOperation.Index, Block: batchOperation.Block}
+		if err := st.validateInsert(insertOperation, nil); err != nil {
+			return nil, err // checked before building the block, so a failed insert doesn't use up ids
+		}
+		insertedBlock, err := st.applyInsert(tx, parentId, batchOperation.Index, batchOperation.Block)
+		if err != nil {
+			return nil, err
+		}
+		addRef(refs, batchOperation.Ref, insertedBlock.id)
+		return &insertedBlock, nil
+	case batchDuplicate:
+		blockId, err := resolveRef(refs, batchOperation.BlockId, batchOperation.BlockRef)
+		if err != nil {
+			return nil, err
+		}
+		duplicatedBlock, err := st.applyDuplicate(tx, blockId)
+		if err != nil {
+			return nil, err
+		}
+		addRef(refs, batchOperation.Ref, duplicatedBlock.id)
+		return &duplicatedBlock, nil
+	case batchUpdate:
+		blockId, err := resolveRef(refs, batchOperation.BlockId, batchOperation.BlockRef)
+		if err != nil {
+			return nil, err
+		}
+		updatedBlock, err := st.applyUpdate(tx, blockId, batchOperation.Update)
+		if err != nil {
+			return nil, err
+		}
+		return &updatedBlock, nil
+	case batchMove:
+		blockId, err := resolveRef(refs, batchOperation.BlockId, batchOperation.BlockRef)
+		if err != nil {
+			return nil, err
+		}
+		parentId, err := resolveRef(refs, batchOperation.ParentBlockId, batchOperation.ParentRef)
+		if err != nil {
+			return nil, err
+		}
+		return nil, tx.record(st.moveSubtree(blockId, parentId, batchOperation.Index))
+	case batchDelete:
+		blockId, err := resolveRef(refs, batchOperation.BlockId, batchOperation.BlockRef)
+		if err != nil {
+			return nil, err
+		}
+		return nil, tx.record(st.trashSubtree(blockId))
+	}
+	return nil, errUnknownOperation
+}
+
+// resolveRef returns the id the ref stands for, or the given id when there is no ref
+func resolveRef(refs map[string]id, blockId id, ref string) (id, error) {
+	if ref == "" {
+		return blockId, nil
+	}
+	resolvedId, ok := refs[ref]
+	if !ok {
+		return 0, errUnknownRef
+	}
+	return resolvedId, nil
+}
+
+func addRef(refs map[string]id, ref string, blockId id) {
+	if ref != "" {
+		refs[ref] = blockId
+	}
+}
@@ -0,0 +1,107 @@
+package crafttask
+
+import (
+	"strings"
+)
+
+// blockType says what a block is, e.g. a heading or a todo, and so which of the type specific fields it has
+type blockType string
+
+const (
+	blockTypeParagraph blockType = "paragraph"
+	// headings have a level from 1 to 6
+	blockTypeHeading blockType = "heading"
+	// todos are checked or not
+	blockTypeTodo blockType = "todo"
+	// code has the language it is in, if any
+	blockTypeCode    blockType = "code"
+	blockTypeQuote   blockType = "quote"
+	blockTypeDivider blockType = "divider"
+	// references show the content of their target block instead of having their own
+	blockTypeReference blockType = "reference"
+)
+
+var blockTypes = map[blockType]bool{
+	blockTypeParagraph: true,
+	blockTypeHeading:   true,
+	blockTypeTodo:      true,
+	blockTypeCode:      true,
+	blockTypeQuote:     true,
+	blockTypeDivider:   true,
+	blockTypeReference: true,
+}
+
+const maxHeadingLevel = 6
+
+// blockTypeFields is a block's type with the fields that only blocks of that type have.
+// Blocks without a type are paragraphs.
+type blockTypeFields struct {
+	Type     blockType `json:",omitempty"`
+	Level    int       `json:",omitempty"`
+	Checked  bool      `json:",omitempty"`
+	Language string    `json:",omitempty"`
+	Target   id        `json:",omitempty"`
+}
+
+// applyTo returns the block with its type and type specific fields taken from these
+func (f blockTypeFields) applyTo(b block) block {
+	b.blockType = f.Type
+	if b.blockType == "" {
+		b.blockType = blockTypeParagraph
+	}
+	b.level = f.Level
+	b.checked = f.Checked
+	b.language = f.Language
+	b.target = f.Target
+	return b
+}
+
+func typeFieldsOf(b block) blockTypeFields {
+	return blockTypeFields{
+		Type:     b.blockType,
+		Level:    b.level,
+		Checked:  b.checked,
+		Language: b.language,
+		Target:   b.target,
+	}
+}
+
+// validateTypeFields checks that the block is of a known type and only has the type specific fields of its type,
+// with valid values. Whether a reference's target exists is up to the store.
+func validateTypeFields(b block) error {
+	if !blockTypes[b.blockType] {
+		return errUnknownBlockType
+	}
+	if b.level != 0 && b.blockType != blockTypeHeading ||
+		b.checked && b.blockType != blockTypeTodo ||
+		b.language != "" && b.blockType != blockTypeCode ||
+		b.target != root && b.blockType != blockTypeReference {
+		return errFieldNotOfBlockType
+	}
+	switch b.blockType {
+	case blockTypeHeading:
+		if b.level < 1 || b.level > maxHeadingLevel {
+			return errInvalidHeadingLevel
+		}
+	case blockTypeCode:
+		// the language goes right after a Markdown code fence
+		if strings.ContainsAny(b.language, " \t\r\n`") {
+			return errInvalidCodeLanguage
+		}
+		if b.richText != nil {
+			return errFormattedCode
+		}
+	case blockTypeDivider:
+		if b.content != "" {
+			return errDividerWithContent
+		}
+	case blockTypeReference:
+		if b.target == root {
+			return errMissingReferenceTarget
+		}
+		if b.content != "" {
+			return errReferenceWithContent
+		}
+	}
+	return nil
+}
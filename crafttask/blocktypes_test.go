@@ -0,0 +1,249 @@
+package crafttask
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateTypeFields(t *testing.T) {
+	assert.NoError(t, validateTypeFields(blockRequest{Content: "text"}.fields()))
+	assert.NoError(t, validateTypeFields(block{blockType: blockTypeHeading, level: 6}))
+	assert.NoError(t, validateTypeFields(block{blockType: blockTypeCode, language: "c++"}))
+	assert.Equal(t, errUnknownBlockType, validateTypeFields(block{blockType: "table"}))
+	assert.Equal(t, errInvalidHeadingLevel, validateTypeFields(block{blockType: blockTypeHeading}))
+	assert.Equal(t, errInvalidHeadingLevel, validateTypeFields(block{blockType: blockTypeHeading, level: 7}))
+	assert.Equal(t, errFieldNotOfBlockType, validateTypeFields(block{blockType: blockTypeParagraph, checked: true}))
+	assert.Equal(t, errFieldNotOfBlockType, validateTypeFields(block{blockType: blockTypeTodo, level: 1}))
+	assert.Equal(t, errInvalidCodeLanguage, validateTypeFields(block{blockType: blockTypeCode, language: "go run"}))
+	assert.Equal(t, errDividerWithContent, validateTypeFields(block{blockType: blockTypeDivider, content: "text"}))
+}
+
+func TestInMemoryStore_InsertTyped(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeHeading, Level: 2}, Content: "Plan", Subblocks: []blockRequest{
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo}, Content: "Write it"},
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo, Checked: true}, Content: "Think it through"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeCode, Language: "go"}, Content: "if done {\n\treturn \"```\"\n}"}},
+		{ParentBlockId: root, Index: 2, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeDivider}}},
+		{ParentBlockId: root, Index: 3, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeQuote}, Content: "Simple is\n\nbetter"}},
+		{ParentBlockId: root, Index: 4, Block: blockRequest{Content: "[ ] not a todo"}},
+	})
+	require.NoError(t, err)
+
+	blocks := store.FetchBlocks([]id{1, 4})
+	require.Len(t, blocks, 2)
+	assert.Equal(t, blockTypeHeading, blocks[0].blockType)
+	assert.Equal(t, 2, blocks[0].level)
+	assert.Equal(t, blockTypeCode, blocks[1].blockType)
+	assert.Equal(t, "go", blocks[1].language)
+
+	_, err = store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "fine"}},
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "parent", Subblocks: []blockRequest{
+			{blockTypeFields: blockTypeFields{Type: blockTypeHeading, Level: 9}},
+		}}},
+	})
+	assert.Equal(t, operationErrors{1: errInvalidHeadingLevel}, err)
+	assertConsistent(t, store)
+}
+
+func TestInMemoryStore_UpdateTyped(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeHeading, Level: 2}, Content: "Plan", Subblocks: []blockRequest{
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo}, Content: "Write it"},
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo, Checked: true}, Content: "Think it through"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeCode, Language: "go"}, Content: "if done {\n\treturn \"```\"\n}"}},
+		{ParentBlockId: root, Index: 2, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeDivider}}},
+		{ParentBlockId: root, Index: 3, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeQuote}, Content: "Simple is\n\nbetter"}},
+		{ParentBlockId: root, Index: 4, Block: blockRequest{Content: "[ ] not a todo"}},
+	})
+	require.NoError(t, err)
+
+	updated, err := store.UpdateBlock(2, updatePayload{blockTypeFields: blockTypeFields{Type: blockTypeTodo, Checked: true}, Content: "Write it"})
+	require.NoError(t, err)
+	assert.True(t, updated.checked)
+
+	// without a type, the block keeps its type and only the content changes
+	updated, err = store.UpdateBlock(2, updatePayload{Content: "Write it down"})
+	require.NoError(t, err)
+	assert.Equal(t, blockTypeTodo, updated.blockType)
+	assert.True(t, updated.checked)
+
+	updated, err = store.UpdateBlock(2, updatePayload{blockTypeFields: blockTypeFields{Type: blockTypeParagraph}, Content: "Written"})
+	require.NoError(t, err)
+	assert.Equal(t, blockTypeParagraph, updated.blockType)
+	assert.False(t, updated.checked)
+
+	_, err = store.UpdateBlock(2, updatePayload{blockTypeFields: blockTypeFields{Checked: true}, Content: "Written"})
+	assert.Equal(t, errMissingBlockType, err)
+	_, err = store.UpdateBlock(5, updatePayload{Content: "a divider"})
+	assert.Equal(t, errDividerWithContent, err)
+
+	require.NoError(t, store.Undo())
+	require.NoError(t, store.Undo())
+	blocks := store.FetchBlocks([]id{2})
+	require.Len(t, blocks, 1)
+	assert.Equal(t, blockTypeTodo, blocks[0].blockType)
+	assert.True(t, blocks[0].checked)
+	assert.Equal(t, "Write it", blocks[0].content)
+}
+
+func TestInMemoryStore_ExportTyped(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeHeading, Level: 2}, Content: "Plan", Subblocks: []blockRequest{
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo}, Content: "Write it"},
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo, Checked: true}, Content: "Think it through"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeCode, Language: "go"}, Content: "if done {\n\treturn \"```\"\n}"}},
+		{ParentBlockId: root, Index: 2, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeDivider}}},
+		{ParentBlockId: root, Index: 3, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeQuote}, Content: "Simple is\n\nbetter"}},
+		{ParentBlockId: root, Index: 4, Block: blockRequest{Content: "[ ] not a todo"}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "Plan\n  [ ] Write it\n  [x] Think it through\nif done {\\n\treturn \"```\"\\n}\n---\nSimple is\\n\\nbetter\n\\[ ] not a todo\n", store.Export())
+
+	exporter, err := newMarkdownExporter(url.Values{})
+	require.NoError(t, err)
+	assert.Equal(t, "- ## Plan\n  - [ ] Write it\n  - [x] Think it through\n"+
+		"- ````go\n  if done {\n  \treturn \"```\"\n  }\n  ````\n"+
+		"- ---\n"+
+		"- > Simple is\n  >\n  > better\n"+
+		"- \\[ \\] not a todo\n", store.ExportWith(exporter))
+
+	assert.Equal(t, xml.Header+"<opml version=\"2.0\">\n  <head></head>\n  <body>\n"+
+		"    <outline text=\"Plan\" type=\"heading\" level=\"2\">\n"+
+		"      <outline text=\"Write it\" type=\"todo\" checked=\"false\"/>\n"+
+		"      <outline text=\"Think it through\" type=\"todo\" checked=\"true\"/>\n"+
+		"    </outline>\n"+
+		"    <outline text=\"if done {&#xA;&#x9;return &#34;```&#34;&#xA;}\" type=\"code\" language=\"go\"/>\n"+
+		"    <outline text=\"\" type=\"divider\"/>\n"+
+		"    <outline text=\"Simple is&#xA;&#xA;better\" type=\"quote\"/>\n"+
+		"    <outline text=\"[ ] not a todo\"/>\n"+
+		"  </body>\n</opml>\n", store.ExportWith(opmlExporter{}))
+
+	var document jsonDocument
+	require.NoError(t, json.Unmarshal([]byte(store.ExportWith(&jsonExporter{})), &document))
+	assert.Equal(t, blockTypeFields{Type: blockTypeHeading, Level: 2}, document.Blocks[0].blockTypeFields)
+	assert.Equal(t, blockTypeFields{Type: blockTypeTodo, Checked: true}, document.Blocks[0].Subblocks[1].blockTypeFields)
+	assert.Equal(t, blockTypeFields{}, document.Blocks[4].blockTypeFields)
+}
+
+func TestImportTypedRoundTrip(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeHeading, Level: 2}, Content: "Plan", Subblocks: []blockRequest{
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo}, Content: "Write it"},
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo, Checked: true}, Content: "Think it through"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeCode, Language: "go"}, Content: "if done {\n\treturn \"```\"\n}"}},
+		{ParentBlockId: root, Index: 2, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeDivider}}},
+		{ParentBlockId: root, Index: 3, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeQuote}, Content: "Simple is\n\nbetter"}},
+		{ParentBlockId: root, Index: 4, Block: blockRequest{Content: "[ ] not a todo"}},
+	})
+	require.NoError(t, err)
+	markdownExporter := func() exporter {
+		exporter, err := newMarkdownExporter(url.Values{})
+		require.NoError(t, err)
+		return exporter
+	}
+	for name, format := range map[string]struct {
+		newExporter func() exporter
+		importer    importer
+	}{
+		"markdown": {markdownExporter, importMarkdown},
+		"opml":     {func() exporter { return opmlExporter{} }, importOpml},
+		"json":     {func() exporter { return &jsonExporter{} }, importJson},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assertRoundTrip(t, store, format.newExporter, format.importer)
+			blocks, err := format.importer(store.ExportWith(format.newExporter()))
+			require.NoError(t, err)
+			imported := NewInMemoryStore()
+			_, err = imported.InsertBlocks(insertOperationsAt(root, 0, blocks))
+			require.NoError(t, err)
+			assert.Equal(t, store.ExportWith(&jsonExporter{}), imported.ExportWith(&jsonExporter{}))
+		})
+	}
+}
+
+func TestImportMarkdown_Typed(t *testing.T) {
+	blocks, err := importMarkdown("- [X] done\n- #### Small\n- ```\n  code\n\n  ```\n")
+	require.NoError(t, err)
+	assert.Equal(t, []blockRequest{
+		{blockTypeFields: blockTypeFields{Type: blockTypeTodo, Checked: true}, Content: "done", Subblocks: []blockRequest{}},
+		{blockTypeFields: blockTypeFields{Type: blockTypeHeading, Level: 4}, Content: "Small", Subblocks: []blockRequest{}},
+		{blockTypeFields: blockTypeFields{Type: blockTypeCode}, Content: "code\n", Subblocks: []blockRequest{}},
+	}, blocks)
+
+	_, err = importMarkdown("- ```js\n  let a\n- next\n")
+	assert.Equal(t, lineErrors{{line: 1, message: "code fence not closed"}}, err)
+	_, err = importMarkdown("- ```js\n  let a\n")
+	assert.Equal(t, lineErrors{{line: 1, message: "code fence not closed"}}, err)
+}
+
+func TestImportOpml_Typed(t *testing.T) {
+	blocks, err := importOpml(`<opml version="2.0"><body>
+<outline text="feed" type="rss" level="3"/>
+<outline text="Title" type="heading" level="1"/>
+</body></opml>`)
+	require.NoError(t, err)
+	assert.Equal(t, []blockRequest{
+		{Content: "feed", Subblocks: []blockRequest{}},
+		{blockTypeFields: blockTypeFields{Type: blockTypeHeading, Level: 1}, Content: "Title", Subblocks: []blockRequest{}},
+	}, blocks)
+
+	_, err = importOpml(`<opml version="2.0"><body>
+<outline text="Title" type="heading" level="high"/>
+<outline text="Title" type="heading" level="7"/>
+<outline text="---" type="divider"/>
+</body></opml>`)
+	assert.Equal(t, lineErrors{
+		{line: 2, message: "heading without a level attribute that is a number"},
+		{line: 3, message: errInvalidHeadingLevel.Error()},
+		{line: 4, message: errDividerWithContent.Error()},
+	}, err)
+}
+
+func TestAPI_TypedBlocks(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+
+	response := doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Type":"todo","Content":"Buy milk"}}]`)
+	require.Equal(t, http.StatusCreated, response.Code)
+	var blocks []blockResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&blocks))
+	require.Len(t, blocks, 1)
+	assert.Equal(t, blockTypeTodo, blocks[0].Type)
+	require.NotNil(t, blocks[0].Checked)
+	assert.False(t, *blocks[0].Checked)
+
+	response = doRequest(t, r, "PATCH", "/documents/1/blocks/1", `{"Type":"todo","Checked":true,"Content":"Buy milk"}`)
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"Id":1,"Type":"todo","Checked":true,"Content":"Buy milk","Subblocks":[]}`, response.Body.String())
+	response = doRequest(t, r, "PATCH", "/documents/1/blocks/1", `{"Type":"heading","Level":0,"Content":"Milk"}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Type":"table"}},{"ParentBlockId":0,"Index":0,"Block":{"Language":"go"}}]`)
+	require.Equal(t, http.StatusBadRequest, response.Code)
+	var results []operationResult
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&results))
+	require.Len(t, results, 2)
+	assert.Equal(t, "unknown_block_type", results[0].ErrorCode)
+	assert.Equal(t, "invalid_block_type_fields", results[1].ErrorCode)
+
+	response = doRequest(t, r, "GET", "/documents/1/diff?from=1&to=2", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"Change":"type_changed","BlockId":1,"OldType":{"Type":"todo"},"NewType":{"Type":"todo","Checked":true}`)
+}
@@ -0,0 +1,261 @@
+package crafttask
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+const (
+	changeInserted       = "inserted"
+	changeDeleted        = "deleted"
+	changeMoved          = "moved"
+	changeContentChanged = "content_changed"
+	// the block's type or its type specific fields changed, e.g. a todo was checked
+	changeTypeChanged = "type_changed"
+	// properties were set or unset
+	changePropertiesChanged = "properties_changed"
+	changeDuplicated        = "duplicated"
+)
+
+type blockPosition struct {
+	parentId id
+	index    int
+}
+
+// blockChange is one block-level difference between two revisions; positions and contents are set when they apply
+// to the kind of change, e.g. an inserted block has no old position. A content change is a change of the content's
+// formatting too.
+type blockChange struct {
+	kind          string
+	blockId       id
+	duplicateOf   id
+	oldPosition   *blockPosition
+	newPosition   *blockPosition
+	oldContent    string
+	newContent    string
+	oldRichText   []textRun
+	newRichText   []textRun
+	oldType       blockTypeFields
+	newType       blockTypeFields
+	oldProperties properties
+	newProperties properties
+}
+
+type documentDiff struct {
+	from    uint64
+	to      uint64
+	changes []blockChange
+	// the change between the two revisions' exports as a unified diff
+	unified string
+}
+
+// Diff compares the document at two revisions: the deleted blocks in the old document's order, then the other
+// changes in the new one's, a block changed in several ways having a change of each kind
+func (st *InMemoryStore) Diff(fromRevision uint64, toRevision uint64) (documentDiff, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	if fromRevision > toRevision {
+		return documentDiff{}, errInvalidRevisionRange
+	}
+	fromStore, err := st.atRevision(fromRevision)
+	if err != nil {
+		return documentDiff{}, err
+	}
+	toStore, err := st.atRevision(toRevision)
+	if err != nil {
+		return documentDiff{}, err
+	}
+	fromTree := flattenTree(fromStore.document.blocks)
+	toTree := flattenTree(toStore.document.blocks)
+	copiedFrom := st.copiedBetween(fromRevision, toRevision)
+
+	changes := make([]blockChange, 0)
+	for _, blockId := range fromTree.order {
+		if _, stillExists := toTree.blocks[blockId]; !stillExists {
+			oldBlock := fromTree.blocks[blockId]
+			changes = append(changes, blockChange{
+				kind:        changeDeleted,
+				blockId:     blockId,
+				oldPosition: &blockPosition{oldBlock.parentId, oldBlock.index},
+				oldContent:  oldBlock.content,
+			})
+		}
+	}
+	movedWithinParent := fromTree.reorderedBlocks(toTree)
+	for _, blockId := range toTree.order {
+		newBlock := toTree.blocks[blockId]
+		oldBlock, existed := fromTree.blocks[blockId]
+		if !existed {
+			change := blockChange{
+				kind:        changeInserted,
+				blockId:     blockId,
+				newPosition: &blockPosition{newBlock.parentId, newBlock.index},
+				newContent:  newBlock.content,
+			}
+			if sourceId, isCopy := copiedFrom[blockId]; isCopy {
+				change.kind = changeDuplicated
+				change.duplicateOf = sourceId
+			}
+			changes = append(changes, change)
+			continue
+		}
+		if oldBlock.parentId != newBlock.parentId || movedWithinParent[blockId] {
+			changes = append(changes, blockChange{
+				kind:        changeMoved,
+				blockId:     blockId,
+				oldPosition: &blockPosition{oldBlock.parentId, oldBlock.index},
+				newPosition: &blockPosition{newBlock.parentId, newBlock.index},
+			})
+		}
+		if oldBlock.content != newBlock.content || !reflect.DeepEqual(oldBlock.richText, newBlock.richText) {
+			changes = append(changes, blockChange{
+				kind:        changeContentChanged,
+				blockId:     blockId,
+				oldContent:  oldBlock.content,
+				newContent:  newBlock.content,
+				oldRichText: oldBlock.richText,
+				newRichText: newBlock.richText,
+			})
+		}
+		if oldBlock.typeFields != newBlock.typeFields {
+			changes = append(changes, blockChange{
+				kind:    changeTypeChanged,
+				blockId: blockId,
+				oldType: oldBlock.typeFields,
+				newType: newBlock.typeFields,
+			})
+		}
+		if !oldBlock.properties.equal(newBlock.properties) {
+			changes = append(changes, blockChange{
+				kind:          changePropertiesChanged,
+				blockId:       blockId,
+				oldProperties: oldBlock.properties,
+				newProperties: newBlock.properties,
+			})
+		}
+	}
+	return documentDiff{
+		from:    fromRevision,
+		to:      toRevision,
+		changes: changes,
+		unified: unifiedDiff(
+			fmt.Sprintf("revision %d", fromRevision), fmt.Sprintf("revision %d", toRevision),
+			fromStore.Export(), toStore.Export(),
+		),
+	}, nil
+}
+
+// copiedBetween collects which block each block duplicated in the revisions after from up to to was copied from
+func (st *InMemoryStore) copiedBetween(fromRevision uint64, toRevision uint64) map[id]id {
+	copiedFrom := make(map[id]id)
+	for _, revision := range st.revisions.log {
+		if revision.number <= fromRevision || revision.number > toRevision {
+			continue
+		}
+		for _, m := range revision.tx.mutations {
+			if m.kind != mutationInsert {
+				continue
+			}
+			for copyId, sourceId := range m.copiedFrom {
+				copiedFrom[copyId] = sourceId
+			}
+		}
+	}
+	return copiedFrom
+}
+
+type flatBlock struct {
+	parentId   id
+	index      int
+	content    string
+	richText   []textRun
+	typeFields blockTypeFields
+	properties properties
+}
+
+// flatTree indexes every block of a document by id
+type flatTree struct {
+	blocks map[id]flatBlock
+	// block ids in document order
+	order []id
+	// subblock ids by parent id, in order
+	subblocks map[id][]id
+}
+
+func flattenTree(topLevelBlocks *orderedMapOfBlocks) flatTree {
+	tree := flatTree{
+		blocks:    make(map[id]flatBlock),
+		order:     make([]id, 0),
+		subblocks: make(map[id][]id),
+	}
+	tree.add(root, topLevelBlocks)
+	return tree
+}
+
+func (tree *flatTree) add(parentId id, blocks *orderedMapOfBlocks) {
+	for index, blockToAdd := range blocks.OrderedValues() {
+		tree.blocks[blockToAdd.id] = flatBlock{
+			parentId:   parentId,
+			index:      index,
+			content:    blockToAdd.content,
+			richText:   blockToAdd.richText,
+			typeFields: typeFieldsOf(blockToAdd),
+			properties: blockToAdd.properties,
+		}
+		tree.order = append(tree.order, blockToAdd.id)
+		tree.subblocks[parentId] = append(tree.subblocks[parentId], blockToAdd.id)
+		tree.add(blockToAdd.id, blockToAdd.subblocks)
+	}
+}
+
+// reorderedBlocks finds the blocks that kept their parent but were moved among its subblocks. Inserting or removing
+// a sibling shifts indexes without moving anything, so the blocks that stayed are the longest run of siblings
+// still in their old relative order, and the others are the ones that were moved.
+func (tree flatTree) reorderedBlocks(newTree flatTree) map[id]bool {
+	reordered := make(map[id]bool)
+	for parentId, newSubblocks := range newTree.subblocks {
+		keptSubblocks := make([]id, 0, len(newSubblocks))
+		oldIndexes := make([]int, 0, len(newSubblocks))
+		for _, blockId := range newSubblocks {
+			if oldBlock, existed := tree.blocks[blockId]; existed && oldBlock.parentId == parentId {
+				keptSubblocks = append(keptSubblocks, blockId)
+				oldIndexes = append(oldIndexes, oldBlock.index)
+			}
+		}
+		inOrder := longestIncreasingRun(oldIndexes)
+		for i, blockId := range keptSubblocks {
+			if !inOrder[i] {
+				reordered[blockId] = true
+			}
+		}
+	}
+	return reordered
+}
+
+// longestIncreasingRun marks the elements of a longest increasing subsequence of the distinct values
+func longestIncreasingRun(values []int) []bool {
+	// tails[l] is the position of the smallest value ending an increasing subsequence of length l+1
+	tails := make([]int, 0, len(values))
+	previous := make([]int, len(values))
+	for i, value := range values {
+		length := sort.Search(len(tails), func(l int) bool { return values[tails[l]] >= value })
+		previous[i] = -1
+		if length > 0 {
+			previous[i] = tails[length-1]
+		}
+		if length == len(tails) {
+			tails = append(tails, i)
+		} else {
+			tails[length] = i
+		}
+	}
+	inRun := make([]bool, len(values))
+	if len(tails) == 0 {
+		return inRun
+	}
+	for i := tails[len(tails)-1]; i >= 0; i = previous[i] {
+		inRun[i] = true
+	}
+	return inRun
+}
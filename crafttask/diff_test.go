@@ -0,0 +1,135 @@
+package crafttask
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryStore_Diff(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2", Subblocks: []blockRequest{{Content: "Child Block 3"}}}},
+		{ParentBlockId: root, Index: 2, Block: blockRequest{Content: "Block 4"}},
+		{ParentBlockId: root, Index: 3, Block: blockRequest{Content: "Block 5"}},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, store.DeleteBlocks([]id{1}))
+	require.NoError(t, store.MoveBlock(5, movePayload{NewParentId: root, Index: 0}))
+	require.NoError(t, store.MoveBlock(4, movePayload{NewParentId: 2, Index: 0}))
+	_, err = store.UpdateBlock(2, updatePayload{Content: "Updated Block 2"})
+	require.NoError(t, err)
+	_, err = store.DuplicateBlock(5)
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 100, Block: blockRequest{Content: "Block 7"}}})
+	require.NoError(t, err)
+
+	diff, err := store.Diff(1, 7)
+	require.NoError(t, err)
+	assert.Equal(t, []blockChange{
+		{kind: changeDeleted, blockId: 1, oldPosition: &blockPosition{root, 0}, oldContent: "Block 1"},
+		{kind: changeMoved, blockId: 5, oldPosition: &blockPosition{root, 3}, newPosition: &blockPosition{root, 0}},
+		{kind: changeDuplicated, blockId: 6, duplicateOf: 5, newPosition: &blockPosition{root, 1}, newContent: "Block 5"},
+		{kind: changeContentChanged, blockId: 2, oldContent: "Block 2", newContent: "Updated Block 2"},
+		{kind: changeMoved, blockId: 4, oldPosition: &blockPosition{root, 2}, newPosition: &blockPosition{2, 0}},
+		{kind: changeInserted, blockId: 7, newPosition: &blockPosition{root, 3}, newContent: "Block 7"},
+	}, diff.changes, "block 2 and 3 only shifted, they didn't move")
+	assert.Equal(t, "--- revision 1\n+++ revision 7\n"+
+		"@@ -1,5 +1,6 @@\n"+
+		"-Block 1\n"+
+		"-Block 2\n"+
+		"+Block 5\n"+
+		"+Block 5\n"+
+		"+Updated Block 2\n"+
+		"+  Block 4\n"+
+		"   Child Block 3\n"+
+		"-Block 4\n"+
+		"-Block 5\n"+
+		"+Block 7\n", diff.unified)
+
+	diff, err = store.Diff(3, 3)
+	require.NoError(t, err)
+	assert.Empty(t, diff.changes)
+	assert.Equal(t, "", diff.unified)
+
+	_, err = store.Diff(3, 2)
+	assert.Equal(t, errInvalidRevisionRange, err)
+	_, err = store.Diff(1, 8)
+	assert.Equal(t, errRevisionDoesNotExist, err)
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	from := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\n17\n18\n19\n20\n"
+	to := "1\n2\n3\nfour\n5\n6\n7\n8\n9\n10\n12\n13\n14\n15\n16\n17\n18\n19\n20\n21\n"
+	assert.Equal(t, "--- a\n+++ b\n"+
+		"@@ -1,14 +1,13 @@\n 1\n 2\n 3\n-4\n+four\n 5\n 6\n 7\n 8\n 9\n 10\n-11\n 12\n 13\n 14\n"+
+		"@@ -18,3 +17,4 @@\n 18\n 19\n 20\n+21\n", unifiedDiff("a", "b", from, to))
+
+	assert.Equal(t, "--- a\n+++ b\n@@ -0,0 +1 @@\n+1\n", unifiedDiff("a", "b", "", "1\n"))
+	assert.Equal(t, "--- a\n+++ b\n@@ -1,2 +0,0 @@\n-1\n-2\n", unifiedDiff("a", "b", "1\n2\n", ""))
+}
+
+func TestDiffLines_ShortestEditScript(t *testing.T) {
+	from := make([]string, 0, 3000)
+	to := make([]string, 0, 3000)
+	for i := 0; i < 3000; i++ {
+		from = append(from, fmt.Sprint(i))
+		if i%3 == 0 {
+			to = append(to, fmt.Sprintf("changed %d", i))
+		} else {
+			to = append(to, fmt.Sprint(i))
+		}
+	}
+	edits := diffLines(from, to)
+	var rebuiltFrom, rebuiltTo []string
+	removed := 0
+	for _, edit := range edits {
+		if edit.operation != '+' {
+			rebuiltFrom = append(rebuiltFrom, edit.line)
+		}
+		if edit.operation != '-' {
+			rebuiltTo = append(rebuiltTo, edit.line)
+		}
+		if edit.operation == '-' {
+			removed++
+		}
+	}
+	assert.Equal(t, from, rebuiltFrom)
+	assert.Equal(t, to, rebuiltTo)
+	assert.Equal(t, 1000, removed, "only the changed lines are removed and added")
+
+	assert.Equal(t, []lineEdit{{'-', "a"}, {'-', "b"}, {'+', "c"}}, diffLines([]string{"a", "b"}, []string{"c"}))
+}
+
+func TestAPI_Diff(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block 1"}}]`)
+	doRequest(t, r, "PATCH", "/documents/1/blocks/1", `{"Content":"Updated Block 1"}`)
+
+	response := doRequest(t, r, "GET", "/documents/1/diff?from=0&to=2", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	var diff diffResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&diff))
+	newContent := "Updated Block 1"
+	assert.Equal(t, diffResponse{From: 0, To: 2, Changes: []blockChangeResponse{
+		{Change: "inserted", BlockId: 1, NewPosition: &blockPositionResponse{ParentId: root, Index: 0}, NewContent: &newContent},
+	}}, diff)
+
+	response = doRequest(t, r, "GET", "/documents/1/diff?from=1&to=2&format=unified", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "--- revision 1\n+++ revision 2\n@@ -1 +1 @@\n-Block 1\n+Updated Block 1\n", response.Body.String())
+
+	response = doRequest(t, r, "GET", "/documents/1/diff?from=2&to=1", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doRequest(t, r, "GET", "/documents/1/diff?from=1", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doRequest(t, r, "GET", "/documents/1/diff?from=1&to=5", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
@@ -0,0 +1,11 @@
+// Package crafttask stores documents of nested blocks and serves them over HTTP.
+//
+// The export endpoint writes, and the import endpoint reads, these formats (?format=):
+//   - text: a line per block indented by two spaces per level; todos start with "[ ] " or "[x] " and dividers
+//     are "---", and backslashes escape line breaks and anything at the start of the content that looks like those
+//   - markdown: nested bullet lists, the blocks less deep than ?headingDepth= as headings; marks as inline markup
+//   - opml: an outline per block, its fields in the text, type, level, checked and language attributes, formatted
+//     content as Markdown-style markup in _note and the properties as attributes of their own
+//   - json: every field of every block, ids included, read back as it was
+//   - html: nested lists with an anchor per block, for export only
+package crafttask
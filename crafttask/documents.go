@@ -0,0 +1,344 @@
+package crafttask
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	catalogFileName = "documents.json"
+	// migratedDocumentName is the name of the document a single-document data directory is migrated into
+	migratedDocumentName = "Document"
+)
+
+// DocumentStore keeps track of every document; each document is a separate Store,
+// so it has its own tree, parent index and id space
+type DocumentStore interface {
+	CreateDocument(name string) (documentInfo, error)
+	ListDocuments() []documentInfo
+	FetchDocument(documentId id) (documentInfo, error)
+	RenameDocument(documentId id, name string) (documentInfo, error)
+	DeleteDocument(documentId id) error
+	Document(documentId id) (Store, error)
+}
+
+type documentInfo struct {
+	id   id
+	name string
+}
+
+type openDocument struct {
+	info  documentInfo
+	store Store
+}
+
+// Documents is a DocumentStore keeping the documents either only in memory or,
+// when it has a directory, each in its own FileStore under that directory
+type Documents struct {
+	lock         sync.RWMutex
+	documents    map[id]openDocument
+	idGenerator  idGenerator
+	dir          string
+	storeOptions FileStoreOptions
+}
+
+type persistedCatalog struct {
+	LastId    id
+	Documents []persistedDocument
+}
+
+type persistedDocument struct {
+	Id   id
+	Name string
+}
+
+func NewInMemoryDocuments() *Documents {
+	return &Documents{
+		documents:   make(map[id]openDocument),
+		idGenerator: newInMemoryIdGenerator(),
+	}
+}
+
+// NewFileDocuments opens the documents persisted in dir, creating it if needed
+func NewFileDocuments(dir string, storeOptions FileStoreOptions) (*Documents, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	d := &Documents{
+		documents:    make(map[id]openDocument),
+		idGenerator:  newInMemoryIdGenerator(),
+		dir:          dir,
+		storeOptions: storeOptions,
+	}
+	catalog, err := readCatalog(filepath.Join(dir, catalogFileName))
+	if err != nil {
+		return nil, err
+	}
+	if catalog, err = d.migrateSingleDocument(catalog); err != nil {
+		return nil, err
+	}
+	d.idGenerator.advanceTo(catalog.LastId)
+	for _, persisted := range catalog.Documents {
+		store, err := d.openStore(persisted.Id)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		d.documents[persisted.Id] = openDocument{
+			info:  documentInfo{id: persisted.Id, name: persisted.Name},
+			store: store,
+		}
+	}
+	return d, nil
+}
+
+// migrateSingleDocument moves the log and snapshots of a data directory from before there were several documents,
+// which are right in the directory, into the directory of a first document, and adds that to the catalog.
+// The files are moved before the catalog is saved, so a migration that was cut short is finished on the next start.
+// Those files next to documents from the catalog can't be told apart from a broken directory, so that fails instead.
+func (d *Documents) migrateSingleDocument(catalog persistedCatalog) (persistedCatalog, error) {
+	singleDocumentFiles, err := listSnapshots(d.dir)
+	if err != nil {
+		return catalog, err
+	}
+	walPath := filepath.Join(d.dir, walFileName)
+	if _, err := os.Stat(walPath); err == nil {
+		singleDocumentFiles = append(singleDocumentFiles, walPath)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return catalog, err
+	}
+	if len(singleDocumentFiles) == 0 {
+		return catalog, nil
+	}
+	if len(catalog.Documents) > 0 {
+		return catalog, errUnmigratedDocument
+	}
+	documentId := d.idGenerator.getNewId()
+	documentDir := d.documentDir(documentId)
+	if err := os.MkdirAll(documentDir, 0o755); err != nil {
+		return catalog, err
+	}
+	for _, path := range singleDocumentFiles {
+		if err := os.Rename(path, filepath.Join(documentDir, filepath.Base(path))); err != nil {
+			return catalog, err
+		}
+	}
+	if err := syncDir(documentDir); err != nil {
+		return catalog, err
+	}
+	if err := syncDir(d.dir); err != nil {
+		return catalog, err
+	}
+	catalog = persistedCatalog{
+		LastId:    documentId,
+		Documents: []persistedDocument{{Id: documentId, Name: migratedDocumentName}},
+	}
+	return catalog, d.writeCatalog(catalog)
+}
+
+func (d *Documents) openStore(documentId id) (Store, error) {
+	if d.dir == "" {
+		return NewInMemoryStore(), nil
+	}
+	return NewFileStore(d.documentDir(documentId), d.storeOptions)
+}
+
+func (d *Documents) documentDir(documentId id) string {
+	return filepath.Join(d.dir, strconv.FormatUint(uint64(documentId), 10))
+}
+
+func (d *Documents) CreateDocument(name string) (documentInfo, error) {
+	name, err := validateDocumentName(name)
+	if err != nil {
+		return documentInfo{}, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	documentId := d.idGenerator.getNewId()
+	store, err := d.openStore(documentId)
+	if err != nil {
+		return documentInfo{}, err
+	}
+	info := documentInfo{id: documentId, name: name}
+	d.documents[documentId] = openDocument{info: info, store: store}
+	if err := d.saveCatalog(); err != nil {
+		delete(d.documents, documentId)
+		closeStore(store)
+		return documentInfo{}, err
+	}
+	return info, nil
+}
+
+func (d *Documents) ListDocuments() []documentInfo {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.sortedInfos()
+}
+
+func (d *Documents) sortedInfos() []documentInfo {
+	toReturn := make([]documentInfo, 0, len(d.documents))
+	for _, document := range d.documents {
+		toReturn = append(toReturn, document.info)
+	}
+	sort.Slice(toReturn, func(i, j int) bool { return toReturn[i].id < toReturn[j].id })
+	return toReturn
+}
+
+func (d *Documents) FetchDocument(documentId id) (documentInfo, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	document, ok := d.documents[documentId]
+	if !ok {
+		return documentInfo{}, errDocumentDoesNotExist
+	}
+	return document.info, nil
+}
+
+func (d *Documents) RenameDocument(documentId id, name string) (documentInfo, error) {
+	name, err := validateDocumentName(name)
+	if err != nil {
+		return documentInfo{}, err
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	document, ok := d.documents[documentId]
+	if !ok {
+		return documentInfo{}, errDocumentDoesNotExist
+	}
+	oldName := document.info.name
+	document.info.name = name
+	d.documents[documentId] = document
+	if err := d.saveCatalog(); err != nil {
+		document.info.name = oldName
+		d.documents[documentId] = document
+		return documentInfo{}, err
+	}
+	return document.info, nil
+}
+
+// DeleteDocument removes the document and closes its store. Requests that got the store before can still read it,
+// but their writes fail with errStoreClosed.
+func (d *Documents) DeleteDocument(documentId id) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	document, ok := d.documents[documentId]
+	if !ok {
+		return errDocumentDoesNotExist
+	}
+	delete(d.documents, documentId)
+	if err := d.saveCatalog(); err != nil {
+		d.documents[documentId] = document
+		return err
+	}
+	closeStore(document.store)
+	if d.dir != "" {
+		return os.RemoveAll(d.documentDir(documentId))
+	}
+	return nil
+}
+
+func (d *Documents) Document(documentId id) (Store, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	document, ok := d.documents[documentId]
+	if !ok {
+		return nil, errDocumentDoesNotExist
+	}
+	return document.store, nil
+}
+
+func (d *Documents) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var closeErr error
+	for _, document := range d.documents {
+		if err := closeStore(document.store); err != nil {
+			closeErr = err
+		}
+	}
+	return closeErr
+}
+
+func closeStore(store Store) error {
+	if closer, ok := store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+func validateDocumentName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errInvalidDocumentName
+	}
+	return name, nil
+}
+
+// saveCatalog replaces the catalog file atomically, so it is either the old or the new list of documents
+func (d *Documents) saveCatalog() error {
+	if d.dir == "" {
+		return nil
+	}
+	catalog := persistedCatalog{
+		LastId:    d.idGenerator.lastId(),
+		Documents: make([]persistedDocument, 0, len(d.documents)),
+	}
+	for _, info := range d.sortedInfos() {
+		catalog.Documents = append(catalog.Documents, persistedDocument{Id: info.id, Name: info.name})
+	}
+	return d.writeCatalog(catalog)
+}
+
+func (d *Documents) writeCatalog(catalog persistedCatalog) error {
+	payload, err := json.Marshal(catalog)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.dir, catalogFileName)
+	tempPath := path + ".tmp"
+	if err := writeFileSynced(tempPath, payload); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	return syncDir(d.dir)
+}
+
+func readCatalog(path string) (persistedCatalog, error) {
+	payload, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return persistedCatalog{}, nil
+	}
+	if err != nil {
+		return persistedCatalog{}, err
+	}
+	var catalog persistedCatalog
+	if err := json.Unmarshal(payload, &catalog); err != nil {
+		return persistedCatalog{}, err
+	}
+	return catalog, nil
+}
+
+func writeFileSynced(path string, payload []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(payload); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,135 @@
+package crafttask
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDocuments_SeparateIdSpaces(t *testing.T) {
+	documents := NewInMemoryDocuments()
+
+	document1, err := documents.CreateDocument("Document 1")
+	require.NoError(t, err)
+	document2, err := documents.CreateDocument("Document 2")
+	require.NoError(t, err)
+
+	store1, err := documents.Document(document1.id)
+	require.NoError(t, err)
+	store2, err := documents.Document(document2.id)
+	require.NoError(t, err)
+
+	blocks1, err := store1.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block in 1"}}})
+	require.NoError(t, err)
+	blocks2, err := store2.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block in 2"}}})
+	require.NoError(t, err)
+
+	assert.Equal(t, id(1), blocks1[0].id)
+	assert.Equal(t, id(1), blocks2[0].id)
+	assert.Equal(t, "Block in 1\n", store1.Export())
+	assert.Equal(t, "Block in 2\n", store2.Export())
+}
+
+func TestDocuments_CreateRenameDelete(t *testing.T) {
+	documents := NewInMemoryDocuments()
+
+	_, err := documents.CreateDocument("  ")
+	assert.Equal(t, errInvalidDocumentName, err)
+
+	document1, err := documents.CreateDocument("Document 1")
+	require.NoError(t, err)
+	document2, err := documents.CreateDocument("Document 2")
+	require.NoError(t, err)
+
+	renamed, err := documents.RenameDocument(document1.id, "Renamed")
+	require.NoError(t, err)
+	assert.Equal(t, "Renamed", renamed.name)
+
+	require.NoError(t, documents.DeleteDocument(document2.id))
+	_, err = documents.Document(document2.id)
+	assert.Equal(t, errDocumentDoesNotExist, err)
+	assert.Equal(t, errDocumentDoesNotExist, documents.DeleteDocument(document2.id))
+
+	assert.Equal(t, []documentInfo{{id: document1.id, name: "Renamed"}}, documents.ListDocuments())
+}
+
+func TestFileDocuments_PersistAcrossReopen(t *testing.T) {
+	dir := t.TempDir()
+	documents, err := NewFileDocuments(dir, FileStoreOptions{})
+	require.NoError(t, err)
+
+	document1, err := documents.CreateDocument("Document 1")
+	require.NoError(t, err)
+	document2, err := documents.CreateDocument("Document 2")
+	require.NoError(t, err)
+	_, err = documents.RenameDocument(document1.id, "Renamed")
+	require.NoError(t, err)
+
+	store1, err := documents.Document(document1.id)
+	require.NoError(t, err)
+	_, err = store1.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+
+	require.NoError(t, documents.DeleteDocument(document2.id))
+	_, err = os.Stat(documents.documentDir(document2.id))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, documents.Close())
+
+	reopened, err := NewFileDocuments(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	assert.Equal(t, []documentInfo{{id: document1.id, name: "Renamed"}}, reopened.ListDocuments())
+	reopenedStore1, err := reopened.Document(document1.id)
+	require.NoError(t, err)
+	assert.Equal(t, "Block 1\n", reopenedStore1.Export())
+
+	document3, err := reopened.CreateDocument("Document 3")
+	require.NoError(t, err)
+	assert.Equal(t, id(3), document3.id, "document ids should not be reused")
+}
+
+func TestFileDocuments_MigratesSingleDocumentDirectory(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 2})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: i, Block: blockRequest{Content: "Block"}}})
+		require.NoError(t, err)
+	}
+	expectedExport := store.Export()
+	require.NoError(t, store.Close())
+
+	documents, err := NewFileDocuments(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []documentInfo{{id: 1, name: migratedDocumentName}}, documents.ListDocuments())
+	migrated, err := documents.Document(1)
+	require.NoError(t, err)
+	assert.Equal(t, expectedExport, migrated.Export())
+	_, err = os.Stat(filepath.Join(dir, walFileName))
+	assert.True(t, os.IsNotExist(err), "the log is moved")
+	require.NoError(t, documents.Close())
+
+	// a single document's log showing up next to the catalog isn't migrated over the documents
+	require.NoError(t, os.WriteFile(filepath.Join(dir, walFileName), nil, 0o644))
+	_, err = NewFileDocuments(dir, FileStoreOptions{})
+	assert.Equal(t, errUnmigratedDocument, err)
+}
+
+func TestFileDocuments_WritesToDeletedDocumentFail(t *testing.T) {
+	documents, err := NewFileDocuments(t.TempDir(), FileStoreOptions{})
+	require.NoError(t, err)
+	defer documents.Close()
+	document, err := documents.CreateDocument("Document 1")
+	require.NoError(t, err)
+	store, err := documents.Document(document.id)
+	require.NoError(t, err)
+
+	require.NoError(t, documents.DeleteDocument(document.id))
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	assert.ErrorIs(t, err, errDocumentDoesNotExist)
+	assert.Empty(t, store.Export(), "the write isn't applied either")
+}
@@ -1,7 +1,86 @@
 package crafttask
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
 
 var errBlockDoesNotExist = errors.New("block does not exist")
 var errParentBlockDoesNotExist = errors.New("parent block does not exist")
 var errBlockMovedToItsChild = errors.New("block attempt to move to its child")
+var errDocumentDoesNotExist = errors.New("document does not exist")
+
+// errStoreClosed is what writes to the store of a deleted document get when they come in after it was closed
+var errStoreClosed = fmt.Errorf("%w any more", errDocumentDoesNotExist)
+var errUnmigratedDocument = errors.New("data directory has a single document's log or snapshots next to its catalog of documents")
+var errInvalidDocumentName = errors.New("document name must not be empty")
+var errInvalidIndex = errors.New("index must not be negative")
+var errUnknownRef = errors.New("ref does not name a block created earlier in the batch")
+var errDuplicateRef = errors.New("ref is already used earlier in the batch")
+var errUnknownOperation = errors.New("unknown operation")
+var errNothingToUndo = errors.New("nothing to undo")
+var errNothingToRedo = errors.New("nothing to redo")
+var errRevisionDoesNotExist = errors.New("revision does not exist")
+var errRevisionNotAvailable = errors.New("revision is too old to be rebuilt")
+var errInvalidRevisionRange = errors.New("from revision is after to revision")
+var errMissingBlockId = errors.New("block has no id to keep")
+var errBlockIdTaken = errors.New("block id is already taken in the document")
+var errBlockNotInTrash = errors.New("block is not in the trash")
+var errOriginalParentDoesNotExist = errors.New("block's original parent does not exist anymore")
+var errUnknownBlockType = errors.New("block type has to be paragraph, heading, todo, code, quote, divider or reference")
+var errFieldNotOfBlockType = errors.New("block has a field its type doesn't have")
+var errInvalidHeadingLevel = errors.New("heading level has to be from 1 to 6")
+var errInvalidCodeLanguage = errors.New("code language must not contain spaces or backticks")
+var errDividerWithContent = errors.New("divider must not have content")
+var errMissingBlockType = errors.New("type specific fields need the type they belong to")
+var errFormattedCode = errors.New("code blocks can't have formatting")
+var errMissingReferenceTarget = errors.New("reference must have a target")
+var errReferenceWithContent = errors.New("reference must not have content, it shows its target's")
+var errReferenceTargetDoesNotExist = errors.New("reference target does not exist")
+var errReferenceCycle = errors.New("reference refers back to itself")
+var errEmptyTextRun = errors.New("rich text runs must not be empty")
+var errUnknownTextMark = errors.New("text mark has to be bold, italic, strikethrough or code")
+var errInvalidCodeMark = errors.New("code can't be combined with other marks or span lines")
+var errInvalidLink = errors.New("link has to be an absolute URL without spaces or a link to a block, e.g. #block-3")
+var errRichTextMismatch = errors.New("content has to be the rich text's plain text")
+var errInvalidPropertyName = errors.New("property name must not be blank")
+var errUnknownPropertyType = errors.New("property type has to be string, number, bool, date or list")
+var errInvalidPropertyValue = errors.New("property value is not of the property's type")
+var errEmptySearchQuery = errors.New("search query must have a word to search for")
+var errUnclosedSearchPhrase = errors.New("search query has a phrase without its closing quote")
+
+// operationErrors is returned when operations of a bulk request are invalid, keyed by each operation's position in the request
+type operationErrors map[int]error
+
+func (e operationErrors) Error() string {
+	return fmt.Sprintf("%d operations are invalid", len(e))
+}
+
+// first is the error of the earliest invalid operation
+func (e operationErrors) first() error {
+	first := -1
+	for i := range e {
+		if first == -1 || i < first {
+			first = i
+		}
+	}
+	return e[first]
+}
+
+// lineError is a malformed line of an imported text, numbered from 1
+type lineError struct {
+	line    int
+	message string
+}
+
+// lineErrors is returned when an imported text has malformed lines, in the order of the lines
+type lineErrors []lineError
+
+func (e lineErrors) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, fmt.Sprintf("line %d: %s", err.line, err.message))
+	}
+	return strings.Join(messages, "\n")
+}
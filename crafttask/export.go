@@ -0,0 +1,208 @@
+package crafttask
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const defaultExportFormat = "text"
+
+// exporter renders blocks in one format. Every exporter gets the blocks the same way, from walkBlocks:
+// depth first in document order, each block right before its subblocks.
+type exporter interface {
+	// writeHeader writes what comes before the first block
+	writeHeader(w *bufio.Writer)
+	// writeBlock writes the block's own content; depth is 0 for top level blocks
+	writeBlock(w *bufio.Writer, b block, depth int)
+	// closeBlock writes what comes after the block's subblocks
+	closeBlock(w *bufio.Writer, b block, depth int)
+	// writeFooter writes what comes after the last block
+	writeFooter(w *bufio.Writer)
+}
+
+// lineExporter is embedded by the exporters that write every block on its own, with nothing around the blocks
+type lineExporter struct{}
+
+func (lineExporter) writeHeader(*bufio.Writer)            {}
+func (lineExporter) closeBlock(*bufio.Writer, block, int) {}
+func (lineExporter) writeFooter(*bufio.Writer)            {}
+
+// exportFormat describes how to make an exporter for one format out of the export request's options
+type exportFormat struct {
+	contentType string
+	newExporter func(options url.Values) (exporter, error)
+}
+
+var exportFormats = map[string]exportFormat{}
+
+// registerExportFormat makes the format available by its name, e.g. to the export endpoint's ?format= parameter
+func registerExportFormat(name string, format exportFormat) {
+	if _, exists := exportFormats[name]; exists {
+		panic(fmt.Sprintf("export format %s registered twice", name))
+	}
+	exportFormats[name] = format
+}
+
+func init() {
+	registerExportFormat(defaultExportFormat, exportFormat{
+		contentType: "text/plain",
+		newExporter: newPlainTextExporter,
+	})
+}
+
+// exportFormatNames lists the registered formats, sorted
+func exportFormatNames() []string {
+	names := make([]string, 0, len(exportFormats))
+	for name := range exportFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// exportScope is the part of the document to export: the block rootId with its subblocks, or every block when
+// rootId is root, down to maxDepth levels below the top (unlimited when negative)
+type exportScope struct {
+	rootId   id
+	maxDepth int
+}
+
+var wholeDocument = exportScope{rootId: root, maxDepth: -1}
+
+// how many blocks are exported between checks whether the export was cancelled
+const exportCancelCheckEvery = 1000
+
+// exportBlocks has the exporter render the blocks straight into the writer, down to maxDepth levels below them.
+// It stops early when writing fails or the context is done, e.g. because the client is gone.
+func exportBlocks(ctx context.Context, output io.Writer, exporter exporter, blocks []block, maxDepth int) error {
+	failing := &failingWriter{w: output}
+	w := bufio.NewWriter(failing)
+	exporter.writeHeader(w)
+	exported := 0
+	err := walkBlocks(blocks, maxDepth, func(b block, depth int) error {
+		exporter.writeBlock(w, b, depth)
+		exported++
+		if failing.err != nil {
+			return failing.err
+		}
+		if exported%exportCancelCheckEvery == 0 {
+			return ctx.Err()
+		}
+		return nil
+	}, func(b block, depth int) {
+		exporter.closeBlock(w, b, depth)
+	})
+	if err != nil {
+		return err
+	}
+	exporter.writeFooter(w)
+	return w.Flush()
+}
+
+// failingWriter remembers the first error of the writer, so the export can stop at it instead of carrying on
+// into a writer that's not there anymore
+type failingWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (f *failingWriter) Write(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	n, err := f.w.Write(p)
+	f.err = err
+	return n, err
+}
+
+// walkBlocks visits the blocks depth first in document order, calling leave after a block's subblocks. It keeps its
+// own stack, so deep trees don't need a deep call stack, and skips the subblocks below maxDepth unless it's negative.
+func walkBlocks(blocks []block, maxDepth int, enter func(b block, depth int) error, leave func(b block, depth int)) error {
+	type level struct {
+		parent    block
+		subblocks []block
+		next      int
+	}
+	levels := []level{{subblocks: blocks}}
+	for len(levels) > 0 {
+		current := &levels[len(levels)-1]
+		depth := len(levels) - 1
+		if current.next == len(current.subblocks) {
+			finished := *current
+			levels = levels[:len(levels)-1]
+			if depth > 0 {
+				leave(finished.parent, depth-1)
+			}
+			continue
+		}
+		b := current.subblocks[current.next]
+		current.next++
+		if depth == maxDepth {
+			b.subblocks = NewOrderedMapOfBlocks() // a copy of the block, the document keeps its subblocks
+		}
+		if err := enter(b, depth); err != nil {
+			return err
+		}
+		levels = append(levels, level{parent: b, subblocks: b.subblocks.OrderedValues()})
+	}
+	return nil
+}
+
+// plainTextExporter writes a line per block, indented by two spaces per level, without the rich text's marks
+type plainTextExporter struct {
+	lineExporter
+	linkReferences bool
+}
+
+// newPlainTextExporter takes how references are written from the ?references= option
+func newPlainTextExporter(options url.Values) (exporter, error) {
+	linkReferences, err := linkReferencesOption(options)
+	if err != nil {
+		return nil, err
+	}
+	return plainTextExporter{linkReferences: linkReferences}, nil
+}
+
+func (e plainTextExporter) writeBlock(w *bufio.Writer, b block, depth int) {
+	content := escapePlainText(referenceAsText(b, e.linkReferences).content)
+	switch b.blockType {
+	case blockTypeTodo:
+		if b.checked {
+			content = plainTextChecked + content
+		} else {
+			content = plainTextUnchecked + content
+		}
+	case blockTypeDivider:
+		content = plainTextDivider
+	}
+	fmt.Fprintf(w, "%s%s\n", strings.Repeat(" ", depth*2), content)
+}
+
+// the markers of todos and dividers in plain text
+const (
+	plainTextUnchecked = "[ ] "
+	plainTextChecked   = "[x] "
+	plainTextDivider   = "---"
+)
+
+// plainTextEscaper escapes what would break a block's line: line breaks, and backslashes since they start the escapes
+var plainTextEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`)
+
+// escapePlainText escapes the content so it stays on its line, and neither its leading whitespace nor a todo's or
+// divider's marker at its start is taken for what it looks like
+func escapePlainText(content string) string {
+	content = plainTextEscaper.Replace(content)
+	if strings.HasPrefix(content, " ") || strings.HasPrefix(content, "\t") || startsWithPlainTextMarker(content) {
+		content = `\` + content
+	}
+	return content
+}
+
+func startsWithPlainTextMarker(line string) bool {
+	return strings.HasPrefix(line, plainTextUnchecked) || strings.HasPrefix(line, plainTextChecked) || line == plainTextDivider
+}
@@ -0,0 +1,283 @@
+package crafttask
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryStore_ExportMarkdown(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+
+	exporter, err := newMarkdownExporter(url.Values{})
+	require.NoError(t, err)
+	assert.Equal(t, "- Block 1\n  - Child Block 2\n    - Grandchild Block 3\n  - Child Block 4\n- Block 5\n  - Child Block 6\n", store.ExportWith(exporter))
+
+	exporter, err = newMarkdownExporter(url.Values{"headingDepth": {"1"}})
+	require.NoError(t, err)
+	assert.Equal(t, "# Block 1\n\n- Child Block 2\n  - Grandchild Block 3\n- Child Block 4\n\n# Block 5\n\n- Child Block 6\n", store.ExportWith(exporter))
+
+	exporter, err = newMarkdownExporter(url.Values{"headingDepth": {"2"}})
+	require.NoError(t, err)
+	assert.Equal(t, "# Block 1\n\n## Child Block 2\n\n- Grandchild Block 3\n\n## Child Block 4\n\n# Block 5\n\n## Child Block 6\n", store.ExportWith(exporter))
+
+	_, err = newMarkdownExporter(url.Values{"headingDepth": {"7"}})
+	assert.Equal(t, errInvalidHeadingDepth, err)
+}
+
+func TestEscapeMarkdown(t *testing.T) {
+	assert.Equal(t, `plain text, nothing to escape.`, escapeMarkdown("plain text, nothing to escape."))
+	assert.Equal(t, `\*bold\* \_it\_ \[link\](url) \`+"`code\\`"+` a \\ b \# c`, escapeMarkdown("*bold* _it_ [link](url) `code` a \\ b # c"))
+	assert.Equal(t, `\- not a list item`, escapeMarkdown("- not a list item"))
+	assert.Equal(t, `12\. not a numbered one`, escapeMarkdown("12. not a numbered one"))
+	assert.Equal(t, `\> \<not a quote\>`, escapeMarkdown("> <not a quote>"))
+
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "first line\n- second line"}}})
+	require.NoError(t, err)
+	exporter, err := newMarkdownExporter(url.Values{})
+	require.NoError(t, err)
+	assert.Equal(t, "- first line\n  \\- second line\n", store.ExportWith(exporter))
+}
+
+func TestAPI_ExportFormats(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block *1*","Subblocks":[{"Content":"Child Block 2"}]}}]`)
+
+	response := doRequest(t, r, "GET", "/documents/1/export", "")
+	assert.Equal(t, "text/plain", response.Header().Get("Content-Type"))
+	assert.Equal(t, "Block *1*\n  Child Block 2\n", response.Body.String())
+
+	response = doRequest(t, r, "GET", "/documents/1/export?format=markdown&headingDepth=1", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "text/markdown", response.Header().Get("Content-Type"))
+	assert.Equal(t, "# Block \\*1\\*\n\n- Child Block 2\n", response.Body.String())
+
+	response = doRequest(t, r, "GET", "/documents/1/export?format=markdown&headingDepth=deep", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doRequest(t, r, "GET", "/documents/1/export?format=docx", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Contains(t, response.Body.String(), "markdown, opml, text")
+}
+
+func TestExportBlocks_DeepTree(t *testing.T) {
+	const depth = 100000
+	deepest := block{id: depth, content: "deepest", subblocks: NewOrderedMapOfBlocks()}
+	for i := depth - 1; i > 0; i-- {
+		parent := block{id: id(i), content: "level", subblocks: NewOrderedMapOfBlocks()}
+		parent.subblocks.Set(deepest.id, deepest)
+		deepest = parent
+	}
+
+	var output strings.Builder
+	require.NoError(t, exportBlocks(context.Background(), &output, &jsonExporter{}, []block{deepest}, -1)) // the text formats would indent it quadratically
+	assert.Equal(t, depth-1, strings.Count(output.String(), `"Content":"level"`))
+	assert.True(t, strings.HasSuffix(output.String(), `{"Id":100000,"Content":"deepest","Subblocks":[`+strings.Repeat("]}", depth)+"]}\n"))
+}
+
+func TestInMemoryStore_ExportDeepDocument(t *testing.T) {
+	const depth = 100000
+	store := NewInMemoryStore()
+	deepest := block{id: depth, content: "deepest", subblocks: NewOrderedMapOfBlocks()}
+	for i := depth - 1; i > 0; i-- {
+		parent := block{id: id(i), content: "level", subblocks: NewOrderedMapOfBlocks()}
+		parent.subblocks.Set(deepest.id, deepest)
+		store.parentsCache[deepest.id] = parent.id
+		deepest = parent
+	}
+	store.document.blocks.Set(deepest.id, deepest)
+	store.parentsCache[deepest.id] = root
+
+	var output strings.Builder
+	require.NoError(t, store.ExportTo(context.Background(), &output, &jsonExporter{}, wholeDocument))
+	assert.Equal(t, depth-1, strings.Count(output.String(), `"Content":"level"`))
+	output.Reset()
+	require.NoError(t, store.ExportTo(context.Background(), &output, &jsonExporter{}, exportScope{rootId: 50000, maxDepth: -1}))
+	assert.Equal(t, depth-50000, strings.Count(output.String(), `"Content":"level"`))
+}
+
+func TestExportBlocks_StopsEarly(t *testing.T) {
+	blocks := make([]block, 0, 3*exportCancelCheckEvery)
+	for i := 1; i <= 3*exportCancelCheckEvery; i++ {
+		blocks = append(blocks, block{id: id(i), content: "block", subblocks: NewOrderedMapOfBlocks()})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var output strings.Builder
+	err := exportBlocks(ctx, &output, plainTextExporter{}, blocks, -1)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, strings.Count(output.String(), "\n"), 3*exportCancelCheckEvery)
+
+	writer := &limitedWriter{limit: 100}
+	err = exportBlocks(context.Background(), writer, plainTextExporter{}, blocks, -1)
+	assert.ErrorIs(t, err, errWriterFull)
+	assert.Equal(t, 1, writer.failedWrites)
+}
+
+var errWriterFull = errors.New("writer full")
+
+// limitedWriter fails once more than limit bytes were written to it
+type limitedWriter struct {
+	limit        int
+	written      int
+	failedWrites int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.written+len(p) > w.limit {
+		w.failedWrites++
+		return 0, errWriterFull
+	}
+	w.written += len(p)
+	return len(p), nil
+}
+
+// stalledWriter blocks every write until it's released, like a client that stopped reading
+type stalledWriter struct {
+	started, release chan struct{}
+}
+
+func (w stalledWriter) Write(p []byte) (int, error) {
+	select {
+	case w.started <- struct{}{}:
+	default:
+	}
+	<-w.release
+	return len(p), nil
+}
+
+func TestInMemoryStore_ExportDoesNotBlockWrites(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+
+	writer := stalledWriter{started: make(chan struct{}), release: make(chan struct{})}
+	exported := make(chan error)
+	go func() { exported <- store.ExportTo(context.Background(), writer, plainTextExporter{}, wholeDocument) }()
+	<-writer.started
+
+	updated := make(chan error)
+	go func() {
+		_, err := store.UpdateBlock(1, updatePayload{Content: "Updated Block 1"})
+		updated <- err
+	}()
+	select {
+	case err := <-updated:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the update waited for the export to be written")
+	}
+	close(writer.release)
+	require.NoError(t, <-exported)
+}
+
+func TestAPI_ExportGzip(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block 1","Subblocks":[{"Content":"Child Block 2"}]}}]`)
+
+	request := httptest.NewRequest("GET", "/documents/1/export?format=markdown", nil)
+	request.Header.Set("Accept-Encoding", "deflate, gzip;q=0.8")
+	response := httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "gzip", response.Header().Get("Content-Encoding"))
+	assert.Equal(t, "text/markdown", response.Header().Get("Content-Type"))
+	reader, err := gzip.NewReader(response.Body)
+	require.NoError(t, err)
+	content, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "- Block 1\n  - Child Block 2\n", string(content))
+
+	request = httptest.NewRequest("GET", "/documents/1/export", nil)
+	request.Header.Set("Accept-Encoding", "gzip;q=0")
+	response = httptest.NewRecorder()
+	r.ServeHTTP(response, request)
+	assert.Empty(t, response.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Block 1\n  Child Block 2\n", response.Body.String())
+}
+
+func TestInMemoryStore_ExportSubtree(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	export := func(exporter exporter, scope exportScope) string {
+		var output strings.Builder
+		require.NoError(t, store.ExportTo(context.Background(), &output, exporter, scope))
+		return output.String()
+	}
+
+	assert.Equal(t, "Child Block 2\n  Grandchild Block 3\n", export(plainTextExporter{}, exportScope{rootId: 2, maxDepth: -1}))
+	assert.Equal(t, "Block 1\n  Child Block 2\n  Child Block 4\n", export(plainTextExporter{}, exportScope{rootId: 1, maxDepth: 1}))
+	assert.Equal(t, "Block 1\nBlock 5\n", export(plainTextExporter{}, exportScope{rootId: root, maxDepth: 0}))
+	assert.Equal(t, xml.Header+"<opml version=\"2.0\">\n  <head></head>\n  <body>\n"+
+		"    <outline text=\"Block 1\">\n      <outline text=\"Child Block 2\"/>\n      <outline text=\"Child Block 4\"/>\n    </outline>\n"+
+		"  </body>\n</opml>\n", export(opmlExporter{}, exportScope{rootId: 1, maxDepth: 1}))
+	assert.Equal(t, `{"SchemaVersion":1,"Blocks":[{"Id":5,"Content":"Block 5","Subblocks":[]}]}`+"\n", export(&jsonExporter{}, exportScope{rootId: 5, maxDepth: 0}))
+
+	var output strings.Builder
+	err = store.ExportTo(context.Background(), &output, plainTextExporter{}, exportScope{rootId: 10, maxDepth: -1})
+	assert.Equal(t, errBlockDoesNotExist, err)
+	assert.Empty(t, output.String())
+
+	// the subtree's blocks are left as they were
+	assert.Equal(t, "Block 1\n  Child Block 2\n    Grandchild Block 3\n  Child Block 4\nBlock 5\n  Child Block 6\n", store.Export())
+}
+
+func TestAPI_ExportSubtree(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block 1","Subblocks":[{"Content":"Child Block 2","Subblocks":[{"Content":"Grandchild Block 3"}]}]}}]`)
+
+	response := doRequest(t, r, "GET", "/documents/1/export?format=markdown&root=2", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "- Child Block 2\n  - Grandchild Block 3\n", response.Body.String())
+	response = doRequest(t, r, "GET", "/documents/1/export?root=1&maxDepth=1", "")
+	assert.Equal(t, "Block 1\n  Child Block 2\n", response.Body.String())
+
+	doRequest(t, r, "DELETE", "/documents/1/blocks?blockIds=3", "")
+	response = doRequest(t, r, "GET", "/documents/1/export?root=3", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = doRequest(t, r, "GET", "/documents/1/export?root=3&revision=1", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "Grandchild Block 3\n", response.Body.String())
+
+	request := httptest.NewRequest("GET", "/documents/1/export?root=3", nil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, request)
+	assert.Equal(t, http.StatusNotFound, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("Content-Encoding"))
+
+	response = doRequest(t, r, "GET", "/documents/1/export?root=first", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doRequest(t, r, "GET", "/documents/1/export?maxDepth=-1", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
@@ -0,0 +1,359 @@
+package crafttask
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	walFileName          = "blocks.wal"
+	defaultSnapshotEvery = 1000
+)
+
+var errMissingLogRecords = errors.New("log records between the snapshot and the rest of the log are missing")
+
+type FileStoreOptions struct {
+	// SnapshotEvery is how many logged operations trigger a new snapshot and a log compaction; defaults to 1000
+	SnapshotEvery int
+}
+
+// FileStore keeps the document in memory and makes it durable by recording every mutation
+// in a write-ahead log before applying it. Reads are served straight from the in-memory copy.
+// Every so often the whole document is written to a snapshot and the log is cut back,
+// so startup doesn't have to replay the document's entire history.
+type FileStore struct {
+	*InMemoryStore
+	writeLock            sync.Mutex // keeps the order of the log the same as the order mutations are applied in
+	dir                  string
+	options              FileStoreOptions
+	wal                  *writeAheadLog
+	recordsSinceSnapshot int
+	closed               bool
+}
+
+// NewFileStore opens the store persisted in dir, creating it if needed. It loads the newest
+// readable snapshot and replays the log records written after it. Replaying the operations in
+// their original order rebuilds the tree, the parents cache and the id counter, since ids are
+// handed out deterministically.
+func NewFileStore(dir string, options FileStoreOptions) (*FileStore, error) {
+	if options.SnapshotEvery <= 0 {
+		options.SnapshotEvery = defaultSnapshotEvery
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	snapshot, hasSnapshot, err := loadNewestSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+	wal, records, err := openWriteAheadLog(filepath.Join(dir, walFileName))
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileStore{
+		InMemoryStore: NewInMemoryStore(),
+		dir:           dir,
+		options:       options,
+		wal:           wal,
+	}
+	if hasSnapshot {
+		fs.InMemoryStore.restoreSnapshot(snapshot)
+	}
+	expectedSequence := snapshot.Sequence + 1
+	for _, record := range records {
+		if record.Sequence < expectedSequence {
+			continue // already part of the snapshot
+		}
+		if record.Sequence != expectedSequence {
+			wal.close()
+			return nil, errMissingLogRecords
+		}
+		fs.InMemoryStore.setClock(fixedClock(record.Time))
+		fs.replay(record) // operations that failed originally fail the same way again, so the error is irrelevant
+		fs.recordsSinceSnapshot++
+		expectedSequence++
+	}
+	if wal.lastSequence < snapshot.Sequence {
+		wal.lastSequence = snapshot.Sequence
+	}
+	fs.InMemoryStore.setClock(time.Now)
+	return fs, nil
+}
+
+func (fs *FileStore) replay(record walRecord) error {
+	switch record.Operation {
+	case walOperationInsert:
+		_, err := fs.InMemoryStore.InsertBlocks(record.Inserts)
+		return err
+	case walOperationInsertPartially:
+		fs.InMemoryStore.InsertBlocksPartially(record.Inserts)
+		return nil
+	case walOperationDelete:
+		return fs.InMemoryStore.DeleteBlocks(record.BlockIds)
+	case walOperationDuplicate:
+		_, err := fs.InMemoryStore.DuplicateBlock(record.BlockId)
+		return err
+	case walOperationMove:
+		if record.Move == nil {
+			return errCorruptWalRecord
+		}
+		return fs.InMemoryStore.MoveBlock(record.BlockId, *record.Move)
+	case walOperationUpdate:
+		if record.Update == nil {
+			return errCorruptWalRecord
+		}
+		_, err := fs.InMemoryStore.UpdateBlock(record.BlockId, *record.Update)
+		return err
+	case walOperationBatch:
+		_, err := fs.InMemoryStore.ApplyBatch(record.Batch)
+		return err
+	case walOperationUndo:
+		return fs.InMemoryStore.Undo()
+	case walOperationRedo:
+		return fs.InMemoryStore.Redo()
+	case walOperationRestore:
+		if record.Restore == nil {
+			return errCorruptWalRecord
+		}
+		_, err := fs.InMemoryStore.RestoreFromTrash(record.BlockId, *record.Restore)
+		return err
+	case walOperationPurge:
+		return fs.InMemoryStore.PurgeTrash(record.BlockIds)
+	case walOperationImport:
+		_, err := fs.InMemoryStore.ImportBlocks(record.Inserts, record.KeepIds)
+		return err
+	case walOperationSetProperty:
+		if record.Property == nil {
+			return errCorruptWalRecord
+		}
+		_, err := fs.InMemoryStore.SetProperty(record.BlockId, record.PropertyName, *record.Property)
+		return err
+	case walOperationUnsetProperty:
+		return fs.InMemoryStore.UnsetProperty(record.BlockId, record.PropertyName)
+	}
+	return errCorruptWalRecord
+}
+
+func (fs *FileStore) InsertBlocks(insertOperations []insertOperation) ([]block, error) {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationInsert, Inserts: insertOperations}); err != nil {
+		return nil, err
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.InsertBlocks(insertOperations)
+}
+
+// InsertBlocksPartially can't report a failed write per operation, so every operation fails with it
+func (fs *FileStore) InsertBlocksPartially(insertOperations []insertOperation) []insertResult {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationInsertPartially, Inserts: insertOperations}); err != nil {
+		results := make([]insertResult, 0, len(insertOperations))
+		for range insertOperations {
+			results = append(results, insertResult{err: err})
+		}
+		return results
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.InsertBlocksPartially(insertOperations)
+}
+
+func (fs *FileStore) DeleteBlocks(idsToDelete []id) error {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationDelete, BlockIds: idsToDelete}); err != nil {
+		return err
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.DeleteBlocks(idsToDelete)
+}
+
+func (fs *FileStore) DuplicateBlock(idToDuplicate id) (block, error) {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationDuplicate, BlockId: idToDuplicate}); err != nil {
+		return block{}, err
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.DuplicateBlock(idToDuplicate)
+}
+
+func (fs *FileStore) MoveBlock(blockId id, movePayload movePayload) error {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationMove, BlockId: blockId, Move: &movePayload}); err != nil {
+		return err
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.MoveBlock(blockId, movePayload)
+}
+
+func (fs *FileStore) UpdateBlock(blockId id, updatePayload updatePayload) (block, error) {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationUpdate, BlockId: blockId, Update: &updatePayload}); err != nil {
+		return block{}, err
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.UpdateBlock(blockId, updatePayload)
+}
+
+func (fs *FileStore) SetProperty(blockId id, name string, payload propertyPayload) (block, error) {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationSetProperty, BlockId: blockId, PropertyName: name, Property: &payload}); err != nil {
+		return block{}, err
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.SetProperty(blockId, name, payload)
+}
+
+func (fs *FileStore) UnsetProperty(blockId id, name string) error {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationUnsetProperty, BlockId: blockId, PropertyName: name}); err != nil {
+		return err
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.UnsetProperty(blockId, name)
+}
+
+func (fs *FileStore) ApplyBatch(batchOperations []batchOperation) (batchResult, error) {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationBatch, Batch: batchOperations}); err != nil {
+		return batchResult{}, err
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.ApplyBatch(batchOperations)
+}
+
+// Undo and Redo reach as far back after a restart as before it: snapshots keep the undo and redo stacks, and
+// replaying the log after them rebuilds the rest
+func (fs *FileStore) Undo() error {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationUndo}); err != nil {
+		return err
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.Undo()
+}
+
+func (fs *FileStore) Redo() error {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationRedo}); err != nil {
+		return err
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.Redo()
+}
+
+func (fs *FileStore) RestoreFromTrash(blockId id, restorePayload restorePayload) (block, error) {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationRestore, BlockId: blockId, Restore: &restorePayload}); err != nil {
+		return block{}, err
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.RestoreFromTrash(blockId, restorePayload)
+}
+
+// PurgeTrash also erases the purged subtrees from disk: the older snapshots and log records still have them, so it
+// snapshots right away and keeps only that snapshot, leaving nothing to replay them from
+func (fs *FileStore) PurgeTrash(idsToPurge []id) error {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationPurge, BlockIds: idsToPurge}); err != nil {
+		return err
+	}
+	if err := fs.InMemoryStore.PurgeTrash(idsToPurge); err != nil {
+		fs.recordWritten()
+		return err
+	}
+	fs.InMemoryStore.setClock(time.Now)
+	return fs.snapshot(1)
+}
+
+func (fs *FileStore) ImportBlocks(insertOperations []insertOperation, keepIds bool) ([]block, error) {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if err := fs.log(walRecord{Operation: walOperationImport, Inserts: insertOperations, KeepIds: keepIds}); err != nil {
+		return nil, err
+	}
+	defer fs.recordWritten()
+	return fs.InMemoryStore.ImportBlocks(insertOperations, keepIds)
+}
+
+// log durably appends the record, then has the in-memory store date the mutation with the record's time,
+// which is also the time it gets when the record is replayed
+func (fs *FileStore) log(record walRecord) error {
+	if fs.closed {
+		return errStoreClosed
+	}
+	record.Time = time.Now().UTC()
+	if err := fs.wal.append(record); err != nil {
+		return err
+	}
+	fs.InMemoryStore.setClock(fixedClock(record.Time))
+	return nil
+}
+
+func fixedClock(t time.Time) func() time.Time {
+	return func() time.Time { return t }
+}
+
+// recordWritten puts the in-memory store back on the real clock, for reads that depend on the time,
+// and takes a snapshot once enough records piled up in the log.
+// The mutation itself is already durable, so a failed snapshot is only logged and retried on the next write.
+func (fs *FileStore) recordWritten() {
+	fs.InMemoryStore.setClock(time.Now)
+	fs.recordsSinceSnapshot++
+	if fs.recordsSinceSnapshot < fs.options.SnapshotEvery {
+		return
+	}
+	if err := fs.snapshot(snapshotsToKeep); err != nil {
+		log.Printf("snapshotting %s: %v", fs.dir, err)
+	}
+}
+
+// Snapshot writes the whole document to disk and compacts the log
+func (fs *FileStore) Snapshot() error {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if fs.closed {
+		return errStoreClosed
+	}
+	return fs.snapshot(snapshotsToKeep)
+}
+
+// snapshot writes the whole document to disk, keeping the newest keep snapshots, and compacts the log
+func (fs *FileStore) snapshot(keep int) error {
+	if err := writeSnapshot(fs.dir, fs.InMemoryStore.snapshot(fs.wal.lastSequence)); err != nil {
+		return err
+	}
+	fs.recordsSinceSnapshot = 0
+	oldestSnapshotSequence, err := pruneSnapshots(fs.dir, keep)
+	if err != nil {
+		return err
+	}
+	return fs.wal.compact(oldestSnapshotSequence)
+}
+
+// Close waits for the write in progress, if any, and closes the log. Later writes fail with errStoreClosed,
+// since requests still holding the store can outlive the document; reads keep being served from memory.
+func (fs *FileStore) Close() error {
+	fs.writeLock.Lock()
+	defer fs.writeLock.Unlock()
+	if fs.closed {
+		return nil
+	}
+	fs.closed = true
+	return fs.wal.close()
+}
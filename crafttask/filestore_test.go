@@ -0,0 +1,293 @@
+package crafttask
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileStore_ReplaysLogOnReopen(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+
+	blocks, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}},
+	})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{
+		{ParentBlockId: blocks[0].id, Index: 0, Block: blockRequest{Content: "Child Block 1"}},
+	})
+	require.NoError(t, err)
+	duplicatedBlock, err := store.DuplicateBlock(blocks[0].id)
+	require.NoError(t, err)
+	require.NoError(t, store.MoveBlock(blocks[1].id, movePayload{NewParentId: duplicatedBlock.id, Index: 0}))
+	_, err = store.UpdateBlock(blocks[1].id, updatePayload{Content: "Updated Block 2"})
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBlocks([]id{blocks[0].id}))
+	expectedExport := store.Export()
+	require.NoError(t, store.Close())
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	defer reopened.Close()
+
+	assert.Equal(t, expectedExport, reopened.Export())
+	assert.Equal(t, store.parentsCache, reopened.parentsCache)
+
+	newBlocks, err := reopened.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 3"}}})
+	require.NoError(t, err)
+	assert.Equal(t, id(6), newBlocks[0].id, "id counter should continue after the replayed ids")
+}
+
+func TestFileStore_TruncatesTornRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	// simulate a crash in the middle of appending the next record
+	walPath := filepath.Join(dir, walFileName)
+	intactSize := fileSize(t, walPath)
+	frame, err := encodeWalRecord(walRecord{Operation: walOperationInsert, Inserts: []insertOperation{{ParentBlockId: root, Block: blockRequest{Content: "Block 2"}}}})
+	require.NoError(t, err)
+	file, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = file.Write(frame[:len(frame)-3])
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, "Block 1\n", reopened.Export())
+	assert.Equal(t, intactSize, fileSize(t, walPath))
+
+	_, err = reopened.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 3"}}})
+	require.NoError(t, err)
+	require.NoError(t, reopened.Close())
+
+	reopenedAgain, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	defer reopenedAgain.Close()
+	assert.Equal(t, "Block 1\nBlock 3\n", reopenedAgain.Export())
+}
+
+func TestFileStore_IgnoresCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}}})
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	walPath := filepath.Join(dir, walFileName)
+	content, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	content[len(content)-2] ^= 0xff
+	require.NoError(t, os.WriteFile(walPath, content, 0o644))
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, "Block 1\n", reopened.Export())
+}
+
+func TestFileStore_FailsOnCorruptRecordBeforeTheTail(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}}})
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	walPath := filepath.Join(dir, walFileName)
+	content, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	content[walHeaderSize+2] ^= 0xff
+	require.NoError(t, os.WriteFile(walPath, content, 0o644))
+
+	_, err = NewFileStore(dir, FileStoreOptions{})
+	assert.ErrorIs(t, err, errCorruptWalRecord)
+	assert.Equal(t, int64(len(content)), fileSize(t, walPath), "the log is left as it is")
+}
+
+func TestFileStore_FailsOnCorruptLengthBeforeTheTail(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}}})
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	walPath := filepath.Join(dir, walFileName)
+	content, err := os.ReadFile(walPath)
+	require.NoError(t, err)
+	content[3] ^= 0x7f // the first record's length now points far past the end of the file
+	require.NoError(t, os.WriteFile(walPath, content, 0o644))
+
+	_, err = NewFileStore(dir, FileStoreOptions{})
+	assert.ErrorIs(t, err, errCorruptWalRecord)
+	assert.Equal(t, int64(len(content)), fileSize(t, walPath), "the records after it are kept")
+}
+
+func TestFileStore_TruncatesHeaderClaimingMoreThanTheFile(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	walPath := filepath.Join(dir, walFileName)
+	intactSize := fileSize(t, walPath)
+	file, err := os.OpenFile(walPath, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = file.Write(append(frameHeader(0xffffffff, 0), '{'))
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, "Block 1\n", reopened.Export())
+	assert.Equal(t, intactSize, fileSize(t, walPath))
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	return info.Size()
+}
+
+func TestFileStore_SnapshotCompactsLog(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 3})
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: i, Block: blockRequest{Content: "Block"}}})
+		require.NoError(t, err)
+	}
+	expectedExport := store.Export()
+	require.NoError(t, store.Close())
+
+	snapshots, err := listSnapshots(dir)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, filepath.Join(dir, snapshotFileName(6)), snapshots[0])
+	assert.Equal(t, filepath.Join(dir, snapshotFileName(3)), snapshots[1])
+
+	walFile, err := os.Open(filepath.Join(dir, walFileName))
+	require.NoError(t, err)
+	records, _, err := readWalRecords(walFile)
+	require.NoError(t, walFile.Close())
+	require.NoError(t, err)
+	require.Len(t, records, 4, "only the records after the oldest kept snapshot should be left")
+	assert.Equal(t, uint64(4), records[0].Sequence)
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 3})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, expectedExport, reopened.Export())
+	newBlocks, err := reopened.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block"}}})
+	require.NoError(t, err)
+	assert.Equal(t, id(8), newBlocks[0].id)
+}
+
+func TestFileStore_FallsBackToOlderSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 2})
+	require.NoError(t, err)
+	blocks, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: blocks[0].id, Index: 0, Block: blockRequest{Content: "Child Block 1"}}})
+	require.NoError(t, err)
+	_, err = store.DuplicateBlock(blocks[0].id)
+	require.NoError(t, err)
+	require.NoError(t, store.MoveBlock(blocks[0].id, movePayload{NewParentId: root, Index: 1}))
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 2"}}})
+	require.NoError(t, err)
+	expectedExport := store.Export()
+	require.NoError(t, store.Close())
+
+	newestSnapshot := filepath.Join(dir, snapshotFileName(4))
+	require.NoError(t, os.WriteFile(newestSnapshot, []byte("garbage"), 0o644))
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 2})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, expectedExport, reopened.Export())
+	assert.Equal(t, id(5), reopened.idGenerator.lastId())
+}
+
+func TestFileStore_MissingLogRecords_Err(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 2})
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: i, Block: blockRequest{Content: "Block"}}})
+		require.NoError(t, err)
+	}
+	require.NoError(t, store.Close())
+
+	snapshots, err := listSnapshots(dir)
+	require.NoError(t, err)
+	for _, snapshot := range snapshots {
+		require.NoError(t, os.WriteFile(snapshot, []byte("garbage"), 0o644))
+	}
+
+	_, err = NewFileStore(dir, FileStoreOptions{SnapshotEvery: 2})
+	assert.Equal(t, errMissingLogRecords, err)
+}
+
+func TestFileStore_ConcurrentOperations(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 25})
+	require.NoError(t, err)
+	stressStore(t, store, 4, 50)
+	assertConsistent(t, store.InMemoryStore)
+	expectedExport := store.Export()
+	require.NoError(t, store.Close())
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 25})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, expectedExport, reopened.Export())
+}
+
+func TestFileStore_KeepsBlockTypes(t *testing.T) {
+	for _, snapshotEvery := range []int{0, 1} {
+		dir := t.TempDir()
+		store, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: snapshotEvery})
+		require.NoError(t, err)
+		_, err = store.InsertBlocks([]insertOperation{
+			{ParentBlockId: root, Index: 0, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeCode, Language: "sql"}, Content: "select 1"}},
+			{ParentBlockId: root, Index: 1, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeTodo}, Content: "Run it"}},
+		})
+		require.NoError(t, err)
+		_, err = store.UpdateBlock(2, updatePayload{blockTypeFields: blockTypeFields{Type: blockTypeTodo, Checked: true}, Content: "Run it"})
+		require.NoError(t, err)
+		expectedExport := store.ExportWith(&jsonExporter{})
+		require.NoError(t, store.Close())
+
+		reopened, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: snapshotEvery})
+		require.NoError(t, err)
+		assert.Equal(t, expectedExport, reopened.ExportWith(&jsonExporter{}))
+		require.NoError(t, reopened.Undo())
+		blocks := reopened.FetchBlocks([]id{2})
+		require.Len(t, blocks, 1)
+		assert.False(t, blocks[0].checked)
+		require.NoError(t, reopened.Close())
+	}
+}
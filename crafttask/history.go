@@ -0,0 +1,64 @@
+package crafttask
+
+// how many operations can be undone; the oldest ones are forgotten first
+const historyLimit = 1000
+
+// history holds the transactions that can be undone and the undone ones that can be redone
+type history struct {
+	undoStack []transaction
+	redoStack []transaction
+}
+
+// commit records a finished operation as a new revision and so it can be undone;
+// a new operation makes the undone ones unreachable
+func (st *InMemoryStore) commit(tx transaction, summary string) {
+	st.purgeExpiredTrash()
+	if len(tx.mutations) == 0 {
+		return
+	}
+	tx.summary = summary
+	st.recordRevision(tx)
+	st.history.undoStack = append(st.history.undoStack, tx)
+	if len(st.history.undoStack) > historyLimit {
+		st.history.undoStack = st.history.undoStack[1:]
+	}
+	st.history.redoStack = nil
+}
+
+// Undo reverts the latest operation that hasn't been undone yet
+func (st *InMemoryStore) Undo() error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.purgeExpiredTrash()
+	if len(st.history.undoStack) == 0 {
+		return errNothingToUndo
+	}
+	tx := st.history.undoStack[len(st.history.undoStack)-1]
+	st.history.undoStack = st.history.undoStack[:len(st.history.undoStack)-1]
+	undone := st.rollback(tx)
+	undone.summary = "undo " + tx.summary
+	st.recordRevision(undone)
+	st.history.redoStack = append(st.history.redoStack, tx)
+	return nil
+}
+
+// Redo applies the latest undone operation again; the blocks it recreates keep their original ids
+func (st *InMemoryStore) Redo() error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.purgeExpiredTrash()
+	if len(st.history.redoStack) == 0 {
+		return errNothingToRedo
+	}
+	tx := st.history.redoStack[len(st.history.redoStack)-1]
+	st.history.redoStack = st.history.redoStack[:len(st.history.redoStack)-1]
+	redone := transaction{summary: tx.summary}
+	for _, m := range tx.mutations {
+		if err := redone.record(st.applyMutation(m)); err != nil {
+			panic("inconsistent internal state") // the document is back in the state the mutation was first applied to
+		}
+	}
+	st.recordRevision(transaction{summary: "redo " + tx.summary, mutations: redone.mutations})
+	st.history.undoStack = append(st.history.undoStack, redone)
+	return nil
+}
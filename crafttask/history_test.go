@@ -0,0 +1,143 @@
+package crafttask
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryStore_UndoRedo(t *testing.T) {
+	store := NewInMemoryStore()
+
+	blocks, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{{Content: "Child Block 1"}}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}},
+		{ParentBlockId: root, Index: 2, Block: blockRequest{Content: "Block 3"}},
+	})
+	require.NoError(t, err)
+
+	exports := []string{store.Export()}
+	require.NoError(t, store.MoveBlock(blocks[0].id, movePayload{NewParentId: blocks[2].id, Index: 0}))
+	exports = append(exports, store.Export())
+	_, err = store.UpdateBlock(blocks[1].id, updatePayload{Content: "Updated Block 2"})
+	require.NoError(t, err)
+	exports = append(exports, store.Export())
+	_, err = store.DuplicateBlock(blocks[0].id)
+	require.NoError(t, err)
+	exports = append(exports, store.Export())
+	require.NoError(t, store.DeleteBlocks([]id{blocks[2].id}))
+	exports = append(exports, store.Export())
+	assert.Equal(t, "Updated Block 2\n", store.Export())
+
+	for i := len(exports) - 2; i >= 0; i-- {
+		require.NoError(t, store.Undo())
+		assert.Equal(t, exports[i], store.Export())
+		assertConsistent(t, store)
+	}
+	require.NoError(t, store.Undo(), "the initial insert can be undone too")
+	assert.Equal(t, "", store.Export())
+	assert.Equal(t, errNothingToUndo, store.Undo())
+
+	require.NoError(t, store.Redo())
+	for i := 1; i < len(exports); i++ {
+		require.NoError(t, store.Redo())
+		assert.Equal(t, exports[i], store.Export())
+		assertConsistent(t, store)
+	}
+	assert.Equal(t, errNothingToRedo, store.Redo())
+}
+
+func TestInMemoryStore_UndoRestoresOriginalIds(t *testing.T) {
+	store := NewInMemoryStore()
+
+	blocks, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{{Content: "Child Block 1"}}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBlocks([]id{blocks[0].id}))
+	require.NoError(t, store.Undo())
+
+	restored := store.FetchBlocks([]id{blocks[0].id})
+	require.Len(t, restored, 1)
+	assert.Equal(t, blocksToResponse(blocks[:1]), blocksToResponse(restored))
+	assert.Equal(t, []id{blocks[0].id, blocks[1].id}, store.document.blocks.keys)
+}
+
+func TestInMemoryStore_NewOperationClearsRedo(t *testing.T) {
+	store := NewInMemoryStore()
+
+	_, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+	require.NoError(t, store.Undo())
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 2"}}})
+	require.NoError(t, err)
+
+	assert.Equal(t, errNothingToRedo, store.Redo())
+	assert.Equal(t, "Block 2\n", store.Export())
+}
+
+func TestInMemoryStore_UndoBatch(t *testing.T) {
+	store := NewInMemoryStore()
+
+	blocks, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+	_, err = store.ApplyBatch([]batchOperation{
+		{Operation: batchInsert, ParentBlockId: root, Block: blockRequest{Content: "Block 2"}, Ref: "2"},
+		{Operation: batchMove, BlockId: blocks[0].id, ParentRef: "2"},
+		{Operation: batchUpdate, BlockId: blocks[0].id, Update: updatePayload{Content: "Updated Block 1"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Block 2\n  Updated Block 1\n", store.Export())
+
+	require.NoError(t, store.Undo())
+	assert.Equal(t, "Block 1\n", store.Export(), "a batch is undone as a whole")
+	assertConsistent(t, store)
+}
+
+func TestFileStore_UndoRedoReplayed(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}}})
+	require.NoError(t, err)
+	require.NoError(t, store.Undo())
+	require.NoError(t, store.Undo())
+	require.NoError(t, store.Redo())
+	require.NoError(t, store.Close())
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, "Block 1\n", reopened.Export())
+	require.NoError(t, reopened.Redo())
+	assert.Equal(t, "Block 1\nBlock 2\n", reopened.Export())
+}
+
+func TestFileStore_UndoAcrossSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 1})
+	require.NoError(t, err)
+
+	blocks, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{{Content: "Child Block 1"}}}}})
+	require.NoError(t, err)
+	_, err = store.UpdateBlock(blocks[0].id, updatePayload{Content: "Updated Block 1"})
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBlocks([]id{blocks[0].id}))
+	require.NoError(t, store.Undo())
+	require.NoError(t, store.Close())
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 1})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, "Updated Block 1\n  Child Block 1\n", reopened.Export())
+	require.NoError(t, reopened.Undo())
+	assert.Equal(t, "Block 1\n  Child Block 1\n", reopened.Export())
+	require.NoError(t, reopened.Redo())
+	require.NoError(t, reopened.Redo())
+	assert.Equal(t, "", reopened.Export())
+}
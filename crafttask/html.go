@@ -0,0 +1,167 @@
+package crafttask
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var errInvalidFragmentOption = errors.New("fragment has to be true or false")
+
+const defaultHtmlTitle = "Document"
+
+func init() {
+	registerExportFormat("html", exportFormat{
+		contentType: "text/html; charset=utf-8",
+		newExporter: newHtmlExporter,
+	})
+}
+
+// htmlExporter writes the blocks as nested lists, every item anchored at "block-" and its id.
+// Only web and mail links are written, so the page can't run scripts from a link.
+type htmlExporter struct {
+	// fragment is only the lists, to be embedded in another page, instead of a whole page
+	fragment       bool
+	title          string
+	linkReferences bool
+}
+
+// newHtmlExporter takes whether to write only a fragment from the ?fragment= option (a whole page by default),
+// the page's title from the ?title= option, and how references are written from the ?references= option
+func newHtmlExporter(options url.Values) (exporter, error) {
+	linkReferences, err := linkReferencesOption(options)
+	if err != nil {
+		return nil, err
+	}
+	e := &htmlExporter{title: defaultHtmlTitle, linkReferences: linkReferences}
+	if fragmentRaw := options.Get("fragment"); fragmentRaw != "" {
+		fragment, err := strconv.ParseBool(fragmentRaw)
+		if err != nil {
+			return nil, errInvalidFragmentOption
+		}
+		e.fragment = fragment
+	}
+	if title := options.Get("title"); title != "" {
+		e.title = title
+	}
+	return e, nil
+}
+
+func (e *htmlExporter) writeHeader(w *bufio.Writer) {
+	if !e.fragment {
+		w.WriteString("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>")
+		w.WriteString(html.EscapeString(e.title))
+		w.WriteString("</title>\n</head>\n<body>\n")
+	}
+	w.WriteString("<ul>\n")
+}
+
+func (e *htmlExporter) writeBlock(w *bufio.Writer, b block, depth int) {
+	b = referenceAsText(b, e.linkReferences)
+	w.WriteString(htmlIndentation(2*depth + 1))
+	fmt.Fprintf(w, `<li id="block-%d" data-block-id="%d">`, b.id, b.id)
+	if len(b.subblocks.keys) == 0 {
+		w.WriteString(htmlBlockContent(b))
+		return // closed by closeBlock, on the same line
+	}
+	w.WriteString("\n")
+	w.WriteString(htmlIndentation(2*depth + 2))
+	w.WriteString(htmlBlockContent(b))
+	w.WriteString("\n")
+	w.WriteString(htmlIndentation(2*depth + 2))
+	w.WriteString("<ul>\n")
+}
+
+func (e *htmlExporter) closeBlock(w *bufio.Writer, b block, depth int) {
+	if len(b.subblocks.keys) == 0 {
+		w.WriteString("</li>\n")
+		return
+	}
+	w.WriteString(htmlIndentation(2*depth + 2))
+	w.WriteString("</ul>\n")
+	w.WriteString(htmlIndentation(2*depth + 1))
+	w.WriteString("</li>\n")
+}
+
+func (e *htmlExporter) writeFooter(w *bufio.Writer) {
+	w.WriteString("</ul>\n")
+	if !e.fragment {
+		w.WriteString("</body>\n</html>\n")
+	}
+}
+
+func htmlIndentation(level int) string {
+	return strings.Repeat("  ", level)
+}
+
+// htmlBlockContent is the element of the block's own content
+func htmlBlockContent(b block) string {
+	switch b.blockType {
+	case blockTypeHeading:
+		return fmt.Sprintf("<h%d>%s</h%d>", b.level, htmlRichText(b), b.level)
+	case blockTypeTodo:
+		checkbox := `<input type="checkbox" disabled>`
+		if b.checked {
+			checkbox = `<input type="checkbox" disabled checked>`
+		}
+		return "<p>" + checkbox + " " + htmlRichText(b) + "</p>"
+	case blockTypeCode:
+		class := ""
+		if b.language != "" {
+			class = ` class="language-` + html.EscapeString(b.language) + `"`
+		}
+		return "<pre><code" + class + ">" + html.EscapeString(b.content) + "</code></pre>"
+	case blockTypeQuote:
+		return "<blockquote><p>" + htmlRichText(b) + "</p></blockquote>"
+	case blockTypeDivider:
+		return "<hr>"
+	default:
+		return "<p>" + htmlRichText(b) + "</p>"
+	}
+}
+
+// htmlRichText is the block's content escaped, with its formatting
+func htmlRichText(b block) string {
+	var builder strings.Builder
+	for _, run := range runsOf(b) {
+		text := strings.ReplaceAll(html.EscapeString(run.text), "\n", "<br>")
+		if run.marks&markCode != 0 {
+			text = "<code>" + text + "</code>"
+		}
+		if run.marks&markItalic != 0 {
+			text = "<em>" + text + "</em>"
+		}
+		if run.marks&markBold != 0 {
+			text = "<strong>" + text + "</strong>"
+		}
+		if run.marks&markStrikethrough != 0 {
+			text = "<s>" + text + "</s>"
+		}
+		if htmlSafeLink(run.link) {
+			text = `<a href="` + html.EscapeString(run.link) + `">` + text + "</a>"
+		}
+		builder.WriteString(text)
+	}
+	return builder.String()
+}
+
+// htmlSafeLink tells whether the link is one the page can link to: links that run scripts, e.g. javascript: ones,
+// are written as their text only. Links to blocks on the page, e.g. "#block-3", are fine.
+func htmlSafeLink(link string) bool {
+	if strings.HasPrefix(link, "#") {
+		return true
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
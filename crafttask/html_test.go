@@ -0,0 +1,124 @@
+package crafttask
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHtmlExporter(t *testing.T, options url.Values) exporter {
+	exporter, err := newHtmlExporter(options)
+	require.NoError(t, err)
+	return exporter
+}
+
+func TestInMemoryStore_ExportHtml(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	_, err = store.UpdateBlock(6, updatePayload{Content: "<Child> \"Block\" & 6\nsecond line"})
+	require.NoError(t, err)
+
+	assert.Equal(t, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Plans &amp; &lt;ideas&gt;</title>
+</head>
+<body>
+<ul>
+  <li id="block-1" data-block-id="1">
+    <p>Block 1</p>
+    <ul>
+      <li id="block-2" data-block-id="2">
+        <p>Child Block 2</p>
+        <ul>
+          <li id="block-3" data-block-id="3"><p>Grandchild Block 3</p></li>
+        </ul>
+      </li>
+      <li id="block-4" data-block-id="4"><p>Child Block 4</p></li>
+    </ul>
+  </li>
+  <li id="block-5" data-block-id="5">
+    <p>Block 5</p>
+    <ul>
+      <li id="block-6" data-block-id="6"><p>&lt;Child&gt; &#34;Block&#34; &amp; 6<br>second line</p></li>
+    </ul>
+  </li>
+</ul>
+</body>
+</html>
+`, store.ExportWith(newTestHtmlExporter(t, url.Values{"title": {"Plans & <ideas>"}})))
+
+	var fragment strings.Builder
+	require.NoError(t, store.ExportTo(context.Background(), &fragment, newTestHtmlExporter(t, url.Values{"fragment": {"true"}}),
+		exportScope{rootId: 2, maxDepth: 0}))
+	assert.Equal(t, "<ul>\n  <li id=\"block-2\" data-block-id=\"2\"><p>Child Block 2</p></li>\n</ul>\n", fragment.String())
+
+	_, err = newHtmlExporter(url.Values{"fragment": {"maybe"}})
+	assert.Equal(t, errInvalidFragmentOption, err)
+}
+
+func TestInMemoryStore_ExportHtmlTypes(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeHeading, Level: 2}, Content: "Plan", Subblocks: []blockRequest{
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo}, Content: "Write it"},
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo, Checked: true}, Content: "Think it through"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeCode, Language: "go"}, Content: "if done {\n\treturn \"```\"\n}"}},
+		{ParentBlockId: root, Index: 2, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeDivider}}},
+		{ParentBlockId: root, Index: 3, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeQuote}, Content: "Simple is\n\nbetter"}},
+		{ParentBlockId: root, Index: 4, Block: blockRequest{Content: "[ ] not a todo"}},
+	})
+	require.NoError(t, err)
+	_, err = store.UpdateBlock(7, updatePayload{RichText: []textRunPayload{
+		{Text: "a & b", Marks: []string{"bold", "italic"}}, {Text: " "}, {Text: "<x>", Marks: []string{"code"}},
+		{Text: " "}, {Text: "gone", Marks: []string{"strikethrough"}, Link: "https://example.com/?a=1&b=2"},
+		{Text: " "}, {Text: "click", Link: "javascript:alert(1)"},
+	}})
+	require.NoError(t, err)
+
+	assert.Equal(t, `<ul>
+  <li id="block-1" data-block-id="1">
+    <h2>Plan</h2>
+    <ul>
+      <li id="block-2" data-block-id="2"><p><input type="checkbox" disabled> Write it</p></li>
+      <li id="block-3" data-block-id="3"><p><input type="checkbox" disabled checked> Think it through</p></li>
+    </ul>
+  </li>
+  <li id="block-4" data-block-id="4"><pre><code class="language-go">if done {
+	return &#34;`+"```"+`&#34;
+}</code></pre></li>
+  <li id="block-5" data-block-id="5"><hr></li>
+  <li id="block-6" data-block-id="6"><blockquote><p>Simple is<br><br>better</p></blockquote></li>
+  <li id="block-7" data-block-id="7"><p><strong><em>a &amp; b</em></strong> <code>&lt;x&gt;</code> `+
+		`<a href="https://example.com/?a=1&amp;b=2"><s>gone</s></a> click</p></li>
+</ul>
+`, store.ExportWith(newTestHtmlExporter(t, url.Values{"fragment": {"true"}})))
+}
+
+func TestAPI_ExportHtml(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Hello"}}]`)
+
+	response := doRequest(t, r, "GET", "/documents/1/export?format=html&fragment=1", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "text/html; charset=utf-8", response.Header().Get("Content-Type"))
+	assert.Equal(t, "<ul>\n  <li id=\"block-1\" data-block-id=\"1\"><p>Hello</p></li>\n</ul>\n", response.Body.String())
+
+	response = doRequest(t, r, "GET", "/documents/1/export?format=html&fragment=yes", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
@@ -9,6 +9,8 @@ type id uint64
 
 type idGenerator interface {
 	getNewId() id
+	lastId() id
+	advanceTo(lastId id)
 }
 
 type inMemoryIdGenerator struct {
@@ -23,6 +25,20 @@ func (i *inMemoryIdGenerator) getNewId() id {
 	return id(i.currentId.Add(1))
 }
 
+func (i *inMemoryIdGenerator) lastId() id {
+	return id(i.currentId.Load())
+}
+
+// advanceTo makes sure the next id handed out is after lastId; it never moves the counter back
+func (i *inMemoryIdGenerator) advanceTo(lastId id) {
+	for {
+		current := i.currentId.Load()
+		if current >= uint64(lastId) || i.currentId.CompareAndSwap(current, uint64(lastId)) {
+			return
+		}
+	}
+}
+
 func idFromString(rawId string) (id, error) {
 	parsedId, err := strconv.ParseUint(rawId, 10, 64)
 	if err != nil {
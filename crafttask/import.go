@@ -0,0 +1,240 @@
+package crafttask
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// importer parses a text into blocks, the inverse of an exporter. Malformed lines are reported together as lineErrors.
+type importer func(text string) ([]blockRequest, error)
+
+var importFormats = map[string]importer{}
+
+// registerImportFormat makes the format available by its name, e.g. to the import endpoint's ?format= parameter
+func registerImportFormat(name string, importer importer) {
+	if _, exists := importFormats[name]; exists {
+		panic(fmt.Sprintf("import format %s registered twice", name))
+	}
+	importFormats[name] = importer
+}
+
+func init() {
+	registerImportFormat(defaultExportFormat, importPlainText)
+}
+
+// importFormatNames lists the registered formats, sorted
+func importFormatNames() []string {
+	names := make([]string, 0, len(importFormats))
+	for name := range importFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ImportBlocks inserts the imported blocks like InsertBlocks does. With keepIds the blocks keep their ids, which have
+// to be unique and higher than any handed out before; otherwise references and links among them follow the fresh ids.
+func (st *InMemoryStore) ImportBlocks(insertOperations []insertOperation, keepIds bool) ([]block, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	invalidOperations := make(operationErrors)
+	seenIds := make(map[id]bool)
+	importedTargets := make(map[id]id)
+	for _, insertOperation := range insertOperations {
+		collectImportedTargets(insertOperation.Block, importedTargets)
+	}
+	for i, insertOperation := range insertOperations {
+		if err := st.validateInsert(insertOperation, importedTargets); err != nil {
+			invalidOperations[i] = err
+		} else if keepIds {
+			if err := st.validateIdsToKeep(insertOperation.Block, seenIds); err != nil {
+				invalidOperations[i] = err
+			}
+		}
+	}
+	if len(invalidOperations) > 0 {
+		return nil, invalidOperations
+	}
+	blocksToAdd := make([]block, 0, len(insertOperations))
+	newIds := make(map[id]id)
+	for _, insertOperation := range insertOperations {
+		if keepIds {
+			blocksToAdd = append(blocksToAdd, blockFromRequestKeepingIds(insertOperation.Block))
+			continue
+		}
+		blockToAdd := st.newBlockFromRequest(insertOperation.Block)
+		collectNewIds(insertOperation.Block, blockToAdd, newIds)
+		blocksToAdd = append(blocksToAdd, blockToAdd)
+	}
+	var tx transaction
+	blocksToReturn := make([]block, 0, len(insertOperations))
+	for i, insertOperation := range insertOperations {
+		blockToAdd := retargetLinks(blocksToAdd[i], newIds)
+		if err := tx.record(st.insertSubtree(insertOperation.ParentBlockId, insertOperation.Index, blockToAdd)); err != nil {
+			st.rollback(tx)
+			return nil, err
+		}
+		blocksToReturn = append(blocksToReturn, blockToAdd)
+	}
+	for i, insertedBlock := range blocksToReturn {
+		blocksToReturn[i] = st.resolvedClone(insertedBlock) // once every block is in, since they can refer to each other
+	}
+	var highestId id
+	for keptId := range seenIds {
+		if keptId > highestId {
+			highestId = keptId
+		}
+	}
+	st.idGenerator.advanceTo(highestId)
+	st.commit(tx, fmt.Sprintf("import %s", countOf(tx.blockCount(), "block")))
+	return blocksToReturn, nil
+}
+
+func (st *InMemoryStore) validateIdsToKeep(request blockRequest, seenIds map[id]bool) error {
+	if request.Id == root {
+		return errMissingBlockId
+	}
+	if request.Id <= st.idGenerator.lastId() || seenIds[request.Id] {
+		return errBlockIdTaken
+	}
+	seenIds[request.Id] = true
+	for _, subblockRequest := range request.Subblocks {
+		if err := st.validateIdsToKeep(subblockRequest, seenIds); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func blockFromRequestKeepingIds(request blockRequest) block {
+	newBlock := request.fields()
+	newBlock.id = request.Id
+	newBlock.subblocks = NewOrderedMapOfBlocks()
+	for _, subblockRequest := range request.Subblocks {
+		subblock := blockFromRequestKeepingIds(subblockRequest)
+		newBlock.subblocks.Set(subblock.id, subblock)
+	}
+	return newBlock
+}
+
+// insertOperationsAt inserts the imported top level blocks one after the other, starting at the given index
+func insertOperationsAt(parentId id, index int, blocks []blockRequest) []insertOperation {
+	operations := make([]insertOperation, 0, len(blocks))
+	for i, blockToInsert := range blocks {
+		operations = append(operations, insertOperation{ParentBlockId: parentId, Index: index + i, Block: blockToInsert})
+	}
+	return operations
+}
+
+// importedBlock is a block read from one line, not nested yet
+type importedBlock struct {
+	depth      int
+	typeFields blockTypeFields
+	content    string
+	richText   []textRunPayload
+	properties map[string]propertyPayload
+}
+
+// nestBlocks turns the blocks read in document order into a tree; every block is at most one level deeper than
+// the one before it, which the importers check
+func nestBlocks(blocks []importedBlock, start int, depth int) ([]blockRequest, int) {
+	nested := make([]blockRequest, 0)
+	i := start
+	for i < len(blocks) && blocks[i].depth == depth {
+		nestedBlock := blockRequest{
+			blockTypeFields: blocks[i].typeFields,
+			Content:         blocks[i].content,
+			RichText:        blocks[i].richText,
+			Properties:      blocks[i].properties,
+		}
+		nestedBlock.Subblocks, i = nestBlocks(blocks, i+1, depth+1)
+		nested = append(nested, nestedBlock)
+	}
+	return nested, i
+}
+
+// splitImportLines splits the text into lines, without the last line's line break and carriage returns
+func splitImportLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// importPlainText reads what plainTextExporter writes; blocks other than todos and dividers are paragraphs
+func importPlainText(text string) ([]blockRequest, error) {
+	var errs lineErrors
+	blocks := make([]importedBlock, 0)
+	previousDepth := -1
+	for i, line := range splitImportLines(text) {
+		content := strings.TrimLeft(line, " ")
+		indentation := len(line) - len(content)
+		if strings.HasPrefix(content, "\t") {
+			errs = append(errs, lineError{line: i + 1, message: "indented with a tab instead of spaces"})
+			continue
+		}
+		if indentation%2 != 0 {
+			errs = append(errs, lineError{line: i + 1, message: fmt.Sprintf("indented by %s, not a multiple of 2", countOf(indentation, "space"))})
+			continue
+		}
+		depth := indentation / 2
+		if previousDepth == -1 && depth > 0 {
+			errs = append(errs, lineError{line: i + 1, message: "the first block is indented, it has to be at the top level"})
+			continue
+		}
+		if depth > previousDepth+1 {
+			errs = append(errs, lineError{
+				line:    i + 1,
+				message: fmt.Sprintf("indented %d levels deeper than the line before, only 1 is allowed", depth-previousDepth),
+			})
+			continue
+		}
+		typeFields := blockTypeFields{}
+		switch {
+		case content == plainTextDivider:
+			typeFields.Type, content = blockTypeDivider, ""
+		case strings.HasPrefix(content, plainTextUnchecked), strings.HasPrefix(content, plainTextChecked):
+			typeFields.Type, typeFields.Checked = blockTypeTodo, strings.HasPrefix(content, plainTextChecked)
+			content = content[len(plainTextChecked):]
+		}
+		blocks = append(blocks, importedBlock{depth: depth, typeFields: typeFields, content: unescapePlainText(content)})
+		previousDepth = depth
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	nested, _ := nestBlocks(blocks, 0, 0)
+	return nested, nil
+}
+
+// unescapePlainText undoes escapePlainText, keeping backslashes that don't escape anything
+func unescapePlainText(content string) string {
+	if !strings.Contains(content, `\`) {
+		return content
+	}
+	var unescaped strings.Builder
+	for i := 0; i < len(content); i++ {
+		if content[i] != '\\' || i == len(content)-1 {
+			unescaped.WriteByte(content[i])
+			continue
+		}
+		switch next := content[i+1]; {
+		case next == 'n':
+			unescaped.WriteByte('\n')
+		case next == 'r':
+			unescaped.WriteByte('\r')
+		case next == '\\', i == 0 && (next == ' ' || next == '\t' || next == '[' || next == '-'):
+			unescaped.WriteByte(next)
+		default:
+			unescaped.WriteByte('\\')
+			continue
+		}
+		i++
+	}
+	return unescaped.String()
+}
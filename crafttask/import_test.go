@@ -0,0 +1,169 @@
+package crafttask
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// assertRoundTrip imports the export into a new store and checks it exports the same again
+func assertRoundTrip(t *testing.T, store *InMemoryStore, newExporter func() exporter, importer importer) {
+	exported := store.ExportWith(newExporter())
+	blocks, err := importer(exported)
+	require.NoError(t, err, exported)
+	imported := NewInMemoryStore()
+	_, err = imported.InsertBlocks(insertOperationsAt(root, 0, blocks))
+	require.NoError(t, err)
+	assert.Equal(t, exported, imported.ExportWith(newExporter()))
+	assert.Equal(t, store.Export(), imported.Export())
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{
+		{ParentBlockId: 6, Index: 0, Block: blockRequest{Content: `- *special* [chars] \ #1. <here>`}},
+		{ParentBlockId: 6, Index: 1, Block: blockRequest{Content: ""}},
+		{ParentBlockId: root, Index: 2, Block: blockRequest{Content: "10. first line\n  - second line"}},
+	})
+	require.NoError(t, err)
+
+	markdownExporter := func(headingDepth string) func() exporter {
+		return func() exporter {
+			exporter, err := newMarkdownExporter(url.Values{"headingDepth": {headingDepth}})
+			require.NoError(t, err)
+			return exporter
+		}
+	}
+	assertRoundTrip(t, store, func() exporter { return plainTextExporter{} }, importPlainText)
+	assertRoundTrip(t, store, markdownExporter("0"), importMarkdown)
+
+	_, err = store.UpdateBlock(9, updatePayload{Content: "10. a single line"}) // headings can't span lines
+	require.NoError(t, err)
+	for _, headingDepth := range []string{"1", "2", "6"} {
+		assertRoundTrip(t, store, markdownExporter(headingDepth), importMarkdown)
+	}
+}
+
+func TestImportPlainText_EscapedContent(t *testing.T) {
+	contents := []string{"  indented", "two\nlines", `\n isn't a line break`, "\ttabbed", "carriage return\r", `ends with \`}
+	store := NewInMemoryStore()
+	for i, content := range contents {
+		_, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: i, Block: blockRequest{Content: content}}})
+		require.NoError(t, err)
+	}
+	exported := store.ExportWith(plainTextExporter{})
+	assert.Equal(t, "\\  indented\ntwo\\nlines\n\\\\n isn't a line break\n\\\ttabbed\ncarriage return\\r\nends with \\\\\n", exported)
+
+	blocks, err := importPlainText(exported)
+	require.NoError(t, err)
+	imported := make([]string, 0, len(blocks))
+	for _, b := range blocks {
+		imported = append(imported, b.Content)
+	}
+	assert.Equal(t, contents, imported)
+
+	blocks, err = importPlainText(`C:\Users\ana \ notes`)
+	require.NoError(t, err)
+	assert.Equal(t, `C:\Users\ana \ notes`, blocks[0].Content, "backslashes that don't escape anything are kept")
+}
+
+func TestImportPlainText_TypedBlocks(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeTodo}, Content: "Write it", Subblocks: []blockRequest{
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo, Checked: true}, Content: "[ ] looks unchecked"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeDivider}}},
+		{ParentBlockId: root, Index: 2, Block: blockRequest{Content: "[x] not a todo"}},
+		{ParentBlockId: root, Index: 3, Block: blockRequest{Content: "---"}},
+	})
+	require.NoError(t, err)
+	exported := store.ExportWith(plainTextExporter{})
+	assert.Equal(t, "[ ] Write it\n  [x] \\[ ] looks unchecked\n---\n\\[x] not a todo\n\\---\n", exported)
+
+	blocks, err := importPlainText(exported)
+	require.NoError(t, err)
+	assert.Equal(t, []blockRequest{
+		{blockTypeFields: blockTypeFields{Type: blockTypeTodo}, Content: "Write it", Subblocks: []blockRequest{
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo, Checked: true}, Content: "[ ] looks unchecked", Subblocks: []blockRequest{}},
+		}},
+		{blockTypeFields: blockTypeFields{Type: blockTypeDivider}, Subblocks: []blockRequest{}},
+		{Content: "[x] not a todo", Subblocks: []blockRequest{}},
+		{Content: "---", Subblocks: []blockRequest{}},
+	}, blocks)
+	assertRoundTrip(t, store, func() exporter { return plainTextExporter{} }, importPlainText)
+}
+
+func TestImportPlainText_MalformedIndentation(t *testing.T) {
+	_, err := importPlainText("  Indented First Block\nBlock 1\n   Odd Block\n      Too Deep Block\n\tTab Block\n  Child Block\n")
+	assert.Equal(t, lineErrors{
+		{line: 1, message: "the first block is indented, it has to be at the top level"},
+		{line: 3, message: "indented by 3 spaces, not a multiple of 2"},
+		{line: 4, message: "indented 3 levels deeper than the line before, only 1 is allowed"},
+		{line: 5, message: "indented with a tab instead of spaces"},
+	}, err)
+
+	blocks, err := importPlainText("Block 1\r\n  Child Block 2\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, []blockRequest{
+		{Content: "Block 1", Subblocks: []blockRequest{{Content: "Child Block 2", Subblocks: []blockRequest{}}}},
+		{Content: "", Subblocks: []blockRequest{}},
+	}, blocks)
+}
+
+func TestImportMarkdown(t *testing.T) {
+	blocks, err := importMarkdown("# Title\n\nSome paragraph\n* Item 1\n    1. Subitem 2\n       continued\n - Misaligned Item\n### Skipped Level\n")
+	assert.Nil(t, blocks)
+	assert.Equal(t, lineErrors{
+		{line: 3, message: "neither a heading nor a list item"},
+		{line: 7, message: "list item indented by 1 space, in between the levels of the items above it"},
+		{line: 8, message: "heading of level 3 skips a level"},
+	}, err)
+
+	blocks, err = importMarkdown("# Title\n* Item 1\n    1. Subitem 2\n       continued\n* Item 3\n")
+	require.NoError(t, err)
+	assert.Equal(t, []blockRequest{{Content: "Title", Subblocks: []blockRequest{
+		{Content: "Item 1", Subblocks: []blockRequest{{Content: "Subitem 2\ncontinued", Subblocks: []blockRequest{}}}},
+		{Content: "Item 3", Subblocks: []blockRequest{}},
+	}}}, blocks)
+}
+
+func TestAPI_ImportBlocks(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block 1"}}]`)
+
+	response := doRequest(t, r, "POST", "/documents/1/import?format=markdown&parentBlockId=1", "- Imported Block 2\n  - Imported Block 3\n- Imported Block 4\n")
+	require.Equal(t, http.StatusCreated, response.Code)
+	var blocks []blockResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&blocks))
+	require.Len(t, blocks, 2)
+	assert.Equal(t, id(4), blocks[1].Id)
+	response = doRequest(t, r, "POST", "/documents/1/import?index=0", "Imported Block 5\n")
+	require.Equal(t, http.StatusCreated, response.Code)
+	response = doRequest(t, r, "GET", "/documents/1/export", "")
+	assert.Equal(t, "Imported Block 5\nBlock 1\n  Imported Block 2\n    Imported Block 3\n  Imported Block 4\n", response.Body.String())
+
+	response = doRequest(t, r, "POST", "/documents/1/import", "Block\n   Odd Block\n")
+	require.Equal(t, http.StatusBadRequest, response.Code)
+	var malformedLines []lineErrorResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&malformedLines))
+	assert.Equal(t, []lineErrorResponse{{Line: 2, Error: "indented by 3 spaces, not a multiple of 2"}}, malformedLines)
+
+	response = doRequest(t, r, "POST", "/documents/1/import?parentBlockId=42", "Block\n")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doRequest(t, r, "POST", "/documents/1/import?format=docx", "Block\n")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
@@ -0,0 +1,105 @@
+package crafttask
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// jsonSchemaVersion is bumped whenever the JSON export changes in a way older importers can't read
+const jsonSchemaVersion = 1
+
+var errUnsupportedSchemaVersion = fmt.Errorf("only schema version %d is supported", jsonSchemaVersion)
+
+func init() {
+	registerExportFormat("json", exportFormat{
+		contentType: "application/json",
+		newExporter: func(url.Values) (exporter, error) { return &jsonExporter{}, nil },
+	})
+	registerImportFormat("json", importJson)
+}
+
+// jsonDocument is the whole document with every block's id, the same tree the blocks endpoints return
+type jsonDocument struct {
+	SchemaVersion int
+	Blocks        []blockRequest
+}
+
+// jsonExporter writes a jsonDocument block by block
+type jsonExporter struct {
+	// whether a block was already written at each depth of the blocks being written, so the next one needs a comma
+	written []bool
+}
+
+func (e *jsonExporter) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, `{"SchemaVersion":%d,"Blocks":[`, jsonSchemaVersion)
+	e.written = []bool{false}
+}
+
+func (e *jsonExporter) writeBlock(w *bufio.Writer, b block, depth int) {
+	if e.written[depth] {
+		w.WriteString(",")
+	}
+	e.written[depth] = true
+	if b.blockType == blockTypeReference {
+		b.content, b.richText = "", nil // written with their target instead of what they resolved to, to be imported as is
+	}
+	content, _ := json.Marshal(b.content) // strings always marshal
+	fmt.Fprintf(w, `{"Id":%d,`, b.id)
+	if b.blockType != blockTypeParagraph && b.blockType != "" {
+		typeFields, _ := json.Marshal(typeFieldsOf(b)) // written like blockRequest has them, paragraphs without any
+		w.Write(typeFields[1 : len(typeFields)-1])
+		w.WriteString(",")
+	}
+	fmt.Fprintf(w, `"Content":%s,`, content)
+	if b.richText != nil {
+		richText, _ := json.Marshal(richTextToPayloads(b.richText))
+		fmt.Fprintf(w, `"RichText":%s,`, richText)
+	}
+	if len(b.properties) > 0 {
+		properties, _ := json.Marshal(propertiesToPayloads(b.properties)) // sorted by name
+		fmt.Fprintf(w, `"Properties":%s,`, properties)
+	}
+	w.WriteString(`"Subblocks":[`)
+	e.written = append(e.written, false)
+}
+
+func (e *jsonExporter) closeBlock(w *bufio.Writer, b block, depth int) {
+	w.WriteString("]}")
+	e.written = e.written[:depth+1]
+}
+
+func (e *jsonExporter) writeFooter(w *bufio.Writer) {
+	w.WriteString("]}\n")
+}
+
+// importJson reads a jsonDocument, ids included, reporting where the JSON is malformed
+func importJson(text string) ([]blockRequest, error) {
+	var document jsonDocument
+	if err := json.Unmarshal([]byte(text), &document); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, lineErrors{{line: lineOfOffset(text, syntaxErr.Offset), message: syntaxErr.Error()}}
+		}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, lineErrors{{line: lineOfOffset(text, typeErr.Offset), message: typeErr.Error()}}
+		}
+		return nil, err
+	}
+	if document.SchemaVersion != jsonSchemaVersion {
+		return nil, errUnsupportedSchemaVersion
+	}
+	return document.Blocks, nil
+}
+
+// lineOfOffset numbers the line the byte offset is on from 1
+func lineOfOffset(text string, offset int64) int {
+	if offset > int64(len(text)) {
+		offset = int64(len(text))
+	}
+	return strings.Count(text[:offset], "\n") + 1
+}
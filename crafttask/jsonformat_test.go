@@ -0,0 +1,130 @@
+package crafttask
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryStore_ExportJson(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.MoveBlock(2, movePayload{NewParentId: 5, Index: 0}))
+	_, err = store.UpdateBlock(4, updatePayload{Content: "\"Quoted\" Child Block 4"})
+	require.NoError(t, err)
+
+	exported := store.ExportWith(&jsonExporter{})
+	assert.Equal(t, `{"SchemaVersion":1,"Blocks":[`+
+		`{"Id":1,"Content":"Block 1","Subblocks":[{"Id":4,"Content":"\"Quoted\" Child Block 4","Subblocks":[]}]},`+
+		`{"Id":5,"Content":"Block 5","Subblocks":[`+
+		`{"Id":2,"Content":"Child Block 2","Subblocks":[{"Id":3,"Content":"Grandchild Block 3","Subblocks":[]}]},`+
+		`{"Id":6,"Content":"Child Block 6","Subblocks":[]}]}]}`+"\n", exported)
+	var document jsonDocument
+	require.NoError(t, json.Unmarshal([]byte(exported), &document), "the export is valid JSON")
+
+	assert.Equal(t, `{"SchemaVersion":1,"Blocks":[]}`+"\n", NewInMemoryStore().ExportWith(&jsonExporter{}))
+}
+
+func TestInMemoryStore_ImportJson(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.MoveBlock(2, movePayload{NewParentId: 5, Index: 0}))
+	exported := store.ExportWith(&jsonExporter{})
+	blocks, err := importJson(exported)
+	require.NoError(t, err)
+
+	restored := NewInMemoryStore()
+	_, err = restored.ImportBlocks(insertOperationsAt(root, 0, blocks), true)
+	require.NoError(t, err)
+	assert.Equal(t, exported, restored.ExportWith(&jsonExporter{}), "the ids are kept")
+	assertConsistent(t, restored)
+	assert.Equal(t, id(6), restored.idGenerator.lastId())
+	inserted, err := restored.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 7"}}})
+	require.NoError(t, err)
+	assert.Equal(t, id(7), inserted[0].id, "new ids come after the imported ones")
+
+	_, err = restored.ImportBlocks(insertOperationsAt(root, 0, blocks), true)
+	assert.Equal(t, operationErrors{0: errBlockIdTaken, 1: errBlockIdTaken}, err)
+	_, err = NewInMemoryStore().ImportBlocks(insertOperationsAt(root, 0, append(blocks, blocks[0])), true)
+	assert.Equal(t, operationErrors{2: errBlockIdTaken}, err, "ids have to be unique")
+	_, err = NewInMemoryStore().ImportBlocks(insertOperationsAt(root, 0, []blockRequest{{Content: "Block Without Id"}}), true)
+	assert.Equal(t, operationErrors{0: errMissingBlockId}, err)
+
+	remapped, err := restored.ImportBlocks(insertOperationsAt(3, 0, blocks), false)
+	require.NoError(t, err)
+	assert.Equal(t, id(8), remapped[0].id)
+	assert.Equal(t, "Block 1\n  Child Block 4\nBlock 5\n  Child Block 2\n    Grandchild Block 3\n      Block 1\n        Child Block 4\n      Block 5\n        Child Block 2\n          Grandchild Block 3\n        Child Block 6\n  Child Block 6\n",
+		restored.Export()[len("Block 7\n"):])
+	assertConsistent(t, restored)
+}
+
+func TestImportJson_Malformed(t *testing.T) {
+	_, err := importJson("{\"SchemaVersion\":1,\n\"Blocks\":[\n{\"Id\":1,\"Content\":\"Block 1\"},,\n]}")
+	assert.Equal(t, lineErrors{{line: 3, message: "invalid character ',' looking for beginning of value"}}, err)
+	_, err = importJson("{\"SchemaVersion\":1,\n\"Blocks\":[{\"Id\":\"1\"}]}")
+	require.IsType(t, lineErrors{}, err)
+	assert.Equal(t, 2, err.(lineErrors)[0].line)
+	_, err = importJson(`{"SchemaVersion":2,"Blocks":[]}`)
+	assert.Equal(t, errUnsupportedSchemaVersion, err)
+}
+
+func TestFileStore_ImportKeepingIdsSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	_, err = store.ImportBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Id: 40, Content: "Block 40"}}}, true)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	defer reopened.Close()
+	inserted, err := reopened.InsertBlocks([]insertOperation{{ParentBlockId: 40, Index: 0, Block: blockRequest{Content: "Block 41"}}})
+	require.NoError(t, err)
+	assert.Equal(t, id(41), inserted[0].id)
+}
+
+func TestAPI_JsonFormat(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	createTestDocument(t, r, "Document 2")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block 1","Subblocks":[{"Content":"Child Block 2"}]}}]`)
+	doRequest(t, r, "DELETE", "/documents/1/blocks?blockIds=1", "")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block 3"}}]`)
+
+	response := doRequest(t, r, "GET", "/documents/1/export?format=json", "")
+	assert.Equal(t, "application/json", response.Header().Get("Content-Type"))
+	exported := response.Body.String()
+
+	response = doRequest(t, r, "POST", "/documents/2/import?format=json&ids=keep", exported)
+	require.Equal(t, http.StatusCreated, response.Code)
+	response = doRequest(t, r, "GET", "/documents/2/export?format=json", "")
+	assert.Equal(t, exported, response.Body.String())
+
+	response = doRequest(t, r, "POST", "/documents/2/import?format=json&ids=keep", exported)
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doRequest(t, r, "POST", "/documents/2/import?format=json", exported)
+	require.Equal(t, http.StatusCreated, response.Code)
+	var blocks []blockResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&blocks))
+	assert.Equal(t, []blockResponse{{Id: 4, Type: blockTypeParagraph, Content: "Block 3", Subblocks: []blockResponse{}}}, blocks)
+	response = doRequest(t, r, "POST", "/documents/2/import?format=json&ids=maybe", exported)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
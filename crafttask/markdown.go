@@ -0,0 +1,560 @@
+package crafttask
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Markdown has six levels of headings
+const maxMarkdownHeadingDepth = 6
+
+var errInvalidHeadingDepth = errors.New("headingDepth has to be a number from 0 to 6")
+
+func init() {
+	registerExportFormat("markdown", exportFormat{
+		contentType: "text/markdown",
+		newExporter: newMarkdownExporter,
+	})
+	registerImportFormat("markdown", importMarkdown)
+}
+
+// markdownExporter writes the blocks as nested bullet lists, the blocks less deep than headingDepth as headings
+type markdownExporter struct {
+	lineExporter
+	headingDepth   int
+	linkReferences bool
+	// lists have to be separated from the headings around them by a blank line
+	afterHeading bool
+	written      bool
+}
+
+// newMarkdownExporter takes the depth down to which blocks are headings from the ?headingDepth= option (none by default),
+// and how references are written from the ?references= option
+func newMarkdownExporter(options url.Values) (exporter, error) {
+	linkReferences, err := linkReferencesOption(options)
+	if err != nil {
+		return nil, err
+	}
+	e := &markdownExporter{linkReferences: linkReferences}
+	if headingDepthRaw := options.Get("headingDepth"); headingDepthRaw != "" {
+		headingDepth, err := strconv.Atoi(headingDepthRaw)
+		if err != nil || headingDepth < 0 || headingDepth > maxMarkdownHeadingDepth {
+			return nil, errInvalidHeadingDepth
+		}
+		e.headingDepth = headingDepth
+	}
+	return e, nil
+}
+
+func (e *markdownExporter) writeBlock(w *bufio.Writer, b block, depth int) {
+	b = referenceAsText(b, e.linkReferences)
+	lines := markdownLines(b)
+	if depth < e.headingDepth {
+		if e.written {
+			w.WriteString("\n")
+		}
+		w.WriteString(strings.Repeat("#", depth+1))
+		w.WriteString(" ")
+		w.WriteString(strings.Join(lines, " ")) // a heading can't span lines
+		w.WriteString("\n")
+		e.afterHeading = true
+		e.written = true
+		return
+	}
+	if e.afterHeading {
+		w.WriteString("\n")
+		e.afterHeading = false
+	}
+	indentation := strings.Repeat("  ", depth-e.headingDepth)
+	continuation := "\n" + indentation + "  " // continuation lines stay in the list item
+	w.WriteString(indentation)
+	w.WriteString("- ")
+	switch b.blockType {
+	case blockTypeHeading:
+		w.WriteString(strings.Repeat("#", b.level))
+		w.WriteString(" ")
+		w.WriteString(strings.Join(lines, " "))
+	case blockTypeTodo:
+		if b.checked {
+			w.WriteString("[x] ")
+		} else {
+			w.WriteString("[ ] ")
+		}
+		w.WriteString(strings.Join(lines, continuation))
+	case blockTypeCode:
+		fence := markdownFence(b.content)
+		w.WriteString(fence)
+		w.WriteString(b.language)
+		for _, line := range strings.Split(b.content, "\n") {
+			w.WriteString(continuation)
+			w.WriteString(line)
+		}
+		w.WriteString(continuation)
+		w.WriteString(fence)
+	case blockTypeQuote:
+		for i, line := range lines {
+			if i > 0 {
+				w.WriteString(continuation)
+			}
+			w.WriteString(strings.TrimSuffix("> "+line, " "))
+		}
+	case blockTypeDivider:
+		w.WriteString("---")
+	default:
+		w.WriteString(strings.Join(lines, continuation))
+	}
+	w.WriteString("\n")
+	e.written = true
+}
+
+var markdownBackticks = regexp.MustCompile("`+")
+
+// markdownFence is a code fence longer than any run of backticks in the code, so the code can't close it
+func markdownFence(code string) string {
+	length := longestBackticks(code) + 1
+	if length < 3 {
+		length = 3
+	}
+	return strings.Repeat("`", length)
+}
+
+func longestBackticks(code string) int {
+	longest := 0
+	for _, run := range markdownBackticks.FindAllString(code, -1) {
+		if len(run) > longest {
+			longest = len(run)
+		}
+	}
+	return longest
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `#`, `\#`, `[`, `\[`, `]`, `\]`,
+	`<`, `\<`, `>`, `\>`, `|`, `\|`, `~`, `\~`,
+)
+
+// a line starting like a list item or a setext heading's underline
+var markdownLineStart = regexp.MustCompile(`^(\s*)([-+=]|\d+[.)])`)
+
+// escapeMarkdown escapes the characters that would make a line of content render as something else than its text
+func escapeMarkdown(line string) string {
+	return escapeMarkdownLineStart(markdownEscaper.Replace(line))
+}
+
+// escapeMarkdownLineStart escapes what would make a line start a list item or underline a heading
+func escapeMarkdownLineStart(line string) string {
+	if match := markdownLineStart.FindStringSubmatchIndex(line); match != nil {
+		markerEnd := match[5]
+		line = line[:markerEnd-1] + `\` + line[markerEnd-1:]
+	}
+	return line
+}
+
+// markdownLines is the block's content in Markdown, a line per line of the content, escaped and formatted.
+// Formatting is written line by line, since it can't span the lines of a list item or heading.
+func markdownLines(b block) []string {
+	runLines := splitRunLines(runsOf(b))
+	lines := make([]string, 0, len(runLines))
+	for _, runs := range runLines {
+		var line strings.Builder
+		for _, run := range runs {
+			line.WriteString(markdownRun(run))
+		}
+		lines = append(lines, escapeMarkdownLineStart(line.String()))
+	}
+	return lines
+}
+
+var markdownLinkEscaper = strings.NewReplacer(`\`, `\\`, `(`, `\(`, `)`, `\)`)
+
+// markdownRun writes a run of text, which is one line at most, with its marks and link
+func markdownRun(run textRun) string {
+	var text string
+	if run.marks&markCode != 0 {
+		text = markdownCodeSpan(run.text)
+	} else {
+		text = markdownEmphasis(markdownEscaper.Replace(run.text), run.marks)
+	}
+	if run.link != "" {
+		text = "[" + text + "](" + markdownLinkEscaper.Replace(run.link) + ")"
+	}
+	return text
+}
+
+// markdownEmphasis puts the escaped text in between the delimiters of the marks. Spaces are left outside of them,
+// since emphasis can't start or end with one.
+func markdownEmphasis(escaped string, marks textMarks) string {
+	opening := strings.Repeat("*", markdownStars(marks))
+	if marks&markStrikethrough != 0 {
+		opening = "~~" + opening
+	}
+	core := strings.Trim(escaped, " \t")
+	if opening == "" || core == "" {
+		return escaped
+	}
+	leading := escaped[:len(escaped)-len(strings.TrimLeft(escaped, " \t"))]
+	trailing := escaped[len(strings.TrimRight(escaped, " \t")):]
+	return leading + opening + core + reverseDelimiters(opening) + trailing
+}
+
+// markdownStars is how many asterisks mark the text bold, italic or both
+func markdownStars(marks textMarks) int {
+	stars := 0
+	if marks&markItalic != 0 {
+		stars++
+	}
+	if marks&markBold != 0 {
+		stars += 2
+	}
+	return stars
+}
+
+// reverseDelimiters turns opening delimiters into the closing ones, e.g. ~~** into **~~
+func reverseDelimiters(opening string) string {
+	closing := []byte(opening)
+	for i, j := 0, len(closing)-1; i < j; i, j = i+1, j-1 {
+		closing[i], closing[j] = closing[j], closing[i]
+	}
+	return string(closing)
+}
+
+// markdownCodeSpan puts the code in between more backticks than it has in a row. It's padded with spaces when it
+// starts or ends with a backtick, or with spaces on both ends, which a code span would strip.
+func markdownCodeSpan(code string) string {
+	fence := strings.Repeat("`", longestBackticks(code)+1)
+	if strings.HasPrefix(code, "`") || strings.HasSuffix(code, "`") ||
+		strings.HasPrefix(code, " ") && strings.HasSuffix(code, " ") && strings.Trim(code, " ") != "" {
+		return fence + " " + code + " " + fence
+	}
+	return fence + code + fence
+}
+
+var markdownEscaped = regexp.MustCompile("\\\\([!-/:-@[-`{-~])")
+
+func unescapeMarkdown(line string) string {
+	return markdownEscaped.ReplaceAllString(line, "$1")
+}
+
+// parseMarkdownInline reads the formatting markdownRun writes, returning the plain text and its runs, if formatted.
+// Delimiters that don't make up formatting are read as text.
+func parseMarkdownInline(markup string) (string, []textRun) {
+	runs := make([]textRun, 0)
+	var text strings.Builder
+	addRun := func(run textRun) {
+		if text.Len() > 0 {
+			runs = append(runs, textRun{text: text.String()})
+			text.Reset()
+		}
+		runs = append(runs, run)
+	}
+	for i := 0; i < len(markup); {
+		if run, next, ok := parseMarkdownLink(markup, i); ok {
+			addRun(run)
+			i = next
+		} else if run, next, ok := parseMarkdownMarked(markup, i); ok {
+			addRun(run)
+			i = next
+		} else if markdownEscapedAt(markup, i) {
+			text.WriteByte(markup[i+1])
+			i += 2
+		} else {
+			text.WriteByte(markup[i])
+			i++
+		}
+	}
+	if text.Len() > 0 {
+		runs = append(runs, textRun{text: text.String()})
+	}
+	return plainText(runs), joinRunLines(normalizeRichText(runs))
+}
+
+// joinRunLines joins runs formatted alike that are only apart by line breaks
+func joinRunLines(runs []textRun) []textRun {
+	joined := make([]textRun, 0, len(runs))
+	for i := 0; i < len(runs); i++ {
+		run := runs[i]
+		for i+2 < len(runs) && strings.Trim(runs[i+1].text, "\n") == "" && runs[i+1].marks == 0 && runs[i+1].link == "" &&
+			runs[i+2].formattedLike(run) {
+			run.text += runs[i+1].text + runs[i+2].text
+			i += 2
+		}
+		joined = append(joined, run)
+	}
+	if len(joined) == 0 {
+		return nil
+	}
+	return joined
+}
+
+func markdownEscapedAt(markup string, i int) bool {
+	return markup[i] == '\\' && i+1 < len(markup) && markdownEscaped.MatchString(markup[i:i+2])
+}
+
+// parseMarkdownLink reads a link at i, [text](target), its text unformatted or with the formatting of one run.
+// Only links rich text can have are read as links.
+func parseMarkdownLink(markup string, i int) (textRun, int, bool) {
+	if markup[i] != '[' {
+		return textRun{}, 0, false
+	}
+	run, end, ok := parseMarkdownMarked(markup, i+1)
+	if !ok {
+		end = i + 1
+		for end < len(markup) && markup[end] != ']' && !strings.ContainsRune("[*~`\n", rune(markup[end])) {
+			if markdownEscapedAt(markup, end) {
+				end++
+			}
+			end++
+		}
+		run = textRun{text: unescapeMarkdown(markup[i+1 : end])}
+	}
+	if run.text == "" || !strings.HasPrefix(markup[end:], "](") {
+		return textRun{}, 0, false
+	}
+	targetStart := end + 2
+	for end = targetStart; end < len(markup) && markup[end] != ')'; end++ {
+		if markup[end] == '\\' && end+1 < len(markup) {
+			end++
+		}
+	}
+	if end >= len(markup) {
+		return textRun{}, 0, false
+	}
+	run.link = markdownLinkUnescaper.Replace(markup[targetStart:end])
+	if !validLink(run.link) {
+		return textRun{}, 0, false // e.g. links to blocks of the document the Markdown was exported from, read as text
+	}
+	return run, end + 1, true
+}
+
+var markdownLinkUnescaper = strings.NewReplacer(`\\`, `\`, `\(`, `(`, `\)`, `)`)
+
+// parseMarkdownMarked reads a code span or text between emphasis and strikethrough delimiters at i
+func parseMarkdownMarked(markup string, i int) (textRun, int, bool) {
+	if markup[i] == '`' {
+		return parseMarkdownCodeSpan(markup, i)
+	}
+	start := i
+	var marks textMarks
+	if strings.HasPrefix(markup[start:], "~~") {
+		marks |= markStrikethrough
+		start += 2
+	}
+	stars := len(markup[start:]) - len(strings.TrimLeft(markup[start:], "*"))
+	switch stars {
+	case 0:
+	case 1:
+		marks |= markItalic
+	case 2:
+		marks |= markBold
+	case 3:
+		marks |= markBold | markItalic
+	default:
+		return textRun{}, 0, false
+	}
+	if marks == 0 {
+		return textRun{}, 0, false
+	}
+	start += stars
+	closing := reverseDelimiters(markup[i:start])
+	for end := start; end < len(markup); end++ {
+		if markdownEscapedAt(markup, end) {
+			end++
+			continue
+		}
+		if !strings.ContainsRune("[]*~`\n", rune(markup[end])) {
+			continue
+		}
+		// markdownEmphasis keeps whitespace outside the delimiters, like Markdown wants it
+		text := markup[start:end]
+		if text == "" || text != strings.TrimSpace(text) || !strings.HasPrefix(markup[end:], closing) {
+			return textRun{}, 0, false
+		}
+		return textRun{text: unescapeMarkdown(text), marks: marks}, end + len(closing), true
+	}
+	return textRun{}, 0, false
+}
+
+// parseMarkdownCodeSpan reads a code span at i, up to the next run of as many backticks as it starts with
+func parseMarkdownCodeSpan(markup string, i int) (textRun, int, bool) {
+	fence := markdownBackticks.FindString(markup[i:])
+	start := i + len(fence)
+	for _, match := range markdownBackticks.FindAllStringIndex(markup[start:], -1) {
+		if match[1]-match[0] != len(fence) {
+			continue
+		}
+		code := markup[start : start+match[0]]
+		if strings.Contains(code, "\n") {
+			return textRun{}, 0, false
+		}
+		if len(code) >= 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.Trim(code, " ") != "" {
+			code = code[1 : len(code)-1]
+		}
+		if code == "" {
+			return textRun{}, 0, false
+		}
+		return textRun{text: code, marks: markCode}, start + match[1], true
+	}
+	return textRun{}, 0, false
+}
+
+var (
+	markdownHeading  = regexp.MustCompile(`^(#{1,6})(?:[ \t]+(.*))?$`)
+	markdownListItem = regexp.MustCompile(`^( *)([-*+]|\d+[.)])(?:( +)(.*))?$`)
+)
+
+var (
+	markdownTodo      = regexp.MustCompile(`^\[([ xX])\](?: (.*))?$`)
+	markdownQuote     = regexp.MustCompile(`^> ?`)
+	markdownCodeFence = regexp.MustCompile("^(`{3,})([^`\\s]*)$")
+)
+
+// markdownItemType reads the type of a list item from its content, returning the content without what gives the
+// type away, and for code the fence closing it
+func markdownItemType(content string) (blockTypeFields, string, string) {
+	if match := markdownTodo.FindStringSubmatch(content); match != nil {
+		return blockTypeFields{Type: blockTypeTodo, Checked: match[1] != " "}, match[2], ""
+	}
+	if match := markdownHeading.FindStringSubmatch(content); match != nil {
+		return blockTypeFields{Type: blockTypeHeading, Level: len(match[1])}, strings.TrimSpace(match[2]), ""
+	}
+	if match := markdownCodeFence.FindStringSubmatch(content); match != nil {
+		return blockTypeFields{Type: blockTypeCode, Language: match[2]}, "", match[1]
+	}
+	if markdownQuote.MatchString(content) {
+		return blockTypeFields{Type: blockTypeQuote}, markdownQuote.ReplaceAllString(content, ""), ""
+	}
+	if content == "---" {
+		return blockTypeFields{Type: blockTypeDivider}, "", ""
+	}
+	return blockTypeFields{}, content, ""
+}
+
+// markdownListLevel is an item of the list being read that the next items can be nested under
+type markdownListLevel struct {
+	// where the item's marker starts
+	indent int
+	// where the item's content starts; the items indented at least this much are its subitems
+	contentIndent int
+	depth         int
+}
+
+// markdownCode is the fenced code of a list item being read
+type markdownCode struct {
+	fence string
+	// how far the code's lines are indented, the list item's content indent
+	indent int
+	// the line the code starts on
+	line  int
+	lines []string
+}
+
+// importMarkdown reads what markdownExporter writes: headings are blocks as deep as their level, with the list items
+// after them as subblocks, and indented lines that aren't items continue the item before them
+func importMarkdown(text string) ([]blockRequest, error) {
+	var errs lineErrors
+	blocks := make([]importedBlock, 0)
+	headingDepth := -1
+	listLevels := make([]markdownListLevel, 0)
+	var code *markdownCode
+	for i, line := range splitImportLines(text) {
+		content := strings.TrimLeft(line, " ")
+		indent := len(line) - len(content)
+		if code != nil {
+			if indent >= code.indent || content == "" {
+				codeLine := ""
+				if len(line) > code.indent {
+					codeLine = line[code.indent:]
+				}
+				if codeLine == code.fence {
+					blocks[len(blocks)-1].content = strings.Join(code.lines, "\n")
+					code = nil
+				} else {
+					code.lines = append(code.lines, codeLine)
+				}
+				continue
+			}
+			errs = append(errs, lineError{line: code.line, message: "code fence not closed"})
+			code = nil
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			errs = append(errs, lineError{line: i + 1, message: "indented with a tab instead of spaces"})
+			continue
+		}
+		if match := markdownHeading.FindStringSubmatch(line); match != nil {
+			depth := len(match[1]) - 1
+			if depth > headingDepth+1 {
+				errs = append(errs, lineError{line: i + 1, message: fmt.Sprintf("heading of level %d skips a level", depth+1)})
+				continue
+			}
+			blocks = append(blocks, importedBlock{depth: depth, content: strings.TrimSpace(match[2])})
+			headingDepth = depth
+			listLevels = listLevels[:0]
+			continue
+		}
+		if match := markdownListItem.FindStringSubmatch(line); match != nil {
+			level := markdownListLevel{indent: indent, contentIndent: indent + len(match[2]) + len(match[3])}
+			if match[3] == "" {
+				level.contentIndent++ // an empty item is followed by a single space
+			}
+			for len(listLevels) > 0 && listLevels[len(listLevels)-1].indent > indent &&
+				listLevels[len(listLevels)-1].contentIndent > indent {
+				listLevels = listLevels[:len(listLevels)-1]
+			}
+			switch {
+			case len(listLevels) == 0:
+				level.depth = headingDepth + 1
+			case indent >= listLevels[len(listLevels)-1].contentIndent:
+				level.depth = listLevels[len(listLevels)-1].depth + 1
+			case indent == listLevels[len(listLevels)-1].indent:
+				level.depth = listLevels[len(listLevels)-1].depth
+				listLevels = listLevels[:len(listLevels)-1]
+			default:
+				errs = append(errs, lineError{
+					line:    i + 1,
+					message: fmt.Sprintf("list item indented by %s, in between the levels of the items above it", countOf(indent, "space")),
+				})
+				continue
+			}
+			listLevels = append(listLevels, level)
+			typeFields, itemContent, fence := markdownItemType(match[4])
+			blocks = append(blocks, importedBlock{depth: level.depth, typeFields: typeFields, content: itemContent})
+			if fence != "" {
+				code = &markdownCode{fence: fence, indent: level.contentIndent, line: i + 1, lines: make([]string, 0)}
+			}
+			continue
+		}
+		if len(listLevels) > 0 && indent >= listLevels[len(listLevels)-1].contentIndent {
+			continuation := line[listLevels[len(listLevels)-1].contentIndent:]
+			if blocks[len(blocks)-1].typeFields.Type == blockTypeQuote {
+				continuation = markdownQuote.ReplaceAllString(continuation, "")
+			}
+			blocks[len(blocks)-1].content += "\n" + continuation
+			continue
+		}
+		errs = append(errs, lineError{line: i + 1, message: "neither a heading nor a list item"})
+	}
+	if code != nil {
+		errs = append(errs, lineError{line: code.line, message: "code fence not closed"})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	for i, importedBlock := range blocks {
+		if importedBlock.typeFields.Type == blockTypeCode {
+			continue // the code's lines are taken as they are
+		}
+		content, richText := parseMarkdownInline(importedBlock.content)
+		blocks[i].content = content
+		blocks[i].richText = richTextToPayloads(richText)
+	}
+	nested, _ := nestBlocks(blocks, 0, 0)
+	return nested, nil
+}
@@ -4,10 +4,62 @@ const root = id(0)
 
 type block struct {
 	id        id
-	content   string
-	subblocks *orderedMapOfBlocks
+	blockType blockType
+	// level of headings
+	level int
+	// whether todos are done
+	checked bool
+	// language of code
+	language string
+	// target is the block a reference refers to
+	target  id
+	content string
+	// richText is the content with its formatting, nil when it has none. Like properties, it's never changed in place.
+	richText   []textRun
+	properties properties
+	subblocks  *orderedMapOfBlocks
+	// broken is why a reference handed out by the store couldn't be resolved; it's never stored
+	broken error
 }
 
 type document struct {
 	blocks *orderedMapOfBlocks
 }
+
+// clone deep copies the block so it can be read without holding the store's lock
+func (b block) clone() block {
+	cloned := b.fields()
+	cloned.subblocks = NewOrderedMapOfBlocks()
+	for _, subblock := range b.subblocks.OrderedValues() {
+		cloned.subblocks.Set(subblock.id, subblock.clone())
+	}
+	return cloned
+}
+
+// fields is the block without its subblocks, i.e. everything an update can change
+func (b block) fields() block {
+	return block{
+		id:         b.id,
+		blockType:  b.blockType,
+		level:      b.level,
+		checked:    b.checked,
+		language:   b.language,
+		target:     b.target,
+		content:    b.content,
+		richText:   b.richText,
+		properties: b.properties,
+	}
+}
+
+// withFields returns the block with its own fields taken from the given block, keeping its id and subblocks
+func (b block) withFields(fields block) block {
+	b.blockType = fields.blockType
+	b.level = fields.level
+	b.checked = fields.checked
+	b.language = fields.language
+	b.target = fields.target
+	b.content = fields.content
+	b.richText = fields.richText
+	b.properties = fields.properties
+	return b
+}
@@ -0,0 +1,269 @@
+package crafttask
+
+import (
+	"errors"
+	"time"
+)
+
+type mutationKind int
+
+const (
+	mutationInsert mutationKind = iota
+	mutationRemove
+	mutationMove
+	mutationUpdate
+	mutationTrash
+	mutationRestore
+)
+
+// mutation is a single change to the tree, recorded with everything needed to reverse it.
+// Every store operation is made of mutations, so it can be rolled back when a later part of it fails.
+type mutation struct {
+	kind    mutationKind
+	blockId id
+	// inserts and removals: the whole subtree; updates: the block's fields after the update
+	block block
+	// updates: the block's fields before the update
+	previous block
+	// where the block is inserted, removed from or moved to
+	parentId id
+	index    int
+	// moves: where the block was moved from
+	oldParentId id
+	oldIndex    int
+	// inserts of duplicates: the block each inserted block was copied from
+	copiedFrom map[id]id
+	// trashing and restoring: the position the trash restores the block to and when it was deleted
+	// (oldParentId and oldIndex), while parentId and index are where it is removed from or restored to
+	deletedAt time.Time
+}
+
+func (m mutation) inverse() mutation {
+	switch m.kind {
+	case mutationInsert:
+		m.kind = mutationRemove
+	case mutationRemove:
+		m.kind = mutationInsert
+	case mutationMove:
+		m.parentId, m.index, m.oldParentId, m.oldIndex = m.oldParentId, m.oldIndex, m.parentId, m.index
+	case mutationUpdate:
+		m.block, m.previous = m.previous, m.block
+	case mutationTrash:
+		m.kind = mutationRestore
+	case mutationRestore:
+		m.kind = mutationTrash
+	}
+	return m
+}
+
+// transaction collects the mutations applied by one store operation
+type transaction struct {
+	summary   string
+	mutations []mutation
+}
+
+// blockCount is how many blocks the transaction changed, counting every block of the subtrees it inserted or removed
+func (tx transaction) blockCount() int {
+	count := 0
+	for _, m := range tx.mutations {
+		count += subtreeSize(m.block)
+	}
+	return count
+}
+
+// involves tells whether any of the transaction's mutations needs one of the blocks to be reverted or applied again
+func (tx transaction) involves(blockIds map[id]bool) bool {
+	for _, m := range tx.mutations {
+		if m.involves(blockIds) {
+			return true
+		}
+	}
+	return false
+}
+
+// involves tells whether the mutation changes one of the blocks or one of their subblocks. The position a trashed
+// block is restored to by default isn't needed to revert or redo it, so only moves count their old parent.
+func (m mutation) involves(blockIds map[id]bool) bool {
+	if blockIds[m.blockId] || blockIds[m.parentId] || (m.kind == mutationMove && blockIds[m.oldParentId]) {
+		return true
+	}
+	return subtreeHasAny(m.block, blockIds)
+}
+
+func subtreeHasAny(subtree block, blockIds map[id]bool) bool {
+	if blockIds[subtree.id] {
+		return true
+	}
+	if subtree.subblocks == nil {
+		return false // updates and moves don't hold a subtree
+	}
+	for _, subblock := range subtree.subblocks.OrderedValues() {
+		if subtreeHasAny(subblock, blockIds) {
+			return true
+		}
+	}
+	return false
+}
+
+func subtreeSize(subtree block) int {
+	if subtree.subblocks == nil {
+		return 1 // updates and moves don't hold a subtree
+	}
+	size := 1
+	for _, subblock := range subtree.subblocks.OrderedValues() {
+		size += subtreeSize(subblock)
+	}
+	return size
+}
+
+func (tx *transaction) record(m mutation, err error) error {
+	if err == nil {
+		tx.mutations = append(tx.mutations, m)
+	}
+	return err
+}
+
+// rollback reverts the transaction's mutations, newest first, and returns the mutations that did it;
+// callers hold the write lock
+func (st *InMemoryStore) rollback(tx transaction) transaction {
+	var reverted transaction
+	for i := len(tx.mutations) - 1; i >= 0; i-- {
+		if err := reverted.record(st.applyMutation(tx.mutations[i].inverse())); err != nil {
+			panic("inconsistent internal state") // the inverse of an applied mutation always applies
+		}
+	}
+	return reverted
+}
+
+func (st *InMemoryStore) applyMutation(m mutation) (mutation, error) {
+	switch m.kind {
+	case mutationInsert:
+		inserted, err := st.insertSubtree(m.parentId, m.index, m.block.clone())
+		inserted.copiedFrom = m.copiedFrom
+		return inserted, err
+	case mutationRemove:
+		return st.removeSubtree(m.blockId)
+	case mutationMove:
+		return st.moveSubtree(m.blockId, m.parentId, m.index)
+	case mutationUpdate:
+		return st.updateFields(m.blockId, m.block)
+	case mutationTrash:
+		removed, err := st.removeSubtree(m.blockId)
+		if err != nil {
+			return mutation{}, err
+		}
+		return st.addToTrash(removed, m.oldParentId, m.oldIndex, m.deletedAt), nil
+	case mutationRestore:
+		return st.restoreSubtree(m)
+	}
+	panic("unknown mutation")
+}
+
+// insertSubtree takes ownership of the subtree and links it under the parent.
+// The returned mutation holds the index the block really ended up at, since indexes past the end append.
+func (st *InMemoryStore) insertSubtree(parentId id, index int, subtree block) (mutation, error) {
+	if index < 0 {
+		return mutation{}, errInvalidIndex
+	}
+	mapToInsertIn, err := st.findMapByParent(parentId)
+	if err != nil {
+		return mutation{}, errParentBlockDoesNotExist
+	}
+	if index > len(mapToInsertIn.keys) {
+		index = len(mapToInsertIn.keys)
+	}
+	st.recursiveSetParentLinks(subtree, parentId)
+	st.backlinks.addSubtree(subtree)
+	st.searchIndex.addSubtree(subtree)
+	mapToInsertIn.Insert(subtree.id, index, subtree)
+	return mutation{
+		kind:     mutationInsert,
+		blockId:  subtree.id,
+		block:    subtree.clone(),
+		parentId: parentId,
+		index:    index,
+	}, nil
+}
+
+func (st *InMemoryStore) recursiveSetParentLinks(blockToLink block, parentId id) {
+	st.parentsCache[blockToLink.id] = parentId
+	for _, subblock := range blockToLink.subblocks.OrderedValues() {
+		st.recursiveSetParentLinks(subblock, blockToLink.id)
+	}
+}
+
+func (st *InMemoryStore) removeSubtree(blockId id) (mutation, error) {
+	blockToRemove, index, mapToRemoveFrom, err := st.findBlockById(blockId)
+	if err != nil {
+		return mutation{}, err
+	}
+	parentId := st.parentsCache[blockId]
+	mapToRemoveFrom.Delete(blockId)
+	delete(st.parentsCache, blockId)
+	st.recursiveDeleteParentLinks(blockToRemove)
+	st.backlinks.removeSubtree(blockToRemove)
+	st.searchIndex.removeSubtree(blockToRemove)
+	return mutation{
+		kind:     mutationRemove,
+		blockId:  blockId,
+		block:    blockToRemove, // no longer reachable from the tree, so it doesn't need to be copied
+		parentId: parentId,
+		index:    index,
+	}, nil
+}
+
+func (st *InMemoryStore) moveSubtree(blockId id, newParentId id, index int) (mutation, error) {
+	if index < 0 {
+		return mutation{}, errInvalidIndex
+	}
+	blockToMove, oldIndex, oldMap, err := st.findBlockById(blockId)
+	if err != nil {
+		return mutation{}, err
+	}
+	if err := st.blockMovedToItsChild(blockId, newParentId); err != nil {
+		if errors.Is(err, errBlockDoesNotExist) {
+			return mutation{}, errParentBlockDoesNotExist
+		}
+		return mutation{}, err
+	}
+	oldParentId := st.parentsCache[blockId]
+	oldMap.Delete(blockId)
+	newMap, err := st.findMapByParent(newParentId)
+	if err != nil {
+		panic("inconsistent internal state") // the new parent was checked above and isn't inside the moved block
+	}
+	if index > len(newMap.keys) {
+		index = len(newMap.keys)
+	}
+	newMap.Insert(blockId, index, blockToMove)
+	st.parentsCache[blockId] = newParentId
+	return mutation{
+		kind:        mutationMove,
+		blockId:     blockId,
+		parentId:    newParentId,
+		index:       index,
+		oldParentId: oldParentId,
+		oldIndex:    oldIndex,
+	}, nil
+}
+
+// updateFields replaces the block's own fields with the given block's; id, position and subblocks stay the same
+func (st *InMemoryStore) updateFields(blockId id, fields block) (mutation, error) {
+	blockToUpdate, _, mapWhereBlockIsLocated, err := st.findBlockById(blockId)
+	if err != nil {
+		return mutation{}, err
+	}
+	previous := blockToUpdate.fields()
+	updatedBlock := blockToUpdate.withFields(fields)
+	mapWhereBlockIsLocated.Set(blockId, updatedBlock)
+	st.backlinks.remove(previous)
+	st.backlinks.add(updatedBlock)
+	st.searchIndex.remove(previous)
+	st.searchIndex.add(updatedBlock)
+	return mutation{
+		kind:     mutationUpdate,
+		blockId:  blockId,
+		block:    fields.fields(),
+		previous: previous,
+	}, nil
+}
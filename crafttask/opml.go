@@ -0,0 +1,260 @@
+package crafttask
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	registerExportFormat("opml", exportFormat{
+		contentType: "text/x-opml",
+		newExporter: func(url.Values) (exporter, error) { return opmlExporter{}, nil },
+	})
+	registerImportFormat("opml", importOpml)
+}
+
+// opmlExporter writes an OPML 2.0 document with an outline per block, nested like the blocks are
+type opmlExporter struct{}
+
+// opmlNoteAttribute is the attribute outliners keep notes in, where opmlExporter writes the formatted content
+const opmlNoteAttribute = "_note"
+
+// opmlFieldAttributes are the attributes opmlExporter writes the block's fields in, which properties can't be
+var opmlFieldAttributes = map[string]bool{"text": true, "type": true, "level": true, "checked": true, "language": true}
+
+// opmlAttributeName matches the property names that are attribute names too, leaving out the rest of XML names
+var opmlAttributeName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+func (opmlExporter) writeHeader(w *bufio.Writer) {
+	w.WriteString(xml.Header)
+	w.WriteString("<opml version=\"2.0\">\n  <head></head>\n  <body>\n")
+}
+
+func (opmlExporter) writeBlock(w *bufio.Writer, b block, depth int) {
+	b = referenceAsText(b, false)
+	w.WriteString(opmlIndentation(depth))
+	w.WriteString(`<outline text="`)
+	xml.EscapeText(w, []byte(b.content)) // escapes line breaks too, so they survive in the attribute
+	w.WriteString(`"`)
+	switch b.blockType {
+	case blockTypeHeading:
+		fmt.Fprintf(w, ` type="%s" level="%d"`, b.blockType, b.level)
+	case blockTypeTodo:
+		fmt.Fprintf(w, ` type="%s" checked="%t"`, b.blockType, b.checked)
+	case blockTypeCode:
+		fmt.Fprintf(w, ` type="%s" language="`, b.blockType)
+		xml.EscapeText(w, []byte(b.language))
+		w.WriteString(`"`)
+	case blockTypeQuote, blockTypeDivider:
+		fmt.Fprintf(w, ` type="%s"`, b.blockType)
+	}
+	if b.richText != nil {
+		fmt.Fprintf(w, ` %s="`, opmlNoteAttribute)
+		xml.EscapeText(w, []byte(strings.Join(markdownLines(b), "\n")))
+		w.WriteString(`"`)
+	}
+	for _, name := range sortedPropertyNames(b.properties) {
+		if opmlFieldAttributes[name] || !opmlAttributeName.MatchString(name) || name == opmlNoteAttribute && b.richText != nil {
+			continue
+		}
+		fmt.Fprintf(w, ` %s="`, name)
+		xml.EscapeText(w, []byte(propertyText(b.properties[name])))
+		w.WriteString(`"`)
+	}
+	if len(b.subblocks.keys) == 0 {
+		w.WriteString("/>\n")
+		return
+	}
+	w.WriteString(">\n")
+}
+
+func (opmlExporter) closeBlock(w *bufio.Writer, b block, depth int) {
+	if len(b.subblocks.keys) == 0 {
+		return // closed right away
+	}
+	w.WriteString(opmlIndentation(depth))
+	w.WriteString("</outline>\n")
+}
+
+func (opmlExporter) writeFooter(w *bufio.Writer) {
+	w.WriteString("  </body>\n</opml>\n")
+}
+
+// outlines are inside opml and body
+func opmlIndentation(depth int) string {
+	return strings.Repeat("  ", depth+2)
+}
+
+// importOpml reads the outlines in the body of an OPML document as blocks; outlines of other types than the block
+// types, e.g. links, are paragraphs, and attributes opmlExporter doesn't write are string properties
+func importOpml(text string) ([]blockRequest, error) {
+	var errs lineErrors
+	decoder := xml.NewDecoder(strings.NewReader(text))
+	decoder.CharsetReader = opmlCharsetReader
+	blocks := make([]importedBlock, 0)
+	// the names of the elements the decoder is in
+	openElements := make([]string, 0)
+	outlineDepth := -1
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			var syntaxErr *xml.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				return nil, append(errs, lineError{line: syntaxErr.Line, message: syntaxErr.Msg})
+			}
+			return nil, err
+		}
+		line, _ := decoder.InputPos()
+		switch element := token.(type) {
+		case xml.StartElement:
+			name := element.Name.Local
+			parent := ""
+			if len(openElements) > 0 {
+				parent = openElements[len(openElements)-1]
+			}
+			openElements = append(openElements, name)
+			switch {
+			case parent == "" && name != "opml":
+				errs = append(errs, lineError{line: line, message: fmt.Sprintf("the root element is %s instead of opml", name)})
+			case name == "outline" && opmlInBody(openElements):
+				outlineDepth++
+				typeFields, err := opmlTypeFields(element)
+				if err == nil {
+					err = validateTypeFields(typeFields.applyTo(block{content: opmlAttribute(element, "text")}))
+				}
+				if err != nil {
+					errs = append(errs, lineError{line: line, message: err.Error()})
+				}
+				content := opmlAttribute(element, "text")
+				richText, properties := opmlRichText(element, content), opmlProperties(element)
+				if richText != nil {
+					delete(properties, opmlNoteAttribute)
+				}
+				blocks = append(blocks, importedBlock{
+					depth:      outlineDepth,
+					typeFields: typeFields,
+					content:    content,
+					richText:   richText,
+					properties: properties,
+				})
+			case name == "outline":
+				errs = append(errs, lineError{line: line, message: "outline outside of the body"})
+			case parent == "body" || parent == "outline":
+				errs = append(errs, lineError{line: line, message: fmt.Sprintf("%s element in the body, only outlines can be there", name)})
+			}
+		case xml.EndElement:
+			if element.Name.Local == "outline" && opmlInBody(openElements) {
+				outlineDepth--
+			}
+			openElements = openElements[:len(openElements)-1]
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	nested, _ := nestBlocks(blocks, 0, 0)
+	return nested, nil
+}
+
+// opmlInBody tells whether the open elements are opml, body and any number of outlines
+func opmlInBody(openElements []string) bool {
+	if len(openElements) < 2 || openElements[0] != "opml" || openElements[1] != "body" {
+		return false
+	}
+	for _, name := range openElements[2:] {
+		if name != "outline" {
+			return false
+		}
+	}
+	return true
+}
+
+// opmlCharsetReader decodes the encodings other than UTF-8 that outliners write OPML in
+func opmlCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	switch strings.ToLower(charset) {
+	case "us-ascii":
+		return input, nil
+	case "iso-8859-1", "latin1":
+		latin1, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		runes := make([]rune, 0, len(latin1))
+		for _, b := range latin1 {
+			runes = append(runes, rune(b)) // Latin-1 is the first 256 code points
+		}
+		return strings.NewReader(string(runes)), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding %s", charset)
+}
+
+// opmlTypeFields reads the block type of an outline and the type specific fields of that type
+func opmlTypeFields(element xml.StartElement) (blockTypeFields, error) {
+	fields := blockTypeFields{Type: blockType(opmlAttribute(element, "type"))}
+	switch fields.Type {
+	case blockTypeHeading:
+		level, err := strconv.Atoi(opmlAttribute(element, "level"))
+		if err != nil {
+			return fields, errors.New("heading without a level attribute that is a number")
+		}
+		fields.Level = level
+	case blockTypeTodo:
+		fields.Checked = opmlAttribute(element, "checked") == "true"
+	case blockTypeCode:
+		fields.Language = opmlAttribute(element, "language")
+	case blockTypeQuote, blockTypeDivider:
+	default:
+		fields.Type = "" // a paragraph, like outlines of the other types
+	}
+	return fields, nil
+}
+
+// opmlRichText reads the content's formatting from the outline's note, if its markup is the content formatted
+func opmlRichText(element xml.StartElement, content string) []textRunPayload {
+	note := opmlAttribute(element, opmlNoteAttribute)
+	if note == "" {
+		return nil
+	}
+	text, runs := parseMarkdownInline(note)
+	if text != content {
+		return nil
+	}
+	return richTextToPayloads(runs)
+}
+
+// opmlProperties are the outline's attributes other than the ones of the block's fields, as string properties
+func opmlProperties(element xml.StartElement) map[string]propertyPayload {
+	var toReturn map[string]propertyPayload
+	for _, attribute := range element.Attr {
+		name := attribute.Name.Local
+		if attribute.Name.Space != "" || name == "xmlns" || opmlFieldAttributes[name] {
+			continue
+		}
+		if toReturn == nil {
+			toReturn = make(map[string]propertyPayload)
+		}
+		value, _ := json.Marshal(attribute.Value)
+		toReturn[name] = propertyPayload{Type: propertyTypeString, Value: value}
+	}
+	return toReturn
+}
+
+func opmlAttribute(element xml.StartElement, name string) string {
+	for _, attribute := range element.Attr {
+		if attribute.Name.Local == name {
+			return attribute.Value
+		}
+	}
+	return ""
+}
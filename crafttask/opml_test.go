@@ -0,0 +1,173 @@
+package crafttask
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryStore_ExportOpml(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	_, err = store.UpdateBlock(6, updatePayload{Content: "<Child> \"Block\" & 6\nsecond line"})
+	require.NoError(t, err)
+
+	assert.Equal(t, `<?xml version="1.0" encoding="UTF-8"?>
+<opml version="2.0">
+  <head></head>
+  <body>
+    <outline text="Block 1">
+      <outline text="Child Block 2">
+        <outline text="Grandchild Block 3"/>
+      </outline>
+      <outline text="Child Block 4"/>
+    </outline>
+    <outline text="Block 5">
+      <outline text="&lt;Child&gt; &#34;Block&#34; &amp; 6&#xA;second line"/>
+    </outline>
+  </body>
+</opml>
+`, store.ExportWith(opmlExporter{}))
+	assertRoundTrip(t, store, func() exporter { return opmlExporter{} }, importOpml)
+}
+
+func TestOpml_Properties(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{
+		blockTypeFields: blockTypeFields{Type: blockTypeTodo},
+		Content:         "Task",
+		Properties: map[string]propertyPayload{
+			"owner":    property(propertyTypeString, `"ana"`),
+			"estimate": property(propertyTypeNumber, `2.5`),
+			"tags":     property(propertyTypeList, `["a", "b"]`),
+			"checked":  property(propertyTypeBool, `true`),
+			"due date": property(propertyTypeDate, `"2024-01-01"`),
+		},
+	}}})
+	require.NoError(t, err)
+
+	exported := store.ExportWith(opmlExporter{})
+	assert.Contains(t, exported, `<outline text="Task" type="todo" checked="false" estimate="2.5" owner="ana" tags="a, b"/>`,
+		"properties named like the fields or not like attributes are left out")
+	blocks, err := importOpml(exported)
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	assert.Equal(t, map[string]propertyPayload{
+		"estimate": property(propertyTypeString, `"2.5"`),
+		"owner":    property(propertyTypeString, `"ana"`),
+		"tags":     property(propertyTypeString, `"a, b"`),
+	}, blocks[0].Properties)
+	assertRoundTrip(t, store, func() exporter { return opmlExporter{} }, importOpml)
+}
+
+func TestOpml_RichText(t *testing.T) {
+	store := NewInMemoryStore()
+	richText := []textRunPayload{
+		{Text: "Run "}, {Text: "go test", Marks: []string{"code"}}, {Text: " or "},
+		{Text: "read the docs", Marks: []string{"bold"}, Link: "https://go.dev/doc/"},
+	}
+	_, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{
+		RichText:   richText,
+		Properties: map[string]propertyPayload{"_note": property(propertyTypeString, `"a note"`)},
+	}}})
+	require.NoError(t, err)
+
+	exported := store.ExportWith(opmlExporter{})
+	assert.Contains(t, exported, "<outline text=\"Run go test or read the docs\" _note=\"Run `go test` or [**read the docs**](https://go.dev/doc/)\"/>",
+		"the formatted content takes the place of a note")
+	blocks, err := importOpml(exported)
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+	assert.Equal(t, richText, blocks[0].RichText)
+	assert.Empty(t, blocks[0].Properties)
+	assertRoundTrip(t, store, func() exporter { return opmlExporter{} }, importOpml)
+
+	blocks, err = importOpml(`<opml><body><outline text="Block" _note="*Not* the block"/></body></opml>`)
+	require.NoError(t, err)
+	assert.Nil(t, blocks[0].RichText)
+	assert.Equal(t, map[string]propertyPayload{"_note": property(propertyTypeString, `"*Not* the block"`)}, blocks[0].Properties,
+		"a note that isn't the text formatted is a note")
+}
+
+// The supported subset of OPML 2.0: the outlines in the body with their attributes, nested.
+func TestImportOpml(t *testing.T) {
+	blocks, err := importOpml(`<?xml version="1.0" encoding="ISO-8859-1"?>
+<opml version="2.0">
+	<head>
+		<title>states.opml</title>
+		<expansionState>1, 6, 13</expansionState>
+	</head>
+	<body>
+		<outline text="United States" created="Mon, 11 Jan 2021 10:00:00 GMT" xmlns:dc="http://purl.org/dc/elements/1.1/" dc:subject="geography">
+			<outline text="Far West" isComment="false">
+				<outline text="Alaska"/>
+			</outline>
+			<outline type="link" url="http://example.com"/>
+		</outline>
+		<outline text=""></outline>
+	</body>
+</opml>`)
+	require.NoError(t, err)
+	assert.Equal(t, []blockRequest{
+		{Content: "United States", Properties: map[string]propertyPayload{"created": property(propertyTypeString, `"Mon, 11 Jan 2021 10:00:00 GMT"`)}, Subblocks: []blockRequest{
+			{Content: "Far West", Properties: map[string]propertyPayload{"isComment": property(propertyTypeString, `"false"`)}, Subblocks: []blockRequest{
+				{Content: "Alaska", Subblocks: []blockRequest{}},
+			}},
+			{Content: "", Properties: map[string]propertyPayload{"url": property(propertyTypeString, `"http://example.com"`)}, Subblocks: []blockRequest{}},
+		}},
+		{Content: "", Subblocks: []blockRequest{}},
+	}, blocks, "outlines without text attribute are blocks without content, the attributes in a namespace are dropped")
+
+	blocks, err = importOpml(`<opml version="1.0"><body/></opml>`)
+	require.NoError(t, err)
+	assert.Empty(t, blocks)
+
+	blocks, err = importOpml("<?xml version=\"1.0\" encoding=\"ISO-8859-1\"?><opml><body><outline text=\"Z\xfcrich\"/></body></opml>")
+	require.NoError(t, err)
+	assert.Equal(t, []blockRequest{{Content: "Zürich", Subblocks: []blockRequest{}}}, blocks)
+}
+
+func TestImportOpml_Malformed(t *testing.T) {
+	_, err := importOpml(`<opml version="2.0">
+  <head><outline text="Not in the body"/></head>
+  <body>
+    <outline text="Block">
+      <p>Not an outline</p>
+    </outline>
+  </body>
+</opml>`)
+	assert.Equal(t, lineErrors{
+		{line: 2, message: "outline outside of the body"},
+		{line: 5, message: "p element in the body, only outlines can be there"},
+	}, err)
+
+	_, err = importOpml("<html>\n<body><outline text=\"Block\"/></body></html>")
+	assert.Equal(t, lineErrors{
+		{line: 1, message: "the root element is html instead of opml"},
+		{line: 2, message: "outline outside of the body"},
+	}, err)
+
+	_, err = importOpml("<opml>\n<body>\n<outline text=\"Unclosed Block\">\n</body></opml>")
+	assert.Equal(t, lineErrors{{line: 4, message: "element <outline> closed by </body>"}}, err)
+}
+
+func TestAPI_OpmlFormat(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	response := doRequest(t, r, "POST", "/documents/1/import?format=opml",
+		`<opml version="2.0"><body><outline text="Block 1"><outline text="Child Block 2"/></outline></body></opml>`)
+	require.Equal(t, http.StatusCreated, response.Code)
+
+	response = doRequest(t, r, "GET", "/documents/1/export?format=opml", "")
+	assert.Equal(t, "text/x-opml", response.Header().Get("Content-Type"))
+	assert.Contains(t, response.Body.String(), "<outline text=\"Block 1\">\n      <outline text=\"Child Block 2\"/>\n    </outline>")
+}
@@ -0,0 +1,222 @@
+package crafttask
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// propertyType is the type of a property's value
+type propertyType string
+
+const (
+	propertyTypeString propertyType = "string"
+	propertyTypeNumber propertyType = "number"
+	propertyTypeBool   propertyType = "bool"
+	// dates are calendar dates, written like 2006-01-02
+	propertyTypeDate propertyType = "date"
+	// lists are lists of strings
+	propertyTypeList propertyType = "list"
+)
+
+const propertyDateLayout = "2006-01-02"
+
+// propertyValue is the value of a block's property, in the field of its type
+type propertyValue struct {
+	propertyType propertyType
+	// text of strings and dates
+	text    string
+	number  float64
+	boolean bool
+	list    []string
+}
+
+// properties are a block's properties by name. A block's properties are never changed in place, so copies of the
+// block can share them.
+type properties map[string]propertyValue
+
+// with returns a copy of the properties with the property set
+func (p properties) with(name string, value propertyValue) properties {
+	updated := make(properties, len(p)+1)
+	for existingName, existingValue := range p {
+		updated[existingName] = existingValue
+	}
+	updated[name] = value
+	return updated
+}
+
+// without returns a copy of the properties without the property, nil when there are none left
+func (p properties) without(name string) properties {
+	if len(p) <= 1 {
+		return nil
+	}
+	updated := make(properties, len(p)-1)
+	for existingName, existingValue := range p {
+		if existingName != name {
+			updated[existingName] = existingValue
+		}
+	}
+	return updated
+}
+
+func (p properties) equal(other properties) bool {
+	if len(p) == 0 && len(other) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(p, other)
+}
+
+func validatePropertyName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errInvalidPropertyName
+	}
+	return nil
+}
+
+// propertyFromPayload reads the payload's value as its type
+func propertyFromPayload(payload propertyPayload) (propertyValue, error) {
+	value := propertyValue{propertyType: payload.Type}
+	var err error
+	switch payload.Type {
+	case propertyTypeString:
+		err = json.Unmarshal(payload.Value, &value.text)
+	case propertyTypeNumber:
+		err = json.Unmarshal(payload.Value, &value.number)
+	case propertyTypeBool:
+		err = json.Unmarshal(payload.Value, &value.boolean)
+	case propertyTypeDate:
+		if err = json.Unmarshal(payload.Value, &value.text); err == nil {
+			_, err = time.Parse(propertyDateLayout, value.text)
+		}
+	case propertyTypeList:
+		err = json.Unmarshal(payload.Value, &value.list)
+		if err == nil && value.list == nil {
+			value.list = []string{}
+		}
+	default:
+		return propertyValue{}, errUnknownPropertyType
+	}
+	if err != nil || string(payload.Value) == "null" {
+		return propertyValue{}, fmt.Errorf("%w: %s", errInvalidPropertyValue, payload.Type)
+	}
+	return value, nil
+}
+
+func propertyToPayload(value propertyValue) propertyPayload {
+	var raw []byte
+	switch value.propertyType {
+	case propertyTypeString, propertyTypeDate:
+		raw, _ = json.Marshal(value.text)
+	case propertyTypeNumber:
+		raw, _ = json.Marshal(value.number)
+	case propertyTypeBool:
+		raw, _ = json.Marshal(value.boolean)
+	case propertyTypeList:
+		raw, _ = json.Marshal(value.list)
+	}
+	return propertyPayload{Type: value.propertyType, Value: raw}
+}
+
+// propertyText is the value as text, for formats without types: lists are their items separated by commas
+func propertyText(value propertyValue) string {
+	switch value.propertyType {
+	case propertyTypeNumber:
+		return strconv.FormatFloat(value.number, 'f', -1, 64)
+	case propertyTypeBool:
+		return strconv.FormatBool(value.boolean)
+	case propertyTypeList:
+		return strings.Join(value.list, ", ")
+	}
+	return value.text
+}
+
+// sortedPropertyNames are the names of the properties in order, for formats writing them one by one
+func sortedPropertyNames(p properties) []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// propertiesFromPayloads reads every property of a request, nil when it has none
+func propertiesFromPayloads(payloads map[string]propertyPayload) (properties, error) {
+	if len(payloads) == 0 {
+		return nil, nil
+	}
+	toReturn := make(properties, len(payloads))
+	for name, payload := range payloads {
+		if err := validatePropertyName(name); err != nil {
+			return nil, err
+		}
+		value, err := propertyFromPayload(payload)
+		if err != nil {
+			return nil, err
+		}
+		toReturn[name] = value
+	}
+	return toReturn, nil
+}
+
+func propertiesToPayloads(p properties) map[string]propertyPayload {
+	if len(p) == 0 {
+		return nil
+	}
+	toReturn := make(map[string]propertyPayload, len(p))
+	for name, value := range p {
+		toReturn[name] = propertyToPayload(value)
+	}
+	return toReturn
+}
+
+// SetProperty sets the block's property, replacing the value it had
+func (st *InMemoryStore) SetProperty(blockId id, name string, payload propertyPayload) (block, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if err := validatePropertyName(name); err != nil {
+		return block{}, err
+	}
+	value, err := propertyFromPayload(payload)
+	if err != nil {
+		return block{}, err
+	}
+	blockToUpdate, _, _, err := st.findBlockById(blockId)
+	if err != nil {
+		return block{}, err
+	}
+	fields := blockToUpdate.fields()
+	fields.properties = fields.properties.with(name, value)
+	var tx transaction
+	if err := tx.record(st.updateFields(blockId, fields)); err != nil {
+		return block{}, err
+	}
+	st.commit(tx, fmt.Sprintf("set property %s of block %d", name, blockId))
+	updatedBlock, _, _, _ := st.findBlockById(blockId)
+	return st.resolvedClone(updatedBlock), nil
+}
+
+// UnsetProperty removes the block's property; a property that isn't set is left as is
+func (st *InMemoryStore) UnsetProperty(blockId id, name string) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	blockToUpdate, _, _, err := st.findBlockById(blockId)
+	if err != nil {
+		return err
+	}
+	if _, isSet := blockToUpdate.properties[name]; !isSet {
+		return nil
+	}
+	fields := blockToUpdate.fields()
+	fields.properties = fields.properties.without(name)
+	var tx transaction
+	if err := tx.record(st.updateFields(blockId, fields)); err != nil {
+		return err
+	}
+	st.commit(tx, fmt.Sprintf("unset property %s of block %d", name, blockId))
+	return nil
+}
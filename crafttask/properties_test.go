@@ -0,0 +1,194 @@
+package crafttask
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func property(propertyType propertyType, value string) propertyPayload {
+	return propertyPayload{Type: propertyType, Value: json.RawMessage(value)}
+}
+
+func TestPropertyFromPayload(t *testing.T) {
+	for _, valid := range []propertyPayload{
+		property(propertyTypeString, `"Ana"`),
+		property(propertyTypeNumber, `3.5`),
+		property(propertyTypeBool, `true`),
+		property(propertyTypeDate, `"2026-10-18"`),
+		property(propertyTypeList, `["backend","urgent"]`),
+		property(propertyTypeList, `[]`),
+	} {
+		value, err := propertyFromPayload(valid)
+		require.NoError(t, err, string(valid.Value))
+		assert.Equal(t, valid, propertyToPayload(value))
+	}
+
+	for _, invalid := range []propertyPayload{
+		property(propertyTypeString, `3`),
+		property(propertyTypeNumber, `"3"`),
+		property(propertyTypeBool, `null`),
+		property(propertyTypeDate, `"18.10.2026"`),
+		property(propertyTypeList, `[1, 2]`),
+		property(propertyTypeString, ``),
+	} {
+		_, err := propertyFromPayload(invalid)
+		assert.ErrorIs(t, err, errInvalidPropertyValue, string(invalid.Value))
+	}
+	_, err := propertyFromPayload(property("color", `"red"`))
+	assert.Equal(t, errUnknownPropertyType, err)
+}
+
+func TestInMemoryStore_SetProperty(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+
+	updated, err := store.SetProperty(1, "owner", property(propertyTypeString, `"Ana"`))
+	require.NoError(t, err)
+	assert.Equal(t, properties{"owner": {propertyType: propertyTypeString, text: "Ana"}}, updated.properties)
+	_, err = store.SetProperty(1, "due", property(propertyTypeDate, `"2026-11-01"`))
+	require.NoError(t, err)
+	updated, err = store.SetProperty(1, "owner", property(propertyTypeString, `"Ben"`))
+	require.NoError(t, err)
+	assert.Len(t, updated.properties, 2)
+	assert.Equal(t, "Ben", updated.properties["owner"].text)
+
+	// updating the content keeps the properties
+	updated, err = store.UpdateBlock(1, updatePayload{Content: "Block one"})
+	require.NoError(t, err)
+	assert.Len(t, updated.properties, 2)
+
+	require.NoError(t, store.UnsetProperty(1, "owner"))
+	require.NoError(t, store.UnsetProperty(1, "owner"))
+	blocks := store.FetchBlocks([]id{1})
+	require.Len(t, blocks, 1)
+	assert.Equal(t, properties{"due": {propertyType: propertyTypeDate, text: "2026-11-01"}}, blocks[0].properties)
+
+	require.NoError(t, store.Undo())
+	require.NoError(t, store.Undo())
+	require.NoError(t, store.Undo())
+	blocks = store.FetchBlocks([]id{1})
+	assert.Equal(t, "Ana", blocks[0].properties["owner"].text)
+
+	_, err = store.SetProperty(10, "owner", property(propertyTypeString, `"Ana"`))
+	assert.Equal(t, errBlockDoesNotExist, err)
+	_, err = store.SetProperty(1, " ", property(propertyTypeString, `"Ana"`))
+	assert.Equal(t, errInvalidPropertyName, err)
+	assert.Equal(t, errBlockDoesNotExist, store.UnsetProperty(10, "owner"))
+}
+
+func TestInMemoryStore_DuplicateCopiesProperties(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	_, err = store.SetProperty(3, "tags", property(propertyTypeList, `["a","b"]`))
+	require.NoError(t, err)
+
+	duplicate, err := store.DuplicateBlock(2)
+	require.NoError(t, err)
+	duplicatedGrandchild := duplicate.subblocks.OrderedValues()[0]
+	assert.Equal(t, []string{"a", "b"}, duplicatedGrandchild.properties["tags"].list)
+
+	_, err = store.SetProperty(duplicatedGrandchild.id, "tags", property(propertyTypeList, `["c"]`))
+	require.NoError(t, err)
+	blocks := store.FetchBlocks([]id{3})
+	assert.Equal(t, []string{"a", "b"}, blocks[0].properties["tags"].list)
+}
+
+func TestInMemoryStore_InsertWithProperties(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Task", Properties: map[string]propertyPayload{
+			"points": property(propertyTypeNumber, `3`),
+			"done":   property(propertyTypeBool, `false`),
+		}}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `{"SchemaVersion":1,"Blocks":[{"Id":1,"Content":"Task",`+
+		`"Properties":{"done":{"Type":"bool","Value":false},"points":{"Type":"number","Value":3}},"Subblocks":[]}]}`+"\n",
+		store.ExportWith(&jsonExporter{}))
+
+	blocks, err := importJson(store.ExportWith(&jsonExporter{}))
+	require.NoError(t, err)
+	imported := NewInMemoryStore()
+	_, err = imported.ImportBlocks(insertOperationsAt(root, 0, blocks), true)
+	require.NoError(t, err)
+	assert.Equal(t, store.ExportWith(&jsonExporter{}), imported.ExportWith(&jsonExporter{}))
+
+	_, err = store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Subblocks: []blockRequest{
+			{Properties: map[string]propertyPayload{"due": property(propertyTypeDate, `"tomorrow"`)}},
+		}}},
+	})
+	var invalidOperations operationErrors
+	require.ErrorAs(t, err, &invalidOperations)
+	assert.ErrorIs(t, invalidOperations[0], errInvalidPropertyValue)
+}
+
+func TestFileStore_ReplaysProperties(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Task"}}})
+	require.NoError(t, err)
+	_, err = store.SetProperty(1, "owner", property(propertyTypeString, `"Ana"`))
+	require.NoError(t, err)
+	_, err = store.SetProperty(1, "status", property(propertyTypeString, `"open"`))
+	require.NoError(t, err)
+	require.NoError(t, store.UnsetProperty(1, "owner"))
+	expectedExport := store.ExportWith(&jsonExporter{})
+	require.NoError(t, store.Close())
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, expectedExport, reopened.ExportWith(&jsonExporter{}))
+}
+
+func TestAPI_Properties(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Task"}}]`)
+
+	response := doRequest(t, r, "PUT", "/documents/1/blocks/1/properties/owner", `{"Type":"string","Value":"Ana"}`)
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `{"Id":1,"Type":"paragraph","Content":"Task","Properties":{"owner":{"Type":"string","Value":"Ana"}},"Subblocks":[]}`, response.Body.String())
+	response = doRequest(t, r, "PUT", "/documents/1/blocks/1/properties/due", `{"Type":"date","Value":"2026-10-18"}`)
+	require.Equal(t, http.StatusOK, response.Code)
+
+	response = doRequest(t, r, "DELETE", "/documents/1/blocks/1/properties/owner", "")
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = doRequest(t, r, "GET", "/documents/1/blocks?blockIds=1", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `[{"Id":1,"Type":"paragraph","Content":"Task","Properties":{"due":{"Type":"date","Value":"2026-10-18"}},"Subblocks":[]}]`, response.Body.String())
+
+	response = doRequest(t, r, "PUT", "/documents/1/blocks/1/properties/due", `{"Type":"date","Value":"soon"}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doRequest(t, r, "PUT", "/documents/1/blocks/1/properties/due", `{"Type":"color","Value":"red"}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doRequest(t, r, "PUT", "/documents/1/blocks/7/properties/due", `{"Type":"date","Value":"2026-10-18"}`)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = doRequest(t, r, "DELETE", "/documents/1/blocks/7/properties/due", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = doRequest(t, r, "GET", "/documents/1/diff?from=2&to=4", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"Change":"properties_changed","BlockId":1,`+
+		`"OldProperties":{"owner":{"Type":"string","Value":"Ana"}},"NewProperties":{"due":{"Type":"date","Value":"2026-10-18"}}`)
+}
@@ -0,0 +1,194 @@
+package crafttask
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+var errInvalidReferencesOption = errors.New("references has to be inline or link")
+
+// referencedBlock follows the reference through targets that are references themselves to the block it resolves to.
+// It fails when a target doesn't exist or the references lead back to one of them.
+func (st *InMemoryStore) referencedBlock(referenceId, targetId id) (block, error) {
+	visited := map[id]bool{referenceId: true}
+	for {
+		if visited[targetId] {
+			return block{}, errReferenceCycle
+		}
+		visited[targetId] = true
+		target, _, _, err := st.findBlockById(targetId)
+		if err != nil {
+			return block{}, errReferenceTargetDoesNotExist
+		}
+		if target.blockType != blockTypeReference {
+			return target, nil
+		}
+		targetId = target.target
+	}
+}
+
+// resolveReference returns the reference with the content and rich text of the block it resolves to, or with why it
+// is broken when it doesn't resolve; other blocks are returned as they are
+func (st *InMemoryStore) resolveReference(b block) block {
+	if b.blockType != blockTypeReference {
+		return b
+	}
+	target, err := st.referencedBlock(b.id, b.target)
+	if err != nil {
+		b.broken = err
+		return b
+	}
+	b.content = target.content
+	b.richText = target.richText
+	return b
+}
+
+// resolvedClone deep copies the block like clone does, resolving every reference in it on the way.
+// It's how blocks are handed out, so they are read with their targets' current content.
+func (st *InMemoryStore) resolvedClone(b block) block {
+	resolved := st.resolveReference(b.fields())
+	resolved.subblocks = NewOrderedMapOfBlocks()
+	for _, subblock := range b.subblocks.OrderedValues() {
+		resolved.subblocks.Set(subblock.id, st.resolvedClone(subblock))
+	}
+	return resolved
+}
+
+// validateReference checks that the block can refer to the target: the target has to exist, and mustn't lead back
+// to the block through other references. Targets further on that don't exist only make the reference broken.
+func (st *InMemoryStore) validateReference(blockId, targetId id) error {
+	if _, exists := st.parentsCache[targetId]; !exists {
+		return errReferenceTargetDoesNotExist
+	}
+	if _, err := st.referencedBlock(blockId, targetId); errors.Is(err, errReferenceCycle) {
+		return err
+	}
+	return nil
+}
+
+// validateReferenceTargets checks that the references in the requested subtree refer to blocks that exist, either in
+// the document or among the blocks imported along with them. importedTargets has the ids of those, mapped to the
+// target of the ones that are references and to root for the others.
+func (st *InMemoryStore) validateReferenceTargets(request blockRequest, importedTargets map[id]id) error {
+	if request.Type == blockTypeReference {
+		if _, imported := importedTargets[request.Target]; imported {
+			if importedReferenceCycle(request, importedTargets) {
+				return errReferenceCycle
+			}
+		} else if _, exists := st.parentsCache[request.Target]; !exists {
+			return errReferenceTargetDoesNotExist
+		}
+	}
+	for _, subblockRequest := range request.Subblocks {
+		if err := st.validateReferenceTargets(subblockRequest, importedTargets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importedReferenceCycle tells whether the imported reference leads into a cycle of imported references.
+// References can't lead from the document to the imported blocks, so the cycle can only be among those.
+func importedReferenceCycle(request blockRequest, importedTargets map[id]id) bool {
+	visited := map[id]bool{}
+	if request.Id != root {
+		visited[request.Id] = true
+	}
+	for targetId := request.Target; targetId != root; {
+		if visited[targetId] {
+			return true
+		}
+		visited[targetId] = true
+		var imported bool
+		targetId, imported = importedTargets[targetId]
+		if !imported {
+			return false
+		}
+	}
+	return false
+}
+
+// collectImportedTargets adds the ids of the requested subtree to importedTargets, see validateReferenceTargets
+func collectImportedTargets(request blockRequest, importedTargets map[id]id) {
+	if request.Id != root {
+		importedTargets[request.Id] = request.Target
+	}
+	for _, subblockRequest := range request.Subblocks {
+		collectImportedTargets(subblockRequest, importedTargets)
+	}
+}
+
+// collectNewIds maps the ids of the requested subtree to the ids the blocks built from it got
+func collectNewIds(request blockRequest, built block, newIds map[id]id) {
+	if request.Id != root {
+		newIds[request.Id] = built.id
+	}
+	for i, subblock := range built.subblocks.OrderedValues() {
+		collectNewIds(request.Subblocks[i], subblock, newIds)
+	}
+}
+
+// retargetLinks points the references and block links of the subtree that are to blocks that got new ids to those ids
+func retargetLinks(b block, newIds map[id]id) block {
+	if newTarget, ok := newIds[b.target]; ok && b.blockType == blockTypeReference {
+		b.target = newTarget
+	}
+	if b.richText != nil {
+		retargeted := make([]textRun, len(b.richText)) // rich text is never changed in place
+		copy(retargeted, b.richText)
+		for i, run := range retargeted {
+			linkedId, isBlockLink := linkedBlockId(run.link)
+			if newId, ok := newIds[linkedId]; ok && isBlockLink {
+				retargeted[i].link = blockLink(newId)
+			}
+		}
+		b.richText = retargeted
+	}
+	for _, subblock := range b.subblocks.OrderedValues() {
+		b.subblocks.Set(subblock.id, retargetLinks(subblock, newIds))
+	}
+	return b
+}
+
+// resolvingExporter hands the exporter the blocks with their references resolved
+type resolvingExporter struct {
+	exporter
+	st *InMemoryStore
+}
+
+func (e resolvingExporter) writeBlock(w *bufio.Writer, b block, depth int) {
+	e.exporter.writeBlock(w, e.st.resolveReference(b), depth)
+}
+
+// linkReferencesOption takes whether the text formats link to the targets of references instead of showing their
+// content from the ?references= option, inline or link (inline by default)
+func linkReferencesOption(options url.Values) (bool, error) {
+	switch options.Get("references") {
+	case "", "inline":
+		return false, nil
+	case "link":
+		return true, nil
+	}
+	return false, errInvalidReferencesOption
+}
+
+// referenceAsText returns the resolved reference with the content the text formats write for it: the content it
+// resolved to, or with linkReferences a link to its target, "block 3" linking to "#block-3". Broken references are
+// a note on what they refer to in italics. Other blocks are returned as they are.
+func referenceAsText(b block, linkReferences bool) block {
+	if b.blockType != blockTypeReference {
+		return b
+	}
+	switch {
+	case b.broken != nil:
+		b.richText = []textRun{{text: fmt.Sprintf("broken reference to block %d", b.target), marks: markItalic}}
+	case linkReferences:
+		b.richText = []textRun{{text: fmt.Sprintf("block %d", b.target), link: blockLink(b.target)}}
+	default:
+		return b
+	}
+	b.content = plainText(b.richText)
+	return b
+}
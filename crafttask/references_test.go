@@ -0,0 +1,219 @@
+package crafttask
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reference(target id) blockRequest {
+	return blockRequest{blockTypeFields: blockTypeFields{Type: blockTypeReference, Target: target}}
+}
+
+func TestInMemoryStore_ResolvesReferences(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: 5, Index: 1, Block: reference(3)}})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 2, Block: reference(7)}})
+	require.NoError(t, err)
+
+	blocks := store.FetchBlocks([]id{5, 8})
+	require.Len(t, blocks, 2)
+	assert.Equal(t, "Grandchild Block 3", blocks[0].subblocks.OrderedValues()[1].content)
+	assert.Equal(t, "Grandchild Block 3", blocks[1].content, "references to references resolve to the block they end at")
+
+	_, err = store.UpdateBlock(3, updatePayload{RichText: []textRunPayload{{Text: "Updated", Marks: []string{"bold"}}}})
+	require.NoError(t, err)
+	blocks = store.FetchBlocks([]id{7})
+	assert.Equal(t, "Updated", blocks[0].content)
+	assert.Equal(t, []textRun{{text: "Updated", marks: markBold}}, blocks[0].richText)
+
+	require.NoError(t, store.DeleteBlocks([]id{2}))
+	blocks = store.FetchBlocks([]id{7, 8})
+	assert.Equal(t, errReferenceTargetDoesNotExist, blocks[0].broken)
+	assert.Empty(t, blocks[0].content)
+	assert.Equal(t, errReferenceTargetDoesNotExist, blocks[1].broken)
+
+	_, err = store.RestoreFromTrash(2, restorePayload{})
+	require.NoError(t, err)
+	blocks = store.FetchBlocks([]id{8})
+	assert.NoError(t, blocks[0].broken)
+	assert.Equal(t, "Updated", blocks[0].content)
+}
+
+func TestInMemoryStore_ValidatesReferences(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: 5, Index: 1, Block: reference(3)}})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 2, Block: reference(7)}})
+	require.NoError(t, err)
+
+	for expected, request := range map[error]blockRequest{
+		errReferenceTargetDoesNotExist: reference(10),
+		errMissingReferenceTarget:      reference(root),
+		errReferenceWithContent:        {blockTypeFields: blockTypeFields{Type: blockTypeReference, Target: 1}, Content: "own"},
+		errFieldNotOfBlockType:         {blockTypeFields: blockTypeFields{Type: blockTypeParagraph, Target: 1}},
+	} {
+		_, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: request}})
+		var invalidOperations operationErrors
+		require.ErrorAs(t, err, &invalidOperations)
+		assert.Equal(t, expected, invalidOperations[0])
+	}
+
+	_, err = store.UpdateBlock(3, updatePayload{blockTypeFields: blockTypeFields{Type: blockTypeReference, Target: 8}})
+	assert.Equal(t, errReferenceCycle, err, "3 would refer to itself through 8 and 7")
+	_, err = store.UpdateBlock(1, updatePayload{blockTypeFields: blockTypeFields{Type: blockTypeReference, Target: 1}})
+	assert.Equal(t, errReferenceCycle, err)
+	_, err = store.UpdateBlock(7, updatePayload{blockTypeFields: blockTypeFields{Type: blockTypeReference, Target: 10}})
+	assert.Equal(t, errReferenceTargetDoesNotExist, err)
+
+	updated, err := store.UpdateBlock(7, updatePayload{blockTypeFields: blockTypeFields{Type: blockTypeReference, Target: 4}})
+	require.NoError(t, err)
+	assert.Equal(t, "Child Block 4", updated.content)
+	blocks := store.FetchBlocks([]id{8})
+	assert.Equal(t, "Child Block 4", blocks[0].content)
+}
+
+func TestInMemoryStore_ExportReferences(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: 5, Index: 1, Block: reference(3)}})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 2, Block: reference(7)}})
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBlocks([]id{4}))
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 3, Block: reference(4)}})
+	require.Error(t, err)
+	_, err = store.RestoreFromTrash(4, restorePayload{})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 3, Block: reference(4)}})
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBlocks([]id{4}))
+
+	export := func(newExporter func(options url.Values) (exporter, error), options url.Values) string {
+		exporter, err := newExporter(options)
+		require.NoError(t, err)
+		return store.ExportWith(exporter)
+	}
+	assert.Equal(t, "Block 1\n  Child Block 2\n    Grandchild Block 3\nBlock 5\n  Child Block 6\n  Grandchild Block 3\n"+
+		"Grandchild Block 3\nbroken reference to block 4\n", export(newPlainTextExporter, url.Values{}))
+	assert.Equal(t, "- Block 1\n  - Child Block 2\n    - Grandchild Block 3\n- Block 5\n  - Child Block 6\n  - [block 3](#block-3)\n"+
+		"- [block 7](#block-7)\n- *broken reference to block 4*\n", export(newMarkdownExporter, url.Values{"references": {"link"}}))
+	assert.Contains(t, export(newHtmlExporter, url.Values{"references": {"link"}, "fragment": {"true"}}),
+		`  <li id="block-8" data-block-id="8"><p><a href="#block-7">block 7</a></p></li>`+"\n"+
+			`  <li id="block-9" data-block-id="9"><p><em>broken reference to block 4</em></p></li>`)
+	assert.Contains(t, store.ExportWith(opmlExporter{}), `<outline text="Grandchild Block 3"/>`)
+
+	_, err = newMarkdownExporter(url.Values{"references": {"embed"}})
+	assert.Equal(t, errInvalidReferencesOption, err)
+}
+
+func TestImportReferences(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: 5, Index: 1, Block: reference(3)}})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 2, Block: reference(7)}})
+	require.NoError(t, err)
+	exported := store.ExportWith(&jsonExporter{})
+	assert.Contains(t, exported, `{"Id":8,"Type":"reference","Target":7,"Content":"","Subblocks":[]}`)
+	blocks, err := importJson(exported)
+	require.NoError(t, err)
+
+	// with fresh ids, the references are pointed at the imported blocks
+	imported, err := store.ImportBlocks(insertOperationsAt(root, 0, blocks), false)
+	require.NoError(t, err)
+	require.Len(t, imported, 3)
+	importedReference := imported[2]
+	assert.Equal(t, id(15), importedReference.target)
+	assert.Equal(t, "Grandchild Block 3", importedReference.content)
+
+	// an imported block can refer back to itself through other imported ones
+	_, err = NewInMemoryStore().ImportBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Id: 1, blockTypeFields: blockTypeFields{Type: blockTypeReference, Target: 2}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Id: 2, blockTypeFields: blockTypeFields{Type: blockTypeReference, Target: 1}}},
+	}, true)
+	var invalidOperations operationErrors
+	require.ErrorAs(t, err, &invalidOperations)
+	assert.Equal(t, operationErrors{0: errReferenceCycle, 1: errReferenceCycle}, invalidOperations)
+}
+
+func TestFileStore_ReplaysReferences(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Target"}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Other"}},
+	})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 2, Block: reference(1)}})
+	require.NoError(t, err)
+	_, err = store.UpdateBlock(3, updatePayload{blockTypeFields: blockTypeFields{Type: blockTypeReference, Target: 2}})
+	require.NoError(t, err)
+	expectedExport := store.ExportWith(&jsonExporter{})
+	require.NoError(t, store.Close())
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, expectedExport, reopened.ExportWith(&jsonExporter{}))
+	assert.Equal(t, "Other", reopened.FetchBlocks([]id{3})[0].content)
+}
+
+func TestAPI_References(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Target"}}]`)
+
+	response := doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":1,"Block":{"Type":"reference","Target":1}}]`)
+	require.Equal(t, http.StatusCreated, response.Code)
+	assert.JSONEq(t, `[{"Id":2,"Type":"reference","Target":1,"Content":"Target","Subblocks":[]}]`, response.Body.String())
+
+	response = doRequest(t, r, "PATCH", "/documents/1/blocks/1", `{"Type":"reference","Target":2}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":1,"Block":{"Type":"reference","Target":5}}]`)
+	require.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Contains(t, response.Body.String(), `"ErrorCode":"reference_target_not_found"`)
+
+	doRequest(t, r, "DELETE", "/documents/1/blocks?blockIds=1", "")
+	response = doRequest(t, r, "GET", "/documents/1/blocks?blockIds=2", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `[{"Id":2,"Type":"reference","Target":1,"Broken":"reference_target_not_found","Content":"","Subblocks":[]}]`, response.Body.String())
+
+	response = doRequest(t, r, "GET", "/documents/1/export?references=all", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
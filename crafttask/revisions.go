@@ -0,0 +1,99 @@
+package crafttask
+
+import "time"
+
+// how many revisions are kept to rebuild earlier states from; states before the oldest kept one can't be rebuilt.
+// Revisions hold the subtrees their inserts and deletes touched, so they take up memory in proportion to the
+// operations, not to the document.
+const revisionLimit = 10000
+
+// how many of the newest revisions snapshots keep, since every snapshot writes all of them again; after a restart
+// the states before those can't be rebuilt any more
+const snapshotRevisionLimit = 1000
+
+type revision struct {
+	number    uint64
+	timestamp time.Time
+	summary   string
+	tx        transaction
+}
+
+// revisions is the document's linear history: every committed operation, undo and redo included, is the next revision
+type revisions struct {
+	current uint64
+	log     []revision
+}
+
+func (st *InMemoryStore) recordRevision(tx transaction) {
+	st.revisions.current++
+	st.revisions.log = append(st.revisions.log, revision{
+		number:    st.revisions.current,
+		timestamp: st.now(),
+		summary:   tx.summary,
+		tx:        tx,
+	})
+	if len(st.revisions.log) > revisionLimit {
+		st.revisions.log = st.revisions.log[1:]
+	}
+}
+
+// setClock replaces the source of revision timestamps; persisted operations are replayed with the time they were logged at
+func (st *InMemoryStore) setClock(now func() time.Time) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.now = now
+}
+
+// Revisions lists the revisions that can still be rebuilt, oldest first
+func (st *InMemoryStore) Revisions() []revision {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	toReturn := make([]revision, 0, len(st.revisions.log))
+	for _, revision := range st.revisions.log {
+		revision.tx = transaction{} // the mutations are internal to the store
+		toReturn = append(toReturn, revision)
+	}
+	return toReturn
+}
+
+// AtRevision rebuilds the document as it was right after the given revision (0 is the empty document)
+// by reverting every later revision on a copy of the current document
+func (st *InMemoryStore) AtRevision(revisionNumber uint64) (documentReader, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	rebuilt, err := st.atRevision(revisionNumber)
+	if err != nil {
+		return nil, err
+	}
+	return rebuilt, nil
+}
+
+// atRevision does what AtRevision does; callers hold the lock
+func (st *InMemoryStore) atRevision(revisionNumber uint64) (*InMemoryStore, error) {
+	if revisionNumber > st.revisions.current {
+		return nil, errRevisionDoesNotExist
+	}
+	if revisionNumber < st.revisions.current-uint64(len(st.revisions.log)) {
+		return nil, errRevisionNotAvailable
+	}
+	rebuilt := st.cloneDocument()
+	for i := len(st.revisions.log) - 1; i >= 0 && st.revisions.log[i].number > revisionNumber; i-- {
+		rebuilt.rollback(st.revisions.log[i].tx)
+	}
+	rebuilt.revisions.current = revisionNumber
+	return rebuilt, nil
+}
+
+// cloneDocument copies the tree, the parents cache and the indexes into a new store without any history
+func (st *InMemoryStore) cloneDocument() *InMemoryStore {
+	cloned := NewInMemoryStore()
+	for _, topLevelBlock := range st.document.blocks.OrderedValues() {
+		cloned.document.blocks.Set(topLevelBlock.id, topLevelBlock.clone())
+		cloned.backlinks.addSubtree(topLevelBlock)
+		cloned.searchIndex.addSubtree(topLevelBlock)
+	}
+	for blockId, parentId := range st.parentsCache {
+		cloned.parentsCache[blockId] = parentId
+	}
+	return cloned
+}
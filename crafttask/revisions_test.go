@@ -0,0 +1,133 @@
+package crafttask
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryStore_RevisionsAndTimeTravel(t *testing.T) {
+	store := NewInMemoryStore()
+
+	blocks, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}},
+	})
+	require.NoError(t, err)
+	exports := []string{"", store.Export()}
+	require.NoError(t, store.MoveBlock(blocks[1].id, movePayload{NewParentId: blocks[0].id}))
+	exports = append(exports, store.Export())
+	require.NoError(t, store.DeleteBlocks([]id{42}), "deleting nothing doesn't make a revision")
+	_, err = store.UpdateBlock(blocks[1].id, updatePayload{Content: "Updated Block 2"})
+	require.NoError(t, err)
+	exports = append(exports, store.Export())
+	require.NoError(t, store.Undo())
+	exports = append(exports, store.Export())
+	require.NoError(t, store.DeleteBlocks([]id{blocks[0].id}))
+	exports = append(exports, store.Export())
+
+	summaries := make([]string, 0)
+	for i, revision := range store.Revisions() {
+		assert.Equal(t, uint64(i+1), revision.number)
+		assert.False(t, revision.timestamp.IsZero())
+		summaries = append(summaries, revision.summary)
+	}
+	assert.Equal(t, []string{"insert 2 blocks", "move block 2", "update block 2", "undo update block 2", "delete 2 blocks"}, summaries,
+		"deleting block 1 deletes block 2 under it too")
+
+	for revision, expectedExport := range exports {
+		reader, err := store.AtRevision(uint64(revision))
+		require.NoError(t, err)
+		assert.Equal(t, expectedExport, reader.Export(), "revision %d", revision)
+	}
+	reader, err := store.AtRevision(3)
+	require.NoError(t, err)
+	fetched := reader.FetchBlocks([]id{blocks[1].id})
+	require.Len(t, fetched, 1)
+	assert.Equal(t, "Updated Block 2", fetched[0].content)
+
+	_, err = store.AtRevision(6)
+	assert.Equal(t, errRevisionDoesNotExist, err)
+	assert.Equal(t, exports[5], store.Export(), "time travel doesn't touch the current document")
+}
+
+func TestTransaction_BlockCount(t *testing.T) {
+	subtree := block{id: 1, subblocks: NewOrderedMapOfBlocks()}
+	subtree.subblocks.Set(2, block{id: 2, subblocks: NewOrderedMapOfBlocks()})
+	tx := transaction{mutations: []mutation{
+		{kind: mutationInsert, blockId: 1, block: subtree},
+		{kind: mutationUpdate, blockId: 3, block: block{id: 3}},
+		{kind: mutationMove, blockId: 4},
+	}}
+	assert.Equal(t, 4, tx.blockCount(), "updates and moves count the block they change")
+}
+
+func TestFileStore_RevisionsSurviveRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 2})
+	require.NoError(t, err)
+	blocks, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+	_, err = store.UpdateBlock(blocks[0].id, updatePayload{Content: "Updated Block 1"})
+	require.NoError(t, err)
+	_, err = store.DuplicateBlock(blocks[0].id)
+	require.NoError(t, err)
+	expectedRevisions := store.Revisions()
+	require.NoError(t, store.Close())
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 2})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, expectedRevisions, reopened.Revisions())
+	reader, err := reopened.AtRevision(1)
+	require.NoError(t, err)
+	assert.Equal(t, "Block 1\n", reader.Export())
+}
+
+func TestInMemoryStore_SnapshotKeepsNewestRevisions(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{
+		Content: "Block 1", Subblocks: []blockRequest{{Content: "Child Block 2"}, {Content: "Child Block 3"}},
+	}}})
+	require.NoError(t, err)
+	assert.Equal(t, "insert 3 blocks", store.Revisions()[0].summary)
+
+	for i := 0; i < snapshotRevisionLimit; i++ {
+		_, err = store.UpdateBlock(1, updatePayload{Content: fmt.Sprintf("Block 1, version %d", i)})
+		require.NoError(t, err)
+	}
+	snapshot := store.snapshot(0)
+	require.Len(t, snapshot.Revisions, snapshotRevisionLimit)
+	assert.Equal(t, uint64(2), snapshot.Revisions[0].Number)
+}
+
+func TestAPI_Revisions(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block 1"}}]`)
+	doRequest(t, r, "PATCH", "/documents/1/blocks/1", `{"Content":"Updated Block 1"}`)
+
+	response := doRequest(t, r, "GET", "/documents/1/revisions", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	var revisions []revisionResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&revisions))
+	require.Len(t, revisions, 2)
+	assert.Equal(t, "update block 1", revisions[1].Summary)
+
+	response = doRequest(t, r, "GET", "/documents/1/export?revision=1", "")
+	assert.Equal(t, "Block 1\n", response.Body.String())
+	response = doRequest(t, r, "GET", "/documents/1/blocks?blockIds=1&revision=1", "")
+	var blocks []blockResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&blocks))
+	require.Len(t, blocks, 1)
+	assert.Equal(t, "Block 1", blocks[0].Content)
+
+	response = doRequest(t, r, "GET", "/documents/1/export?revision=3", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = doRequest(t, r, "GET", "/documents/1/export?revision=latest", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
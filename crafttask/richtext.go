@@ -0,0 +1,201 @@
+package crafttask
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// textMarks are the formatting of a run of text, any number of them together
+type textMarks uint8
+
+const (
+	markBold textMarks = 1 << iota
+	markItalic
+	markStrikethrough
+	// code can't be combined with the other marks
+	markCode
+)
+
+// textMarkNames in the order marks are listed in
+var textMarkNames = []struct {
+	mark textMarks
+	name string
+}{
+	{markBold, "bold"},
+	{markItalic, "italic"},
+	{markStrikethrough, "strikethrough"},
+	{markCode, "code"},
+}
+
+// textRun is a part of a block's content formatted the same way throughout, linking to link when set
+type textRun struct {
+	text  string
+	marks textMarks
+	link  string
+}
+
+func (run textRun) formattedLike(other textRun) bool {
+	return run.marks == other.marks && run.link == other.link
+}
+
+// plainText is the text of the runs without their formatting
+func plainText(runs []textRun) string {
+	var builder strings.Builder
+	for _, run := range runs {
+		builder.WriteString(run.text)
+	}
+	return builder.String()
+}
+
+// normalizeRichText merges neighbouring runs formatted alike. Text without any formatting is nil, since the block's
+// content says it all.
+func normalizeRichText(runs []textRun) []textRun {
+	normalized := make([]textRun, 0, len(runs))
+	formatted := false
+	for _, run := range runs {
+		if run.text == "" {
+			continue
+		}
+		if len(normalized) > 0 && normalized[len(normalized)-1].formattedLike(run) {
+			normalized[len(normalized)-1].text += run.text
+			continue
+		}
+		normalized = append(normalized, run)
+		formatted = formatted || run.marks != 0 || run.link != ""
+	}
+	if !formatted {
+		return nil
+	}
+	return normalized
+}
+
+// richTextFromPayloads reads and validates the runs of a request, not normalized yet
+func richTextFromPayloads(payloads []textRunPayload) ([]textRun, error) {
+	runs := make([]textRun, 0, len(payloads))
+	for _, payload := range payloads {
+		if payload.Text == "" {
+			return nil, errEmptyTextRun
+		}
+		run := textRun{text: payload.Text, link: payload.Link}
+		for _, name := range payload.Marks {
+			mark, known := textMarkNamed(name)
+			if !known {
+				return nil, errUnknownTextMark
+			}
+			run.marks |= mark
+		}
+		if run.marks&markCode != 0 && (run.marks != markCode || strings.Contains(run.text, "\n")) {
+			return nil, errInvalidCodeMark
+		}
+		if run.link != "" && !validLink(run.link) {
+			return nil, errInvalidLink
+		}
+		runs = append(runs, run)
+	}
+	return runs, nil
+}
+
+func textMarkNamed(name string) (textMarks, bool) {
+	for _, markName := range textMarkNames {
+		if markName.name == name {
+			return markName.mark, true
+		}
+	}
+	return 0, false
+}
+
+// validLink tells whether the link is an absolute URL, without spaces so it can be written in any format as is,
+// or a link to a block
+func validLink(link string) bool {
+	if _, isBlockLink := linkedBlockId(link); isBlockLink {
+		return true
+	}
+	if strings.ContainsAny(link, " \t\r\n<>\"") {
+		return false
+	}
+	parsed, err := url.Parse(link)
+	return err == nil && parsed.Scheme != "" && (parsed.Host != "" || parsed.Opaque != "")
+}
+
+// blockLinkPrefix starts links to blocks of the same document, "#block-3" linking to block 3 like the ids of the
+// HTML export do
+const blockLinkPrefix = "#block-"
+
+func blockLink(blockId id) string {
+	return blockLinkPrefix + strconv.FormatUint(uint64(blockId), 10)
+}
+
+// linkedBlockId is the id of the block the link is to, if it is a link to a block. The block doesn't have to exist.
+func linkedBlockId(link string) (id, bool) {
+	if !strings.HasPrefix(link, blockLinkPrefix) {
+		return root, false
+	}
+	blockId, err := idFromString(strings.TrimPrefix(link, blockLinkPrefix))
+	if err != nil || blockId == root || blockLink(blockId) != link {
+		return root, false // not written the way blockLink writes it, e.g. with a leading zero
+	}
+	return blockId, true
+}
+
+func richTextToPayloads(runs []textRun) []textRunPayload {
+	if len(runs) == 0 {
+		return nil
+	}
+	toReturn := make([]textRunPayload, 0, len(runs))
+	for _, run := range runs {
+		payload := textRunPayload{Text: run.text, Link: run.link}
+		for _, markName := range textMarkNames {
+			if run.marks&markName.mark != 0 {
+				payload.Marks = append(payload.Marks, markName.name)
+			}
+		}
+		toReturn = append(toReturn, payload)
+	}
+	return toReturn
+}
+
+// blockContent is the content of a requested block and its runs, if it is formatted. With rich text, the content
+// is the rich text's plain text, which the request's content has to be if it has any.
+func blockContent(content string, richText []textRunPayload) (string, []textRun, error) {
+	if richText == nil {
+		return content, nil, nil
+	}
+	runs, err := richTextFromPayloads(richText)
+	if err != nil {
+		return "", nil, err
+	}
+	text := plainText(runs)
+	if content != "" && content != text {
+		return "", nil, errRichTextMismatch
+	}
+	return text, normalizeRichText(runs), nil
+}
+
+// runsOf is the block's content as runs, a single unformatted one when it has no rich text
+func runsOf(b block) []textRun {
+	if b.richText != nil {
+		return b.richText
+	}
+	if b.content == "" {
+		return nil
+	}
+	return []textRun{{text: b.content}}
+}
+
+// splitRunLines splits the runs into lines, so formatting can be written line by line in formats where it can't
+// span lines
+func splitRunLines(runs []textRun) [][]textRun {
+	lines := [][]textRun{{}}
+	for _, run := range runs {
+		for i, text := range strings.Split(run.text, "\n") {
+			if i > 0 {
+				lines = append(lines, []textRun{})
+			}
+			if text != "" {
+				lines[len(lines)-1] = append(lines[len(lines)-1], textRun{text: text, marks: run.marks, link: run.link})
+			}
+		}
+	}
+	return lines
+}
@@ -0,0 +1,195 @@
+package crafttask
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockContent(t *testing.T) {
+	content, runs, err := blockContent("", []textRunPayload{
+		{Text: "Read "}, {Text: "the ", Marks: []string{"bold"}}, {Text: "docs", Marks: []string{"bold"}},
+		{Text: " at "}, {Text: "example", Link: "https://example.com/docs?page=1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Read the docs at example", content)
+	assert.Equal(t, []textRun{
+		{text: "Read "}, {text: "the docs", marks: markBold}, {text: " at "}, {text: "example", link: "https://example.com/docs?page=1"},
+	}, runs, "runs formatted alike are merged")
+
+	content, runs, err = blockContent("plain", []textRunPayload{{Text: "pla"}, {Text: "in"}})
+	require.NoError(t, err)
+	assert.Equal(t, "plain", content)
+	assert.Nil(t, runs, "text without formatting has no rich text")
+
+	for expected, richText := range map[error][]textRunPayload{
+		errEmptyTextRun:     {{Text: ""}},
+		errUnknownTextMark:  {{Text: "a", Marks: []string{"underline"}}},
+		errInvalidCodeMark:  {{Text: "a", Marks: []string{"code", "bold"}}},
+		errInvalidLink:      {{Text: "a", Link: "example.com"}},
+		errRichTextMismatch: {{Text: "a", Marks: []string{"italic"}}},
+	} {
+		_, _, err := blockContent("b", richText)
+		assert.Equal(t, expected, err)
+	}
+	_, _, err = blockContent("", []textRunPayload{{Text: "a\nb", Marks: []string{"code"}}})
+	assert.Equal(t, errInvalidCodeMark, err)
+}
+
+func TestInMemoryStore_RichText(t *testing.T) {
+	store := NewInMemoryStore()
+	blocks, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{
+		RichText: []textRunPayload{{Text: "very", Marks: []string{"italic"}}, {Text: " important"}},
+	}}})
+	require.NoError(t, err)
+	assert.Equal(t, "very important", blocks[0].content)
+	assert.Equal(t, []textRun{{text: "very", marks: markItalic}, {text: " important"}}, blocks[0].richText)
+
+	updated, err := store.UpdateBlock(1, updatePayload{Content: "not important", RichText: []textRunPayload{
+		{Text: "not", Marks: []string{"strikethrough"}}, {Text: " important"},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, []textRun{{text: "not", marks: markStrikethrough}, {text: " important"}}, updated.richText)
+
+	updated, err = store.UpdateBlock(1, updatePayload{Content: "plain again"})
+	require.NoError(t, err)
+	assert.Nil(t, updated.richText)
+
+	_, err = store.UpdateBlock(1, updatePayload{
+		blockTypeFields: blockTypeFields{Type: blockTypeCode},
+		RichText:        []textRunPayload{{Text: "x", Marks: []string{"bold"}}},
+	})
+	assert.Equal(t, errFormattedCode, err)
+
+	require.NoError(t, store.Undo())
+	blocks = store.FetchBlocks([]id{1})
+	assert.Equal(t, []textRun{{text: "not", marks: markStrikethrough}, {text: " important"}}, blocks[0].richText)
+}
+
+func TestInMemoryStore_ExportRichText(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{RichText: []textRunPayload{
+			{Text: "Run "}, {Text: "go test ", Marks: []string{"code"}}, {Text: "or "},
+			{Text: "read the docs", Marks: []string{"bold", "italic"}, Link: "https://go.dev/doc/(tests)"},
+			{Text: "*", Marks: []string{"bold"}}, {Text: " `x`", Marks: []string{"code"}}, {Text: "old", Marks: []string{"strikethrough", "bold"}},
+		}, Subblocks: []blockRequest{
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo}, RichText: []textRunPayload{
+				{Text: "two\nlines", Marks: []string{"italic"}}, {Text: "\n1. still text"},
+			}},
+		}}},
+	})
+	require.NoError(t, err)
+
+	exporter, err := newMarkdownExporter(url.Values{})
+	require.NoError(t, err)
+	assert.Equal(t, "- Run `go test `or [***read the docs***](https://go.dev/doc/\\(tests\\))**\\***``  `x` ``~~**old**~~\n"+
+		"  - [ ] *two*\n    *lines*\n    1\\. still text\n", store.ExportWith(exporter))
+
+	exporter, err = newMarkdownExporter(url.Values{"headingDepth": {"2"}})
+	require.NoError(t, err)
+	assert.Contains(t, store.ExportWith(exporter), "## *two* *lines* 1\\. still text\n")
+
+	assert.Equal(t, "Run go test or read the docs* `x`old\n  [ ] two\\nlines\\n1. still text\n", store.Export())
+	assert.Contains(t, store.ExportWith(&jsonExporter{}), `"RichText":[{"Text":"Run "},{"Text":"go test ","Marks":["code"]},`)
+}
+
+func TestImportRichTextRoundTrip(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{RichText: []textRunPayload{
+			{Text: "Run "}, {Text: "go test ", Marks: []string{"code"}}, {Text: "or "},
+			{Text: "read the docs", Marks: []string{"bold", "italic"}, Link: "https://go.dev/doc/(tests)"},
+			{Text: "*", Marks: []string{"bold"}}, {Text: " `x`", Marks: []string{"code"}}, {Text: "old", Marks: []string{"strikethrough", "bold"}},
+		}, Subblocks: []blockRequest{
+			{blockTypeFields: blockTypeFields{Type: blockTypeTodo}, RichText: []textRunPayload{
+				{Text: "two\nlines", Marks: []string{"italic"}}, {Text: "\n1. still text"},
+			}},
+		}}},
+	})
+	require.NoError(t, err)
+	markdownExporter := func() exporter {
+		exporter, err := newMarkdownExporter(url.Values{})
+		require.NoError(t, err)
+		return exporter
+	}
+	for name, format := range map[string]struct {
+		newExporter func() exporter
+		importer    importer
+	}{
+		"markdown": {markdownExporter, importMarkdown},
+		"json":     {func() exporter { return &jsonExporter{} }, importJson},
+	} {
+		t.Run(name, func(t *testing.T) {
+			blocks, err := format.importer(store.ExportWith(format.newExporter()))
+			require.NoError(t, err)
+			imported := NewInMemoryStore()
+			_, err = imported.InsertBlocks(insertOperationsAt(root, 0, blocks))
+			require.NoError(t, err)
+			assert.Equal(t, store.ExportWith(&jsonExporter{}), imported.ExportWith(&jsonExporter{}))
+		})
+	}
+}
+
+func TestParseMarkdownInline(t *testing.T) {
+	content, runs := parseMarkdownInline(`a * b **unclosed [not a link] \*escaped\*`)
+	assert.Equal(t, "a * b **unclosed [not a link] *escaped*", content)
+	assert.Nil(t, runs)
+
+	content, runs = parseMarkdownInline("[intro](#intro)")
+	assert.Equal(t, "[intro](#intro)", content, "links rich text can't have are text")
+	assert.Nil(t, runs)
+
+	content, runs = parseMarkdownInline("**bold** then *italic*, ~~gone~~ and [link](https://example.com)")
+	assert.Equal(t, "bold then italic, gone and link", content)
+	assert.Equal(t, []textRun{
+		{text: "bold", marks: markBold}, {text: " then "}, {text: "italic", marks: markItalic}, {text: ", "},
+		{text: "gone", marks: markStrikethrough}, {text: " and "}, {text: "link", link: "https://example.com"},
+	}, runs)
+}
+
+func TestAPI_RichText(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+
+	response := doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"RichText":[{"Text":"Hello","Marks":["bold"]},{"Text":" world"}]}}]`)
+	require.Equal(t, http.StatusCreated, response.Code)
+	assert.JSONEq(t, `[{"Id":1,"Type":"paragraph","Content":"Hello world","RichText":[{"Text":"Hello","Marks":["bold"]},{"Text":" world"}],"Subblocks":[]}]`, response.Body.String())
+
+	response = doRequest(t, r, "PATCH", "/documents/1/blocks/1", `{"RichText":[{"Text":"Hello","Marks":["italic"]},{"Text":" world"}]}`)
+	require.Equal(t, http.StatusOK, response.Code)
+	response = doRequest(t, r, "PATCH", "/documents/1/blocks/1", `{"RichText":[{"Text":"Hello","Link":"not a link"}]}`)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Hi","RichText":[{"Text":"Hello","Marks":["bold"]}]}}]`)
+	require.Equal(t, http.StatusBadRequest, response.Code)
+	var results []operationResult
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&results))
+	assert.Equal(t, "invalid_rich_text", results[0].ErrorCode)
+
+	response = doRequest(t, r, "GET", "/documents/1/diff?from=1&to=2", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"Change":"content_changed","BlockId":1,"OldContent":"Hello world","NewContent":"Hello world",`+
+		`"OldRichText":[{"Text":"Hello","Marks":["bold"]},{"Text":" world"}],"NewRichText":[{"Text":"Hello","Marks":["italic"]},{"Text":" world"}]`)
+}
+
+func TestFileStore_KeepsRichText(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 1})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{
+		RichText: []textRunPayload{{Text: "see", Link: "mailto:ana@example.com"}, {Text: " this"}},
+	}}})
+	require.NoError(t, err)
+	expectedExport := store.ExportWith(&jsonExporter{})
+	require.NoError(t, store.Close())
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 1})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, expectedExport, reopened.ExportWith(&jsonExporter{}))
+}
@@ -0,0 +1,361 @@
+package crafttask
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	// BM25's parameters: how quickly more occurrences of a term stop counting, and how much longer blocks count less
+	searchTermSaturation = 1.2
+	searchLengthWeight   = 0.75
+	// how many snippets a hit has at most, and how much of the content they show around a match, in bytes
+	maxSnippets    = 3
+	snippetContext = 30
+)
+
+// token is a word of a block's content: its term, the word lowercased, and where it is in the content, in bytes
+type token struct {
+	term       string
+	start, end int
+}
+
+// tokenize splits the text into its words, runs of letters and digits
+func tokenize(text string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range text {
+		isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordRune && start < 0 {
+			start = i
+		} else if !isWordRune && start >= 0 {
+			tokens = append(tokens, token{term: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, token{term: strings.ToLower(text[start:]), start: start, end: len(text)})
+	}
+	return tokens
+}
+
+// searchIndex is an inverted index of the content of the blocks: for every term, the blocks it's in and where.
+// The mutations keep it up to date, like the backlinks.
+type searchIndex struct {
+	// postings has the positions of the term in every block that has it, counted in tokens and in order
+	postings map[string]map[id][]int
+	// lengths is how many tokens every block with content has
+	lengths     map[id]int
+	totalLength int
+}
+
+func newSearchIndex() searchIndex {
+	return searchIndex{
+		postings: make(map[string]map[id][]int),
+		lengths:  make(map[id]int),
+	}
+}
+
+func (index *searchIndex) add(b block) {
+	tokens := tokenize(b.content)
+	if len(tokens) == 0 {
+		return
+	}
+	for position, token := range tokens {
+		if index.postings[token.term] == nil {
+			index.postings[token.term] = make(map[id][]int)
+		}
+		index.postings[token.term][b.id] = append(index.postings[token.term][b.id], position)
+	}
+	index.lengths[b.id] = len(tokens)
+	index.totalLength += len(tokens)
+}
+
+func (index *searchIndex) remove(b block) {
+	tokens := tokenize(b.content)
+	if len(tokens) == 0 {
+		return
+	}
+	for _, token := range tokens {
+		delete(index.postings[token.term], b.id)
+		if len(index.postings[token.term]) == 0 {
+			delete(index.postings, token.term)
+		}
+	}
+	delete(index.lengths, b.id)
+	index.totalLength -= len(tokens)
+}
+
+func (index *searchIndex) addSubtree(subtree block) {
+	index.add(subtree)
+	for _, subblock := range subtree.subblocks.OrderedValues() {
+		index.addSubtree(subblock)
+	}
+}
+
+func (index *searchIndex) removeSubtree(subtree block) {
+	index.remove(subtree)
+	for _, subblock := range subtree.subblocks.OrderedValues() {
+		index.removeSubtree(subblock)
+	}
+}
+
+// searchClause is a part of a query the blocks found have to match: a word, or a phrase of words right after each
+// other. With prefix, the last word only has to start the word it matches.
+type searchClause struct {
+	terms  []string
+	prefix bool
+}
+
+// parseSearchQuery reads the clauses of the query: the words, and the phrases in double quotes. Words ending in an
+// asterisk are prefixes, and so is a phrase's last word. Words are split the way the content is, so "built-in" is
+// the phrase "built in".
+func parseSearchQuery(query string) ([]searchClause, error) {
+	var clauses []searchClause
+	addClause := func(text string) {
+		tokens := tokenize(text)
+		if len(tokens) == 0 {
+			return
+		}
+		clause := searchClause{prefix: strings.HasSuffix(text, "*") && tokens[len(tokens)-1].end == len(text)-1}
+		for _, token := range tokens {
+			clause.terms = append(clause.terms, token.term)
+		}
+		clauses = append(clauses, clause)
+	}
+	for query != "" {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		if strings.HasPrefix(query, `"`) {
+			end := strings.Index(query[1:], `"`)
+			if end < 0 {
+				return nil, errUnclosedSearchPhrase
+			}
+			addClause(query[1 : end+1])
+			query = query[end+2:]
+			continue
+		}
+		end := strings.IndexFunc(query, func(r rune) bool { return unicode.IsSpace(r) || r == '"' })
+		if end < 0 {
+			end = len(query)
+		}
+		addClause(query[:end])
+		query = query[end:]
+	}
+	if len(clauses) == 0 {
+		return nil, errEmptySearchQuery
+	}
+	return clauses, nil
+}
+
+// matches finds where the clause matches: for every block it matches in, the positions its matches start at
+func (index *searchIndex) matches(clause searchClause) map[id][]int {
+	positions := make([]map[id][]int, len(clause.terms))
+	for i, term := range clause.terms {
+		if clause.prefix && i == len(clause.terms)-1 {
+			positions[i] = index.prefixPostings(term)
+		} else {
+			positions[i] = index.postings[term]
+		}
+		if len(positions[i]) == 0 {
+			return nil
+		}
+	}
+	toReturn := make(map[id][]int)
+	for blockId, starts := range positions[0] {
+		for _, start := range starts {
+			if phraseAt(positions, blockId, start) {
+				toReturn[blockId] = append(toReturn[blockId], start)
+			}
+		}
+	}
+	return toReturn
+}
+
+// phraseAt tells whether every term of the phrase is in the block right after the one before, from start on
+func phraseAt(positions []map[id][]int, blockId id, start int) bool {
+	for i := 1; i < len(positions); i++ {
+		termPositions := positions[i][blockId]
+		at := sort.SearchInts(termPositions, start+i)
+		if at == len(termPositions) || termPositions[at] != start+i {
+			return false
+		}
+	}
+	return true
+}
+
+// prefixPostings merges the postings of every term starting with the prefix. It goes through all the terms,
+// which is quick enough for a document.
+func (index *searchIndex) prefixPostings(prefix string) map[id][]int {
+	merged := make(map[id][]int)
+	for term, postings := range index.postings {
+		if !strings.HasPrefix(term, prefix) {
+			continue
+		}
+		for blockId, positions := range postings {
+			merged[blockId] = append(merged[blockId], positions...)
+		}
+	}
+	for _, positions := range merged {
+		sort.Ints(positions)
+	}
+	return merged
+}
+
+// score is how relevant a block is for a clause it matches matchCount times, by BM25, given that the clause matches
+// in blockCount blocks
+func (index *searchIndex) score(blockId id, matchCount, blockCount int) float64 {
+	indexed := float64(len(index.lengths))
+	idf := math.Log(1 + (indexed-float64(blockCount)+0.5)/(float64(blockCount)+0.5))
+	averageLength := float64(index.totalLength) / indexed
+	lengthNorm := 1 - searchLengthWeight + searchLengthWeight*float64(index.lengths[blockId])/averageLength
+	tf := float64(matchCount)
+	return idf * tf * (searchTermSaturation + 1) / (tf + searchTermSaturation*lengthNorm)
+}
+
+// searchHit is a block the search found, with how relevant it is, snippets of its content with the matches
+// highlighted, and its ancestors, the top level one first
+type searchHit struct {
+	block    block
+	score    float64
+	snippets [][]snippetPart
+	path     []block
+}
+
+// snippetPart is a piece of a snippet, highlighted when it's a match
+type snippetPart struct {
+	text        string
+	highlighted bool
+}
+
+// Search finds the blocks whose content matches every clause of the query, the most relevant first, up to limit of
+// them. Blocks are relevant when their matches are rare in the document, many, and in little other content.
+// References aren't found by the content they show, their targets are.
+func (st *InMemoryStore) Search(query string, limit int) ([]searchHit, error) {
+	clauses, err := parseSearchQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	scores := make(map[id]float64)
+	// the token spans of the matches, to highlight
+	matchedSpans := make(map[id][][2]int)
+	for i, clause := range clauses {
+		matches := st.searchIndex.matches(clause)
+		clauseScores := make(map[id]float64)
+		for blockId, starts := range matches {
+			if _, stillMatching := scores[blockId]; i > 0 && !stillMatching {
+				continue
+			}
+			clauseScores[blockId] = scores[blockId] + st.searchIndex.score(blockId, len(starts), len(matches))
+			for _, start := range starts {
+				matchedSpans[blockId] = append(matchedSpans[blockId], [2]int{start, start + len(clause.terms) - 1})
+			}
+		}
+		scores = clauseScores
+	}
+
+	hitIds := make([]id, 0, len(scores))
+	for blockId := range scores {
+		hitIds = append(hitIds, blockId)
+	}
+	sort.Slice(hitIds, func(i, j int) bool {
+		if scores[hitIds[i]] != scores[hitIds[j]] {
+			return scores[hitIds[i]] > scores[hitIds[j]]
+		}
+		return hitIds[i] < hitIds[j]
+	})
+	if len(hitIds) > limit {
+		hitIds = hitIds[:limit]
+	}
+	hits := make([]searchHit, 0, len(hitIds))
+	for _, blockId := range hitIds {
+		hit := searchHit{block: st.handedOutFields(blockId), score: scores[blockId], path: st.breadcrumbs(blockId)}
+		hit.snippets = snippets(hit.block.content, matchedSpans[blockId])
+		hits = append(hits, hit)
+	}
+	return hits, nil
+}
+
+// snippets cuts the parts of the content around the matches out, with the matches highlighted. spans are the first
+// and the last token of every match.
+func snippets(content string, spans [][2]int) [][]snippetPart {
+	tokens := tokenize(content)
+	highlights := make([][2]int, 0, len(spans))
+	for _, span := range spans {
+		highlights = append(highlights, [2]int{tokens[span[0]].start, tokens[span[1]].end})
+	}
+	sort.Slice(highlights, func(i, j int) bool { return highlights[i][0] < highlights[j][0] })
+
+	var toReturn [][]snippetPart
+	for i := 0; i < len(highlights) && len(toReturn) < maxSnippets; {
+		start := snippetStart(content, highlights[i][0])
+		end := snippetEnd(content, highlights[i][1])
+		var parts []snippetPart
+		if start > 0 {
+			parts = append(parts, snippetPart{text: "…"})
+		}
+		at := start
+		// the matches the snippet shows, including the ones in the context of the earlier ones
+		for ; i < len(highlights) && highlights[i][0] < end; i++ {
+			if highlights[i][0] < at {
+				continue // overlaps with the match before, e.g. a phrase and a word of it
+			}
+			parts = append(parts, snippetPart{text: content[at:highlights[i][0]]})
+			parts = append(parts, snippetPart{text: content[highlights[i][0]:highlights[i][1]], highlighted: true})
+			at = highlights[i][1]
+			if extended := snippetEnd(content, at); extended > end {
+				end = extended
+			}
+		}
+		parts = append(parts, snippetPart{text: content[at:end]})
+		if end < len(content) {
+			parts = append(parts, snippetPart{text: "…"})
+		}
+		toReturn = append(toReturn, withoutEmptyParts(parts))
+	}
+	return toReturn
+}
+
+// snippetStart is where a snippet showing a match starting at matchStart starts: about snippetContext bytes before,
+// at the start of a word
+func snippetStart(content string, matchStart int) int {
+	if matchStart <= snippetContext {
+		return 0
+	}
+	space := strings.IndexFunc(content[matchStart-snippetContext:matchStart], unicode.IsSpace)
+	if space < 0 {
+		return matchStart
+	}
+	start := matchStart - snippetContext + space
+	_, size := utf8.DecodeRuneInString(content[start:])
+	return start + size
+}
+
+// snippetEnd is where a snippet showing a match ending at matchEnd ends: about snippetContext bytes after,
+// at the end of a word
+func snippetEnd(content string, matchEnd int) int {
+	if len(content)-matchEnd <= snippetContext {
+		return len(content)
+	}
+	space := strings.LastIndexFunc(content[matchEnd:matchEnd+snippetContext], unicode.IsSpace)
+	if space < 0 {
+		return matchEnd
+	}
+	return matchEnd + space
+}
+
+func withoutEmptyParts(parts []snippetPart) []snippetPart {
+	kept := parts[:0]
+	for _, part := range parts {
+		if part.text != "" {
+			kept = append(kept, part)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,181 @@
+package crafttask
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func hitIds(t *testing.T, store Store, query string) []id {
+	t.Helper()
+	hits, err := store.Search(query, defaultSearchLimit)
+	require.NoError(t, err)
+	ids := make([]id, 0, len(hits))
+	for _, hit := range hits {
+		ids = append(ids, hit.block.id)
+	}
+	return ids
+}
+
+func TestTokenize(t *testing.T) {
+	assert.Equal(t, []token{{"built", 0, 5}, {"in", 6, 8}, {"café", 10, 15}, {"2", 17, 18}},
+		tokenize("Built-in, Café! 2"))
+	assert.Empty(t, tokenize(" -- "))
+}
+
+func TestParseSearchQuery(t *testing.T) {
+	clauses, err := parseSearchQuery(`Search  "the  Index" build* built-in"quoted"`)
+	require.NoError(t, err)
+	assert.Equal(t, []searchClause{
+		{terms: []string{"search"}},
+		{terms: []string{"the", "index"}},
+		{terms: []string{"build"}, prefix: true},
+		{terms: []string{"built", "in"}},
+		{terms: []string{"quoted"}},
+	}, clauses)
+
+	_, err = parseSearchQuery(` * "" `)
+	assert.Equal(t, errEmptySearchQuery, err)
+	_, err = parseSearchQuery(`"the index`)
+	assert.Equal(t, errUnclosedSearchPhrase, err)
+}
+
+func TestInMemoryStore_Search(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks(insertOperationsAt(root, 0, []blockRequest{
+		{Content: "Search", Subblocks: []blockRequest{
+			{Content: "The search index is updated as blocks change"},
+			{Content: "Searching walks the index"},
+			{Content: "An index of an index"},
+		}},
+		{Content: "Unrelated notes"},
+	}))
+	require.NoError(t, err)
+
+	assert.Equal(t, []id{4, 3, 2}, hitIds(t, store, "index"), "4 has the word twice, and 3 is shorter than 2")
+	assert.Equal(t, []id{1, 3, 2}, hitIds(t, store, "search*"))
+	assert.Equal(t, []id{3, 2}, hitIds(t, store, "INDEX search*"))
+	assert.Equal(t, []id{2}, hitIds(t, store, `"search index"`))
+	assert.Empty(t, hitIds(t, store, `"index search"`))
+	assert.Empty(t, hitIds(t, store, "index unrelated"))
+
+	hits, err := store.Search("index", 2)
+	require.NoError(t, err)
+	require.Len(t, hits, 2)
+	assert.Greater(t, hits[0].score, hits[1].score)
+	assert.Equal(t, "An index of an index", hits[0].block.content)
+	assert.Equal(t, [][]snippetPart{{{text: "An "}, {text: "index", highlighted: true}, {text: " of an "}, {text: "index", highlighted: true}}},
+		hits[0].snippets)
+	require.Len(t, hits[0].path, 1)
+	assert.Equal(t, "Search", hits[0].path[0].content)
+}
+
+func TestInMemoryStore_SearchFollowsChanges(t *testing.T) {
+	store := NewInMemoryStore()
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{
+			{Content: "Child Block 2", Subblocks: []blockRequest{{Content: "Grandchild Block 3"}}},
+			{Content: "Child Block 4"},
+		}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 5", Subblocks: []blockRequest{{Content: "Child Block 6"}}}},
+	})
+	require.NoError(t, err)
+	_, err = store.UpdateBlock(4, updatePayload{Content: "Renamed"})
+	require.NoError(t, err)
+	assert.Equal(t, []id{4}, hitIds(t, store, "renamed"))
+	assert.Equal(t, []id{2, 6}, hitIds(t, store, "child"))
+	assertConsistent(t, store)
+
+	_, err = store.DuplicateBlock(1)
+	require.NoError(t, err)
+	assert.Equal(t, []id{4, 10}, hitIds(t, store, "renamed"))
+	assertConsistent(t, store)
+
+	require.NoError(t, store.DeleteBlocks([]id{1}))
+	assert.Equal(t, []id{10}, hitIds(t, store, "renamed"), "blocks in the trash aren't found")
+	assertConsistent(t, store)
+
+	require.NoError(t, store.Undo())
+	require.NoError(t, store.Undo())
+	require.NoError(t, store.Undo())
+	assert.Equal(t, []id{2, 4, 6}, hitIds(t, store, "child"))
+	assert.Empty(t, hitIds(t, store, "renamed"))
+	assertConsistent(t, store)
+
+	require.NoError(t, store.Redo())
+	assert.Equal(t, []id{4}, hitIds(t, store, "renamed"))
+	_, err = store.UpdateBlock(4, updatePayload{RichText: []textRunPayload{{Text: "Rich", Marks: []string{"bold"}}, {Text: " text"}}})
+	require.NoError(t, err)
+	assert.Equal(t, []id{4}, hitIds(t, store, `"rich text"`))
+	assertConsistent(t, store)
+}
+
+func TestSnippets(t *testing.T) {
+	content := "The index is built as the blocks change, so searching never walks the whole tree of the document again"
+	tokens := tokenize(content)
+	at := func(term string) [2]int {
+		for i, token := range tokens {
+			if token.term == term {
+				return [2]int{i, i}
+			}
+		}
+		panic(term)
+	}
+	assert.Equal(t, [][]snippetPart{
+		{{text: "The "}, {text: "index", highlighted: true}, {text: " is built as the "}, {text: "blocks", highlighted: true},
+			{text: " change, so searching never"}, {text: "…"}},
+		{{text: "…"}, {text: "walks the whole tree of the "}, {text: "document", highlighted: true}, {text: " again"}},
+	}, snippets(content, [][2]int{at("blocks"), at("document"), at("index")}))
+
+	phrase := [2]int{at("whole")[0], at("tree")[0]}
+	assert.Equal(t, [][]snippetPart{
+		{{text: "…"}, {text: "so searching never walks the "}, {text: "whole tree", highlighted: true},
+			{text: " of the document again"}},
+	}, snippets(content, [][2]int{phrase, at("tree")}), "words of a phrase aren't highlighted again")
+}
+
+func TestFileStore_RebuildsSearchIndex(t *testing.T) {
+	for name, options := range map[string]FileStoreOptions{"replayed": {}, "from a snapshot": {SnapshotEvery: 1}} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			store, err := NewFileStore(dir, options)
+			require.NoError(t, err)
+			_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Searchable"}}})
+			require.NoError(t, err)
+			_, err = store.UpdateBlock(1, updatePayload{Content: "Still searchable"})
+			require.NoError(t, err)
+			require.NoError(t, store.Close())
+
+			reopened, err := NewFileStore(dir, options)
+			require.NoError(t, err)
+			defer reopened.Close()
+			assert.Equal(t, []id{1}, hitIds(t, reopened, "still search*"))
+		})
+	}
+}
+
+func TestAPI_Search(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Recipes",`+
+		`"Subblocks":[{"Content":"Bread takes flour and water"},{"Content":"Pancakes"}]}}]`)
+
+	response := doRequest(t, r, "GET", "/documents/1/search?q=flour", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"Id":2,"Type":"paragraph","Content":"Bread takes flour and water"`)
+	assert.Contains(t, response.Body.String(), `"Snippets":[[{"Text":"Bread takes "},{"Text":"flour","Highlighted":true},{"Text":" and water"}]],`+
+		`"Path":[{"Id":1,"Content":"Recipes"}]`)
+
+	response = doRequest(t, r, "GET", "/documents/1/search?q=%22flour+water%22", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	assert.JSONEq(t, `[]`, response.Body.String())
+
+	response = doRequest(t, r, "GET", "/documents/1/search?q=", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doRequest(t, r, "GET", "/documents/1/search?q=bread&limit=0", "")
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	response = doRequest(t, r, "GET", "/documents/2/search?q=bread", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
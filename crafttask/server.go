@@ -3,11 +3,29 @@ package crafttask
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
 
+const (
+	serverReadHeaderTimeout = 10 * time.Second
+	// serverWriteTimeout cuts off clients that stall reading a response, e.g. a large export, so they don't hold on
+	// to the connection for good; it's generous since it covers writing the whole response
+	serverWriteTimeout = 5 * time.Minute
+)
+
+// NewHTTPServer serves the handler on the address, with timeouts for clients that are too slow
+func NewHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		WriteTimeout:      serverWriteTimeout,
+	}
+}
+
 type Server struct {
 	api API
 }
@@ -16,20 +34,14 @@ func NewServer(api API) Server {
 	return Server{api: api}
 }
 
-// these all should be prefixed for the document, but since there is only one, there is no need now (most apparent on the export)
 func (s Server) Run() error {
 	r := mux.NewRouter()
 
-	r.HandleFunc("/blocks/bulk-insert", s.api.InsertBlocks).Methods("POST")
-	r.HandleFunc("/blocks", s.api.DeleteBlocks).Methods("DELETE")
-	r.HandleFunc("/blocks", s.api.FetchBlocksByID).Methods("GET")
-	r.HandleFunc("/blocks/{id}/duplicate", s.api.DuplicateBlock).Methods("POST")
-	r.HandleFunc("/blocks/{id}/move", s.api.MoveBlock).Methods("POST")
-	r.HandleFunc("/export", s.api.ExportDocument).Methods("GET")
+	s.api.RegisterRoutes(r)
 
 	handler := cors.AllowAll().Handler(r)
 	http.Handle("/", handler)
 
 	fmt.Println("Server listening on :8080")
-	return http.ListenAndServe(":8080", nil)
+	return NewHTTPServer(":8080", nil).ListenAndServe()
 }
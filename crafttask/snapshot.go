@@ -0,0 +1,384 @@
+package crafttask
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	snapshotFilePrefix = "snapshot-"
+	snapshotFileSuffix = ".snap"
+	// an older snapshot (and the log after it) is kept around in case the newest one turns out to be corrupt
+	snapshotsToKeep = 2
+)
+
+var errCorruptSnapshot = errors.New("corrupt snapshot")
+
+type persistedBlock struct {
+	Id id
+	blockTypeFields
+	Content    string
+	RichText   []textRunPayload           `json:",omitempty"`
+	Properties map[string]propertyPayload `json:",omitempty"`
+	Subblocks  []persistedBlock           `json:",omitempty"`
+}
+
+type persistedMutation struct {
+	Kind        mutationKind
+	BlockId     id
+	Block       persistedBlock
+	Previous    persistedBlock
+	ParentId    id
+	Index       int
+	OldParentId id
+	OldIndex    int
+	CopiedFrom  map[id]id  `json:",omitempty"`
+	DeletedAt   *time.Time `json:",omitempty"`
+}
+
+type persistedTransaction struct {
+	Summary   string
+	Mutations []persistedMutation
+}
+
+type persistedTrashedBlock struct {
+	Block     persistedBlock
+	ParentId  id
+	Index     int
+	DeletedAt time.Time
+}
+
+type persistedRevision struct {
+	Number      uint64
+	Timestamp   time.Time
+	Transaction persistedTransaction
+}
+
+// documentSnapshot is the whole document as of the log record with the given sequence number.
+// It holds the undo history, the trash and the newest revisions too (see snapshotRevisionLimit), so they work the
+// same after a restart as before it.
+type documentSnapshot struct {
+	Sequence  uint64
+	LastId    id
+	Blocks    []persistedBlock
+	UndoStack []persistedTransaction `json:",omitempty"`
+	RedoStack []persistedTransaction `json:",omitempty"`
+	Revision  uint64
+	Revisions []persistedRevision     `json:",omitempty"`
+	Trash     []persistedTrashedBlock `json:",omitempty"`
+}
+
+func (st *InMemoryStore) snapshot(sequence uint64) documentSnapshot {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	return documentSnapshot{
+		Sequence:  sequence,
+		LastId:    st.idGenerator.lastId(),
+		Blocks:    blocksToPersisted(st.document.blocks.OrderedValues()),
+		UndoStack: transactionsToPersisted(st.history.undoStack),
+		RedoStack: transactionsToPersisted(st.history.redoStack),
+		Revision:  st.revisions.current,
+		Revisions: revisionsToPersisted(newestRevisions(st.revisions.log, snapshotRevisionLimit)),
+		Trash:     trashToPersisted(st.trash),
+	}
+}
+
+func newestRevisions(log []revision, limit int) []revision {
+	if len(log) > limit {
+		return log[len(log)-limit:]
+	}
+	return log
+}
+
+func blocksToPersisted(blocks []block) []persistedBlock {
+	toReturn := make([]persistedBlock, 0, len(blocks))
+	for _, block := range blocks {
+		toReturn = append(toReturn, blockToPersisted(block))
+	}
+	return toReturn
+}
+
+func blockToPersisted(blockToPersist block) persistedBlock {
+	persisted := persistedBlock{
+		Id:              blockToPersist.id,
+		blockTypeFields: typeFieldsOf(blockToPersist),
+		Content:         blockToPersist.content,
+		RichText:        richTextToPayloads(blockToPersist.richText),
+		Properties:      propertiesToPayloads(blockToPersist.properties),
+	}
+	if blockToPersist.subblocks != nil { // blocks recorded for updates only carry their fields
+		persisted.Subblocks = blocksToPersisted(blockToPersist.subblocks.OrderedValues())
+	}
+	return persisted
+}
+
+func blockFromPersisted(persisted persistedBlock) block {
+	properties, _ := propertiesFromPayloads(persisted.Properties) // persisted properties were valid when they were set
+	richText, _ := richTextFromPayloads(persisted.RichText)       // persisted rich text was valid and normalized too
+	restoredBlock := persisted.blockTypeFields.applyTo(block{
+		id:         persisted.Id,
+		content:    persisted.Content,
+		richText:   normalizeRichText(richText),
+		properties: properties,
+		subblocks:  NewOrderedMapOfBlocks(),
+	})
+	for _, persistedSubblock := range persisted.Subblocks {
+		restoredBlock.subblocks.Set(persistedSubblock.Id, blockFromPersisted(persistedSubblock))
+	}
+	return restoredBlock
+}
+
+func transactionsToPersisted(transactions []transaction) []persistedTransaction {
+	toReturn := make([]persistedTransaction, 0, len(transactions))
+	for _, tx := range transactions {
+		toReturn = append(toReturn, transactionToPersisted(tx))
+	}
+	return toReturn
+}
+
+func transactionToPersisted(tx transaction) persistedTransaction {
+	persisted := persistedTransaction{
+		Summary:   tx.summary,
+		Mutations: make([]persistedMutation, 0, len(tx.mutations)),
+	}
+	for _, m := range tx.mutations {
+		var deletedAt *time.Time
+		if !m.deletedAt.IsZero() {
+			deletedAt = &m.deletedAt
+		}
+		persisted.Mutations = append(persisted.Mutations, persistedMutation{
+			Kind:        m.kind,
+			BlockId:     m.blockId,
+			Block:       blockToPersisted(m.block),
+			Previous:    blockToPersisted(m.previous),
+			ParentId:    m.parentId,
+			Index:       m.index,
+			OldParentId: m.oldParentId,
+			OldIndex:    m.oldIndex,
+			CopiedFrom:  m.copiedFrom,
+			DeletedAt:   deletedAt,
+		})
+	}
+	return persisted
+}
+
+func transactionsFromPersisted(persistedTransactions []persistedTransaction) []transaction {
+	toReturn := make([]transaction, 0, len(persistedTransactions))
+	for _, persisted := range persistedTransactions {
+		toReturn = append(toReturn, transactionFromPersisted(persisted))
+	}
+	return toReturn
+}
+
+func transactionFromPersisted(persisted persistedTransaction) transaction {
+	tx := transaction{summary: persisted.Summary}
+	for _, persistedMutation := range persisted.Mutations {
+		var deletedAt time.Time
+		if persistedMutation.DeletedAt != nil {
+			deletedAt = *persistedMutation.DeletedAt
+		}
+		tx.mutations = append(tx.mutations, mutation{
+			kind:        persistedMutation.Kind,
+			blockId:     persistedMutation.BlockId,
+			block:       blockFromPersisted(persistedMutation.Block),
+			previous:    blockFromPersisted(persistedMutation.Previous),
+			parentId:    persistedMutation.ParentId,
+			index:       persistedMutation.Index,
+			oldParentId: persistedMutation.OldParentId,
+			oldIndex:    persistedMutation.OldIndex,
+			copiedFrom:  persistedMutation.CopiedFrom,
+			deletedAt:   deletedAt,
+		})
+	}
+	return tx
+}
+
+func trashToPersisted(trash []trashedBlock) []persistedTrashedBlock {
+	toReturn := make([]persistedTrashedBlock, 0, len(trash))
+	for _, trashed := range trash {
+		toReturn = append(toReturn, persistedTrashedBlock{
+			Block:     blockToPersisted(trashed.block),
+			ParentId:  trashed.parentId,
+			Index:     trashed.index,
+			DeletedAt: trashed.deletedAt,
+		})
+	}
+	return toReturn
+}
+
+func trashFromPersisted(persistedTrash []persistedTrashedBlock) []trashedBlock {
+	toReturn := make([]trashedBlock, 0, len(persistedTrash))
+	for _, persisted := range persistedTrash {
+		toReturn = append(toReturn, trashedBlock{
+			block:     blockFromPersisted(persisted.Block),
+			parentId:  persisted.ParentId,
+			index:     persisted.Index,
+			deletedAt: persisted.DeletedAt,
+		})
+	}
+	return toReturn
+}
+
+func revisionsToPersisted(revisions []revision) []persistedRevision {
+	toReturn := make([]persistedRevision, 0, len(revisions))
+	for _, revision := range revisions {
+		toReturn = append(toReturn, persistedRevision{
+			Number:      revision.number,
+			Timestamp:   revision.timestamp,
+			Transaction: transactionToPersisted(revision.tx),
+		})
+	}
+	return toReturn
+}
+
+func revisionsFromPersisted(persistedRevisions []persistedRevision) []revision {
+	toReturn := make([]revision, 0, len(persistedRevisions))
+	for _, persisted := range persistedRevisions {
+		toReturn = append(toReturn, revision{
+			number:    persisted.Number,
+			timestamp: persisted.Timestamp,
+			summary:   persisted.Transaction.Summary,
+			tx:        transactionFromPersisted(persisted.Transaction),
+		})
+	}
+	return toReturn
+}
+
+// restoreSnapshot replaces the whole document, parents cache, backlinks, search index and history included, with the snapshot's
+func (st *InMemoryStore) restoreSnapshot(snapshot documentSnapshot) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.document = document{blocks: NewOrderedMapOfBlocks()}
+	st.parentsCache = make(map[id]id)
+	st.backlinks = make(backlinks)
+	st.searchIndex = newSearchIndex()
+	for _, persisted := range snapshot.Blocks {
+		restoredBlock := blockFromPersisted(persisted)
+		st.recursiveSetParentLinks(restoredBlock, root)
+		st.backlinks.addSubtree(restoredBlock)
+		st.searchIndex.addSubtree(restoredBlock)
+		st.document.blocks.Set(restoredBlock.id, restoredBlock)
+	}
+	st.history = history{
+		undoStack: transactionsFromPersisted(snapshot.UndoStack),
+		redoStack: transactionsFromPersisted(snapshot.RedoStack),
+	}
+	st.revisions = revisions{
+		current: snapshot.Revision,
+		log:     revisionsFromPersisted(snapshot.Revisions),
+	}
+	st.trash = trashFromPersisted(snapshot.Trash)
+	st.idGenerator.advanceTo(snapshot.LastId)
+}
+
+func snapshotFileName(sequence uint64) string {
+	return fmt.Sprintf("%s%020d%s", snapshotFilePrefix, sequence, snapshotFileSuffix)
+}
+
+// writeSnapshot writes to a temporary file first so a crash never leaves a half written snapshot under the real name
+func writeSnapshot(dir string, snapshot documentSnapshot) error {
+	payload, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	frame, err := encodeFrame(payload)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, snapshotFileName(snapshot.Sequence))
+	tempPath := path + ".tmp"
+	if err := writeFileSynced(tempPath, frame); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, path); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+func readSnapshot(path string) (documentSnapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return documentSnapshot{}, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return documentSnapshot{}, err
+	}
+	payload, err := readFrame(file, info.Size())
+	if err != nil {
+		return documentSnapshot{}, errCorruptSnapshot
+	}
+	var snapshot documentSnapshot
+	if err := json.Unmarshal(payload, &snapshot); err != nil {
+		return documentSnapshot{}, errCorruptSnapshot
+	}
+	return snapshot, nil
+}
+
+// listSnapshots returns the snapshot files in dir, newest first
+func listSnapshots(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, snapshotFilePrefix) && strings.HasSuffix(name, snapshotFileSuffix) {
+			paths = append(paths, filepath.Join(dir, name))
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths))) // zero padded sequence numbers sort lexically
+	return paths, nil
+}
+
+// loadNewestSnapshot falls back to older snapshots when the newer ones can't be read
+func loadNewestSnapshot(dir string) (documentSnapshot, bool, error) {
+	paths, err := listSnapshots(dir)
+	if err != nil {
+		return documentSnapshot{}, false, err
+	}
+	for _, path := range paths {
+		snapshot, err := readSnapshot(path)
+		if err != nil {
+			continue
+		}
+		return snapshot, true, nil
+	}
+	return documentSnapshot{}, false, nil
+}
+
+// pruneSnapshots deletes all but the newest keep snapshots and returns
+// the sequence number of the oldest one left, which is how far back the log has to reach
+func pruneSnapshots(dir string, keep int) (uint64, error) {
+	paths, err := listSnapshots(dir)
+	if err != nil {
+		return 0, err
+	}
+	if len(paths) > keep {
+		for _, path := range paths[keep:] {
+			if err := os.Remove(path); err != nil {
+				return 0, err
+			}
+		}
+		paths = paths[:keep]
+	}
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	return snapshotSequence(paths[len(paths)-1])
+}
+
+func snapshotSequence(path string) (uint64, error) {
+	name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), snapshotFilePrefix), snapshotFileSuffix)
+	return strconv.ParseUint(name, 10, 64)
+}
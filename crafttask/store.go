@@ -1,25 +1,65 @@
 package crafttask
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"strings"
+	"sync"
+	"time"
 )
 
+// documentReader is the read side of a document, either the current one or one rebuilt at an earlier revision
+type documentReader interface {
+	FetchBlocks(blocksIdsToFetch []id) []block
+	Export() string
+	ExportTo(ctx context.Context, w io.Writer, exporter exporter, scope exportScope) error
+}
+
 type Store interface {
+	documentReader
 	InsertBlocks(insertOperations []insertOperation) ([]block, error)
-	DeleteBlocks(blocksIdsToDelete []id)
-	FetchBlocks(blocksIdsToFetch []id) []block
+	InsertBlocksPartially(insertOperations []insertOperation) []insertResult
+	DeleteBlocks(blocksIdsToDelete []id) error
 	DuplicateBlock(blockToDuplicate id) (block, error)
 	MoveBlock(blockToMove id, movePayload movePayload) error
-	Export() string
+	UpdateBlock(blockToUpdate id, updatePayload updatePayload) (block, error)
+	ApplyBatch(batchOperations []batchOperation) (batchResult, error)
+	Undo() error
+	Redo() error
+	Revisions() []revision
+	AtRevision(revision uint64) (documentReader, error)
+	Diff(fromRevision uint64, toRevision uint64) (documentDiff, error)
+	Trash() []trashedBlock
+	RestoreFromTrash(blockToRestore id, restorePayload restorePayload) (block, error)
+	PurgeTrash(blockIdsToPurge []id) error
+	SetProperty(blockId id, name string, payload propertyPayload) (block, error)
+	UnsetProperty(blockId id, name string) error
+	Backlinks(blockId id) ([]backlink, error)
+	Search(query string, limit int) ([]searchHit, error)
+	ImportBlocks(insertOperations []insertOperation, keepIds bool) ([]block, error)
+}
+
+// insertResult is the outcome of a single operation of a partial bulk insert; either block or err is set
+type insertResult struct {
+	block block
+	err   error
 }
 
 // biderectional link
-// synchronized access or simpler data strcutures?
+// every exported method is safe for concurrent use: reads share the lock, writes hold it exclusively.
+// Blocks handed out are copies, so callers can keep reading them after the lock is released.
 type InMemoryStore struct {
+	lock         sync.RWMutex
 	document     document
 	parentsCache map[id]id
+	backlinks    backlinks
+	searchIndex  searchIndex
 	idGenerator  idGenerator
+	history      history
+	revisions    revisions
+	trash        []trashedBlock
+	now          func() time.Time
 }
 
 func NewInMemoryStore() *InMemoryStore {
@@ -28,7 +68,10 @@ func NewInMemoryStore() *InMemoryStore {
 			blocks: NewOrderedMapOfBlocks(),
 		},
 		parentsCache: make(map[id]id),
+		backlinks:    make(backlinks),
+		searchIndex:  newSearchIndex(),
 		idGenerator:  newInMemoryIdGenerator(),
+		now:          time.Now,
 	}
 }
 
@@ -80,37 +123,117 @@ func (st *InMemoryStore) findBlockById(blockId id) (block, int, *orderedMapOfBlo
 	return blockToReturn, index, mapWhereBlockIsLocated, nil
 }
 
+// InsertBlocks applies either every operation or, if any of them is invalid, none of them;
+// the returned operationErrors then lists every invalid operation
 func (st *InMemoryStore) InsertBlocks(insertOperations []insertOperation) ([]block, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	invalidOperations := make(operationErrors)
+	for i, insertOperation := range insertOperations {
+		if err := st.validateInsert(insertOperation, nil); err != nil {
+			invalidOperations[i] = err
+		}
+	}
+	if len(invalidOperations) > 0 {
+		return nil, invalidOperations
+	}
+	var tx transaction
 	blocksToReturn := make([]block, 0, len(insertOperations))
 	for _, insertOperation := range insertOperations {
-		mapToInsertIn, err := st.findMapByParent(insertOperation.ParentBlockId)
+		insertedBlock, err := st.applyInsert(&tx, insertOperation.ParentBlockId, insertOperation.Index, insertOperation.Block)
 		if err != nil {
-			return nil, err // can be reworked to return partial success
-		}
-		blockId := st.idGenerator.getNewId()
-		blockToAdd := block{
-			id:        blockId,
-			content:   insertOperation.Block.Content,
-			subblocks: NewOrderedMapOfBlocks(),
+			st.rollback(tx)
+			return nil, err
 		}
-		blocksToReturn = append(blocksToReturn, blockToAdd)
-		st.parentsCache[blockId] = insertOperation.ParentBlockId
-		mapToInsertIn.Insert(blockId, insertOperation.Index, blockToAdd)
+		blocksToReturn = append(blocksToReturn, insertedBlock)
 	}
+	st.commit(tx, fmt.Sprintf("insert %s", countOf(tx.blockCount(), "block")))
 	return blocksToReturn, nil
 }
 
-func (st *InMemoryStore) DeleteBlocks(idsToDelete []id) {
-	for _, blockIdToDelete := range idsToDelete {
-		blockToDelete, _, mapToDeleteFrom, err := st.findBlockById(blockIdToDelete)
-		if err != nil {
+// InsertBlocksPartially applies every valid operation and reports the outcome of each one, in the order of the request
+func (st *InMemoryStore) InsertBlocksPartially(insertOperations []insertOperation) []insertResult {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	var tx transaction
+	results := make([]insertResult, 0, len(insertOperations))
+	for _, insertOperation := range insertOperations {
+		if err := st.validateInsert(insertOperation, nil); err != nil {
+			results = append(results, insertResult{err: err})
 			continue
-			// already deleted; can continue
 		}
-		mapToDeleteFrom.Delete(blockIdToDelete)
-		delete(st.parentsCache, blockIdToDelete)
-		st.recursiveDeleteParentLinks(blockToDelete)
+		insertedBlock, err := st.applyInsert(&tx, insertOperation.ParentBlockId, insertOperation.Index, insertOperation.Block)
+		results = append(results, insertResult{block: insertedBlock, err: err})
+	}
+	st.commit(tx, fmt.Sprintf("insert %s", countOf(tx.blockCount(), "block")))
+	return results
+}
+
+// inserting never removes blocks, so operations that are valid up front stay valid while the earlier ones are applied.
+// References can refer to blocks of the document, and to the importedTargets when the block is imported along with
+// others (see validateReferenceTargets).
+func (st *InMemoryStore) validateInsert(insertOperation insertOperation, importedTargets map[id]id) error {
+	if insertOperation.Index < 0 {
+		return errInvalidIndex
+	}
+	if _, err := st.pathToNode(insertOperation.ParentBlockId); err != nil {
+		return errParentBlockDoesNotExist
+	}
+	if err := validateBlockRequest(insertOperation.Block); err != nil {
+		return err
+	}
+	return st.validateReferenceTargets(insertOperation.Block, importedTargets)
+}
+
+// validateBlockRequest checks the content, types and properties of the requested block and all of its subblocks
+func validateBlockRequest(request blockRequest) error {
+	if _, _, err := blockContent(request.Content, request.RichText); err != nil {
+		return err
+	}
+	if _, err := propertiesFromPayloads(request.Properties); err != nil {
+		return err
+	}
+	if err := validateTypeFields(request.fields()); err != nil {
+		return err
+	}
+	for _, subblockRequest := range request.Subblocks {
+		if err := validateBlockRequest(subblockRequest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyInsert builds the requested subtree and inserts it, returning a copy of what was inserted
+func (st *InMemoryStore) applyInsert(tx *transaction, parentId id, index int, request blockRequest) (block, error) {
+	blockToAdd := st.newBlockFromRequest(request)
+	if err := tx.record(st.insertSubtree(parentId, index, blockToAdd)); err != nil {
+		return block{}, err
+	}
+	return st.resolvedClone(blockToAdd), nil
+}
+
+// newBlockFromRequest builds the whole requested subtree, giving every nested block a fresh id (depth first, in order)
+func (st *InMemoryStore) newBlockFromRequest(request blockRequest) block {
+	newBlock := request.fields()
+	newBlock.id = st.idGenerator.getNewId()
+	newBlock.subblocks = NewOrderedMapOfBlocks()
+	for _, subblockRequest := range request.Subblocks {
+		subblock := st.newBlockFromRequest(subblockRequest)
+		newBlock.subblocks.Set(subblock.id, subblock)
+	}
+	return newBlock
+}
+
+func (st *InMemoryStore) DeleteBlocks(idsToDelete []id) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	var tx transaction
+	for _, blockIdToDelete := range idsToDelete {
+		tx.record(st.trashSubtree(blockIdToDelete)) // if it's already deleted, we can continue
 	}
+	st.commit(tx, fmt.Sprintf("delete %s", countOf(tx.blockCount(), "block")))
+	return nil
 }
 
 func (st *InMemoryStore) recursiveDeleteParentLinks(blockToDelete block) {
@@ -121,64 +244,115 @@ func (st *InMemoryStore) recursiveDeleteParentLinks(blockToDelete block) {
 }
 
 func (st *InMemoryStore) FetchBlocks(idsToFetch []id) []block {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
 	toReturn := make([]block, 0, len(idsToFetch))
 	for _, id := range idsToFetch {
 		blockToReturn, _, _, err := st.findBlockById(id)
 		if err != nil {
 			continue // we are filtering here so I think we shouldn't error out
 		}
-		toReturn = append(toReturn, blockToReturn)
+		toReturn = append(toReturn, st.resolvedClone(blockToReturn))
 	}
 	return toReturn
 }
 
 func (st *InMemoryStore) DuplicateBlock(idToDuplicate id) (block, error) {
-	blockToDuplicate, index, mapToDuplicateIn, err := st.findBlockById(idToDuplicate)
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	var tx transaction
+	duplicatedBlock, err := st.applyDuplicate(&tx, idToDuplicate)
+	st.commit(tx, fmt.Sprintf("duplicate block %d", idToDuplicate))
+	return duplicatedBlock, err
+}
+
+// applyDuplicate inserts a copy of the block right after it, returning a copy of the duplicate
+func (st *InMemoryStore) applyDuplicate(tx *transaction, idToDuplicate id) (block, error) {
+	blockToDuplicate, index, _, err := st.findBlockById(idToDuplicate)
 	if err != nil {
 		return block{}, err
 	}
-	parentOfBlock, hasParent := st.parentsCache[idToDuplicate]
-	if !hasParent {
-		panic("inconsistent internal state") // this shouldn't happen, perhaps worth a rework
+	copiedFrom := make(map[id]id)
+	duplicatedBlock := st.recursiveCopyWithNewIds(blockToDuplicate, copiedFrom)
+	inserted, err := st.insertSubtree(st.parentsCache[idToDuplicate], index+1, duplicatedBlock)
+	if err != nil {
+		return block{}, err
 	}
-	newId := st.recursiveSetNewIds(&blockToDuplicate, parentOfBlock)
-	mapToDuplicateIn.Insert(newId, index+1, blockToDuplicate)
-	return blockToDuplicate, nil
+	inserted.copiedFrom = copiedFrom
+	tx.record(inserted, nil)
+	return st.resolvedClone(duplicatedBlock), nil
 }
 
-func (st *InMemoryStore) recursiveSetNewIds(blockToSetIdsTo *block, parentId id) id {
-	blockId := st.idGenerator.getNewId()
-	blockToSetIdsTo.id = blockId
-	st.parentsCache[blockId] = parentId
-	for _, subblock := range blockToSetIdsTo.subblocks.values {
-		st.recursiveSetNewIds(&subblock, blockId)
+// copies the whole subtree so the duplicate doesn't share its subblocks with the original;
+// walks in order so the same document always hands out the same ids (needed for replaying persisted operations).
+// Records which block each copy was made from.
+func (st *InMemoryStore) recursiveCopyWithNewIds(blockToCopy block, copiedFrom map[id]id) block {
+	copiedBlock := blockToCopy.fields()
+	copiedBlock.id = st.idGenerator.getNewId()
+	copiedFrom[copiedBlock.id] = blockToCopy.id
+	copiedBlock.subblocks = NewOrderedMapOfBlocks()
+	for _, subblock := range blockToCopy.subblocks.OrderedValues() {
+		copiedSubblock := st.recursiveCopyWithNewIds(subblock, copiedFrom)
+		copiedBlock.subblocks.Set(copiedSubblock.id, copiedSubblock)
 	}
-	return blockId
+	return copiedBlock
 }
 
 func (st *InMemoryStore) MoveBlock(blockId id, movePayload movePayload) error {
-	consistencyCheckErr := st.blockMovedToItsChild(blockId, movePayload.NewParentId)
-	if consistencyCheckErr != nil {
-		return consistencyCheckErr
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	var tx transaction
+	err := tx.record(st.moveSubtree(blockId, movePayload.NewParentId, movePayload.Index))
+	st.commit(tx, fmt.Sprintf("move block %d", blockId))
+	return err
+}
+
+// UpdateBlock replaces the block's content, and its type when the payload has one; its id, position and subblocks
+// stay the same
+func (st *InMemoryStore) UpdateBlock(blockId id, updatePayload updatePayload) (block, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	var tx transaction
+	updatedBlock, err := st.applyUpdate(&tx, blockId, updatePayload)
+	st.commit(tx, fmt.Sprintf("update block %d", blockId))
+	return updatedBlock, err
+}
+
+func (st *InMemoryStore) applyUpdate(tx *transaction, blockId id, updatePayload updatePayload) (block, error) {
+	blockToUpdate, _, _, err := st.findBlockById(blockId)
+	if err != nil {
+		return block{}, err
 	}
-	blockToMove, _, oldMap, findErr := st.findBlockById(blockId)
-	if findErr != nil {
-		return findErr
+	fields := blockToUpdate.fields()
+	if updatePayload.Type != "" {
+		fields = updatePayload.blockTypeFields.applyTo(fields)
+	} else if updatePayload.blockTypeFields != (blockTypeFields{}) {
+		return block{}, errMissingBlockType
 	}
-
-	oldMap.Delete(blockId)
-	st.parentsCache[blockId] = movePayload.NewParentId
-	newMap, findMapErr := st.findMapByParent(movePayload.NewParentId)
-	if findMapErr != nil {
-		//log
-		return errParentBlockDoesNotExist
+	fields.content, fields.richText, err = blockContent(updatePayload.Content, updatePayload.RichText)
+	if err != nil {
+		return block{}, err
 	}
-	newMap.Insert(blockId, movePayload.Index, blockToMove)
-
-	return nil
+	if err := validateTypeFields(fields); err != nil {
+		return block{}, err
+	}
+	// a reference that broke since is kept as it is, unless it's given a new target
+	if fields.blockType == blockTypeReference && updatePayload.Type != "" {
+		if err := st.validateReference(blockId, fields.target); err != nil {
+			return block{}, err
+		}
+	}
+	if err := tx.record(st.updateFields(blockId, fields)); err != nil {
+		return block{}, err
+	}
+	updatedBlock, _, _, _ := st.findBlockById(blockId)
+	return st.resolvedClone(updatedBlock), nil
 }
 
 func (st *InMemoryStore) blockMovedToItsChild(blockId, newParentId id) error {
+	if newParentId == blockId {
+		return errBlockMovedToItsChild
+	}
 	for newParentId != root {
 		var ok bool
 		newParentId, ok = st.parentsCache[newParentId]
@@ -193,16 +367,48 @@ func (st *InMemoryStore) blockMovedToItsChild(blockId, newParentId id) error {
 }
 
 func (st *InMemoryStore) Export() string {
+	return st.ExportWith(plainTextExporter{})
+}
+
+// ExportWith renders the whole document with the given exporter into a string
+func (st *InMemoryStore) ExportWith(exporter exporter) string {
 	var builder strings.Builder
-	for _, block := range st.document.blocks.OrderedValues() {
-		addString(&builder, block, 0)
-	}
+	st.ExportTo(context.Background(), &builder, exporter, wholeDocument) // writing to a strings.Builder doesn't fail
 	return builder.String()
 }
 
-func addString(builder *strings.Builder, block block, indentLevel int) {
-	builder.WriteString(fmt.Sprintf("%s%s\n", strings.Repeat(" ", indentLevel*2), block.content))
-	for _, subblock := range block.subblocks.OrderedValues() {
-		addString(builder, subblock, indentLevel+1)
+// ExportTo streams the scope of the document with the given exporter, references resolved. The lock is only held
+// while the exporter fills its buffer, so a slow client doesn't hold up writes.
+func (st *InMemoryStore) ExportTo(ctx context.Context, w io.Writer, exporter exporter, scope exportScope) error {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	blocks := st.document.blocks.OrderedValues()
+	if scope.rootId != root {
+		rootBlock, _, _, err := st.findBlockById(scope.rootId)
+		if err != nil {
+			return err
+		}
+		blocks = []block{rootBlock}
+	}
+	return exportBlocks(ctx, unlockedWriter{w: w, lock: &st.lock}, resolvingExporter{exporter: exporter, st: st}, blocks, scope.maxDepth)
+}
+
+// unlockedWriter releases the read lock while it writes, for ExportTo
+type unlockedWriter struct {
+	w    io.Writer
+	lock *sync.RWMutex
+}
+
+func (w unlockedWriter) Write(p []byte) (int, error) {
+	w.lock.RUnlock()
+	defer w.lock.RLock()
+	return w.w.Write(p)
+}
+
+// countOf is "1 block", "2 blocks" and so on
+func countOf(count int, noun string) string {
+	if count == 1 {
+		return fmt.Sprintf("%d %s", count, noun)
 	}
+	return fmt.Sprintf("%d %ss", count, noun)
 }
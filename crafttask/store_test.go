@@ -1,6 +1,8 @@
 package crafttask
 
 import (
+	"math/rand"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -249,3 +251,260 @@ Block 2
 `,
 		result)
 }
+
+func TestInMemoryStore_MoveToItself_Err(t *testing.T) {
+	store := NewInMemoryStore()
+
+	blocks, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+
+	err = store.MoveBlock(blocks[0].id, movePayload{NewParentId: blocks[0].id, Index: 0})
+	assert.Equal(t, errBlockMovedToItsChild, err)
+	assert.Equal(t, "Block 1\n", store.Export())
+}
+
+func TestInMemoryStore_ConcurrentOperations(t *testing.T) {
+	store := NewInMemoryStore()
+	stressStore(t, store, 8, 300)
+	assertConsistent(t, store)
+}
+
+// stressStore runs every store operation from several goroutines at once on random blocks; meant to be run with -race
+func stressStore(t *testing.T, store Store, workers int, operationsPerWorker int) {
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(seed))
+			randomId := func() id { return id(random.Intn(operationsPerWorker)) }
+			for i := 0; i < operationsPerWorker; i++ {
+				switch random.Intn(10) {
+				case 0, 1:
+					store.InsertBlocks([]insertOperation{
+						{ParentBlockId: randomId(), Index: random.Intn(3), Block: blockRequest{Content: "Block"}},
+						{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Root Block"}},
+					})
+				case 2:
+					store.DeleteBlocks([]id{randomId()})
+				case 3:
+					for _, fetched := range store.FetchBlocks([]id{randomId(), randomId()}) {
+						blockToResponse(fetched)
+					}
+				case 4:
+					duplicated, err := store.DuplicateBlock(randomId())
+					if err == nil {
+						blockToResponse(duplicated)
+					}
+				case 5:
+					store.MoveBlock(randomId(), movePayload{NewParentId: randomId(), Index: random.Intn(3)})
+				case 6:
+					store.UpdateBlock(randomId(), updatePayload{Content: "Updated Block"})
+				case 7:
+					store.InsertBlocksPartially([]insertOperation{{ParentBlockId: randomId(), Index: 0, Block: blockRequest{Content: "Block"}}})
+				case 8:
+					store.ApplyBatch([]batchOperation{
+						{Operation: batchInsert, ParentBlockId: randomId(), Block: blockRequest{Content: "Batch Block"}, Ref: "new"},
+						{Operation: batchMove, BlockId: randomId(), ParentRef: "new"},
+						{Operation: batchDuplicate, BlockId: randomId()},
+						{Operation: batchDelete, BlockId: randomId()},
+					})
+				case 9:
+					if random.Intn(2) == 0 {
+						store.Undo()
+					} else {
+						store.Redo()
+					}
+				}
+				if i%50 == 0 {
+					store.Export()
+				}
+			}
+		}(int64(worker))
+	}
+	wg.Wait()
+}
+
+// assertConsistent checks that the parents cache and the indexes describe exactly the blocks in the tree
+func assertConsistent(t *testing.T, store *InMemoryStore) {
+	t.Helper()
+	blocksInTree := 0
+	var walk func(blocks *orderedMapOfBlocks, parentId id)
+	walk = func(blocks *orderedMapOfBlocks, parentId id) {
+		require.Len(t, blocks.keys, len(blocks.values))
+		for _, child := range blocks.OrderedValues() {
+			blocksInTree++
+			assert.Equal(t, parentId, store.parentsCache[child.id], "parent of block %d", child.id)
+			walk(child.subblocks, child.id)
+		}
+	}
+	walk(store.document.blocks, root)
+	assert.Len(t, store.parentsCache, blocksInTree)
+
+	expectedBacklinks, expectedSearchIndex := make(backlinks), newSearchIndex()
+	for _, topLevelBlock := range store.document.blocks.OrderedValues() {
+		expectedBacklinks.addSubtree(topLevelBlock)
+		expectedSearchIndex.addSubtree(topLevelBlock)
+	}
+	assert.Equal(t, expectedBacklinks, store.backlinks)
+	assert.Equal(t, expectedSearchIndex, store.searchIndex)
+}
+
+func TestInMemoryStore_Update(t *testing.T) {
+	store := NewInMemoryStore()
+
+	payload := []insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}},
+	}
+	blocks, err := store.InsertBlocks(payload)
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{{ParentBlockId: blocks[0].id, Index: 0, Block: blockRequest{Content: "Child Block 1"}}})
+	require.NoError(t, err)
+
+	updatedBlock, err := store.UpdateBlock(blocks[0].id, updatePayload{Content: "Updated Block 1"})
+	require.NoError(t, err)
+	assert.Equal(t, blocks[0].id, updatedBlock.id)
+	assert.Equal(t, "Updated Block 1", updatedBlock.content)
+	require.Len(t, updatedBlock.subblocks.keys, 1)
+
+	assert.Equal(t, []id{blocks[0].id, blocks[1].id}, store.document.blocks.keys)
+	assert.Equal(t, "Updated Block 1\n  Child Block 1\nBlock 2\n", store.Export())
+}
+
+func TestInMemoryStore_UpdateMissing_Err(t *testing.T) {
+	store := NewInMemoryStore()
+
+	_, err := store.UpdateBlock(1, updatePayload{Content: "Block 1"})
+	assert.Equal(t, errBlockDoesNotExist, err)
+}
+
+func TestInMemoryStore_InsertSubtree(t *testing.T) {
+	store := NewInMemoryStore()
+
+	_, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}}})
+	require.NoError(t, err)
+
+	subtree := blockRequest{
+		Content: "Block 2",
+		Subblocks: []blockRequest{
+			{Content: "Child Block 1", Subblocks: []blockRequest{{Content: "Grand Child Block 1"}}},
+			{Content: "Child Block 2"},
+		},
+	}
+	blocks, err := store.InsertBlocks([]insertOperation{{ParentBlockId: root, Index: 1, Block: subtree}})
+	require.NoError(t, err)
+
+	assert.Equal(t, []blockResponse{{
+		Id:      2,
+		Type:    blockTypeParagraph,
+		Content: "Block 2",
+		Subblocks: []blockResponse{
+			{Id: 3, Type: blockTypeParagraph, Content: "Child Block 1", Subblocks: []blockResponse{{Id: 4, Type: blockTypeParagraph, Content: "Grand Child Block 1", Subblocks: []blockResponse{}}}},
+			{Id: 5, Type: blockTypeParagraph, Content: "Child Block 2", Subblocks: []blockResponse{}},
+		},
+	}}, blocksToResponse(blocks))
+
+	assert.Equal(t, id(3), store.parentsCache[4])
+	assert.Equal(t, id(2), store.parentsCache[5])
+	assert.Equal(t, "Block 1\nBlock 2\n  Child Block 1\n    Grand Child Block 1\n  Child Block 2\n", store.Export())
+
+	err = store.MoveBlock(4, movePayload{NewParentId: 1, Index: 0})
+	require.NoError(t, err)
+	assert.Equal(t, "Block 1\n  Grand Child Block 1\nBlock 2\n  Child Block 1\n  Child Block 2\n", store.Export())
+}
+
+func TestInMemoryStore_InsertIsAtomic(t *testing.T) {
+	store := NewInMemoryStore()
+
+	payload := []insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}},
+		{ParentBlockId: 42, Index: 0, Block: blockRequest{Content: "Orphan Block"}},
+		{ParentBlockId: root, Index: -1, Block: blockRequest{Content: "Block 2"}},
+	}
+	_, err := store.InsertBlocks(payload)
+	assert.Equal(t, operationErrors{1: errParentBlockDoesNotExist, 2: errInvalidIndex}, err)
+	assert.Equal(t, "", store.Export())
+	assert.Empty(t, store.parentsCache)
+
+	blocks, err := store.InsertBlocks(payload[:1])
+	require.NoError(t, err)
+	assert.Equal(t, id(1), blocks[0].id, "rejected operations should not use up ids")
+}
+
+func TestInMemoryStore_InsertPartially(t *testing.T) {
+	store := NewInMemoryStore()
+
+	results := store.InsertBlocksPartially([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}},
+		{ParentBlockId: 42, Index: 0, Block: blockRequest{Content: "Orphan Block"}},
+		{ParentBlockId: 1, Index: 0, Block: blockRequest{Content: "Child Block 1"}},
+	})
+	require.Len(t, results, 3)
+	require.NoError(t, results[0].err)
+	assert.Equal(t, id(1), results[0].block.id)
+	assert.Equal(t, errParentBlockDoesNotExist, results[1].err)
+	require.NoError(t, results[2].err)
+	assert.Equal(t, id(2), results[2].block.id)
+	assert.Equal(t, "Block 1\n  Child Block 1\n", store.Export())
+}
+
+func TestInMemoryStore_Batch(t *testing.T) {
+	store := NewInMemoryStore()
+
+	blocks, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block B"}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block C"}},
+		{ParentBlockId: root, Index: 2, Block: blockRequest{Content: "Block D"}},
+	})
+	require.NoError(t, err)
+
+	result, err := store.ApplyBatch([]batchOperation{
+		{Operation: batchInsert, ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block A"}, Ref: "a"},
+		{Operation: batchMove, BlockId: blocks[0].id, ParentRef: "a", Index: 0},
+		{Operation: batchDelete, BlockId: blocks[1].id},
+		{Operation: batchDuplicate, BlockId: blocks[2].id, Ref: "d2"},
+		{Operation: batchUpdate, BlockRef: "d2", Update: updatePayload{Content: "Block D2"}},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]id{"a": 4, "d2": 5}, result.refs)
+	require.Len(t, result.blocks, 5)
+	assert.Equal(t, "Block A", result.blocks[0].content)
+	assert.Nil(t, result.blocks[1])
+	assert.Nil(t, result.blocks[2])
+	assert.Equal(t, "Block D2", result.blocks[4].content)
+	assert.Equal(t, "Block A\n  Block B\nBlock D\nBlock D2\n", store.Export())
+	assertConsistent(t, store)
+}
+
+func TestInMemoryStore_BatchRollsBack(t *testing.T) {
+	store := NewInMemoryStore()
+
+	blocks, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{{Content: "Child Block 1"}}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}},
+	})
+	require.NoError(t, err)
+	expectedExport := store.Export()
+
+	_, err = store.ApplyBatch([]batchOperation{
+		{Operation: batchInsert, ParentBlockId: blocks[1].id, Index: 0, Block: blockRequest{Content: "New Block"}, Ref: "new"},
+		{Operation: batchMove, BlockId: blocks[0].id, ParentRef: "new", Index: 0},
+		{Operation: batchUpdate, BlockId: blocks[1].id, Update: updatePayload{Content: "Updated Block 2"}},
+		{Operation: batchDuplicate, BlockId: blocks[1].id},
+		{Operation: batchDelete, BlockId: blocks[1].id},
+		{Operation: batchMove, BlockRef: "missing", ParentBlockId: root},
+	})
+	assert.Equal(t, operationErrors{5: errUnknownRef}, err)
+	assert.Equal(t, expectedExport, store.Export())
+	assertConsistent(t, store)
+
+	_, err = store.ApplyBatch([]batchOperation{
+		{Operation: batchDelete, BlockId: blocks[0].id},
+		{Operation: batchInsert, ParentBlockId: blocks[0].id, Block: blockRequest{Content: "Orphan Block"}},
+	})
+	assert.Equal(t, operationErrors{1: errParentBlockDoesNotExist}, err)
+	assert.Equal(t, expectedExport, store.Export())
+	assertConsistent(t, store)
+}
@@ -0,0 +1,245 @@
+package crafttask
+
+import (
+	"fmt"
+	"strings"
+)
+
+// lines of unchanged text shown around each change of a unified diff
+const diffContextLines = 3
+
+type lineEdit struct {
+	// ' ' for a line both texts have, '-' for a removed one and '+' for an added one
+	operation byte
+	line      string
+}
+
+// unifiedDiff compares two texts line by line, in the format of diff -u; equal texts give an empty diff
+func unifiedDiff(fromName, toName, fromText, toText string) string {
+	edits := diffLines(splitLines(fromText), splitLines(toText))
+	var builder strings.Builder
+	fromLine, toLine := 0, 0
+	for start := 0; start < len(edits); {
+		if edits[start].operation == ' ' {
+			fromLine++
+			toLine++
+			start++
+			continue
+		}
+		if builder.Len() == 0 {
+			fmt.Fprintf(&builder, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		// the hunk takes every change closer to the previous one than twice the context
+		hunkStart := start - diffContextLines
+		if hunkStart < 0 {
+			hunkStart = 0
+		}
+		hunkEnd := start
+		for unchanged := 0; hunkEnd < len(edits) && unchanged <= 2*diffContextLines; hunkEnd++ {
+			if edits[hunkEnd].operation == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for hunkEnd > start && edits[hunkEnd-1].operation == ' ' {
+			hunkEnd--
+		}
+		hunkEnd += diffContextLines
+		if hunkEnd > len(edits) {
+			hunkEnd = len(edits)
+		}
+
+		hunkFromStart, hunkToStart := fromLine-(start-hunkStart), toLine-(start-hunkStart)
+		fromCount, toCount := 0, 0
+		var hunk strings.Builder
+		for _, edit := range edits[hunkStart:hunkEnd] {
+			if edit.operation != '+' {
+				fromCount++
+			}
+			if edit.operation != '-' {
+				toCount++
+			}
+			hunk.WriteByte(edit.operation)
+			hunk.WriteString(edit.line)
+			hunk.WriteByte('\n')
+		}
+		fmt.Fprintf(&builder, "@@ -%s +%s @@\n", hunkRange(hunkFromStart, fromCount), hunkRange(hunkToStart, toCount))
+		builder.WriteString(hunk.String())
+		fromLine, toLine = hunkFromStart+fromCount, hunkToStart+toCount
+		start = hunkEnd
+	}
+	return builder.String()
+}
+
+// hunkRange formats the lines a hunk covers; an empty range is given as the line before it, as diff does
+func hunkRange(start int, count int) string {
+	if count == 1 {
+		return fmt.Sprint(start + 1)
+	}
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// diffLines finds the shortest edit script turning one list of lines into the other, with the linear space variant of
+// Myers' algorithm: it splits the lists where an optimal path crosses the middle of the edit graph and diffs the halves.
+// Within every run of changes the removed lines come first, the way diff shows them.
+func diffLines(from []string, to []string) []lineEdit {
+	differ := lineDiffer{from: from, to: to, edits: make([]lineEdit, 0, len(from)+len(to))}
+	differ.diff(0, len(from), 0, len(to))
+	return removalsFirst(differ.edits)
+}
+
+func removalsFirst(edits []lineEdit) []lineEdit {
+	ordered := make([]lineEdit, 0, len(edits))
+	for start := 0; start < len(edits); {
+		end := start
+		for end < len(edits) && edits[end].operation != ' ' {
+			end++
+		}
+		if end == start {
+			ordered = append(ordered, edits[start])
+			start++
+			continue
+		}
+		for _, operation := range []byte{'-', '+'} {
+			for _, edit := range edits[start:end] {
+				if edit.operation == operation {
+					ordered = append(ordered, edit)
+				}
+			}
+		}
+		start = end
+	}
+	return ordered
+}
+
+type lineDiffer struct {
+	from, to []string
+	edits    []lineEdit
+}
+
+// diff appends the edits turning from[fromStart:fromEnd] into to[toStart:toEnd]
+func (d *lineDiffer) diff(fromStart, fromEnd, toStart, toEnd int) {
+	for fromStart < fromEnd && toStart < toEnd && d.from[fromStart] == d.to[toStart] {
+		d.edits = append(d.edits, lineEdit{' ', d.from[fromStart]})
+		fromStart++
+		toStart++
+	}
+	commonSuffix := 0
+	for fromEnd > fromStart && toEnd > toStart && d.from[fromEnd-1] == d.to[toEnd-1] {
+		fromEnd--
+		toEnd--
+		commonSuffix++
+	}
+	switch {
+	case fromStart == fromEnd:
+		for _, line := range d.to[toStart:toEnd] {
+			d.edits = append(d.edits, lineEdit{'+', line})
+		}
+	case toStart == toEnd:
+		for _, line := range d.from[fromStart:fromEnd] {
+			d.edits = append(d.edits, lineEdit{'-', line})
+		}
+	default:
+		if x, y, found := d.middle(fromStart, fromEnd, toStart, toEnd); found {
+			d.diff(fromStart, x, toStart, y)
+			d.diff(x, fromEnd, y, toEnd)
+		} else {
+			// only when the two differ in all lines, and by one at most
+			for _, line := range d.from[fromStart:fromEnd] {
+				d.edits = append(d.edits, lineEdit{'-', line})
+			}
+			for _, line := range d.to[toStart:toEnd] {
+				d.edits = append(d.edits, lineEdit{'+', line})
+			}
+		}
+	}
+	for _, line := range d.from[fromEnd : fromEnd+commonSuffix] {
+		d.edits = append(d.edits, lineEdit{' ', line})
+	}
+}
+
+// middle searches for the shortest edit script from both ends at once, until the two searches overlap; the point
+// they meet at is on a shortest edit script. The lists start and end with different lines and aren't empty.
+func (d *lineDiffer) middle(fromStart, fromEnd, toStart, toEnd int) (int, int, bool) {
+	from, to := d.from[fromStart:fromEnd], d.to[toStart:toEnd]
+	maxEdits := (len(from) + len(to) + 1) / 2
+	offset := maxEdits + 1
+	// forward[offset+k] is how far into from the furthest path from the start on diagonal k (x - y = k) got,
+	// and backward[offset+k] the same for paths from the end, counted from the end
+	forward := make([]int, 2*maxEdits+3)
+	backward := make([]int, 2*maxEdits+3)
+	for i := range forward {
+		forward[i], backward[i] = -1, -1
+	}
+	forward[offset+1], backward[offset+1] = 0, 0
+	delta := len(from) - len(to)
+	// with an odd delta the paths from the start are the ones to meet the others, and with an even one the reverse
+	forwardMeets := delta%2 != 0
+	// diagonals that ran off the edit graph on either side aren't searched any more
+	forwardKStart, forwardKEnd, backwardKStart, backwardKEnd := 0, 0, 0, 0
+	for edits := 0; edits < maxEdits; edits++ {
+		for k := -edits + forwardKStart; k <= edits-forwardKEnd; k += 2 {
+			var x int
+			if k == -edits || (k != edits && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1] // a line added
+			} else {
+				x = forward[offset+k-1] + 1 // a line removed
+			}
+			y := x - k
+			for x < len(from) && y < len(to) && from[x] == to[y] {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+			if x > len(from) {
+				forwardKEnd += 2
+			} else if y > len(to) {
+				forwardKStart += 2
+			} else if forwardMeets {
+				backwardK := delta - k
+				if backwardK >= -maxEdits && backwardK <= maxEdits && backward[offset+backwardK] != -1 &&
+					x >= len(from)-backward[offset+backwardK] {
+					return fromStart + x, toStart + y, true
+				}
+			}
+		}
+		for k := -edits + backwardKStart; k <= edits-backwardKEnd; k += 2 {
+			var x int
+			if k == -edits || (k != edits && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < len(from) && y < len(to) && from[len(from)-x-1] == to[len(to)-y-1] {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+			if x > len(from) {
+				backwardKEnd += 2
+			} else if y > len(to) {
+				backwardKStart += 2
+			} else if !forwardMeets {
+				forwardK := delta - k
+				if forwardK >= -maxEdits && forwardK <= maxEdits && forward[offset+forwardK] != -1 &&
+					forward[offset+forwardK] >= len(from)-x {
+					forwardX := forward[offset+forwardK]
+					return fromStart + forwardX, toStart + forwardX - forwardK, true
+				}
+			}
+		}
+	}
+	return 0, 0, false
+}
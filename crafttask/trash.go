@@ -0,0 +1,207 @@
+package crafttask
+
+import (
+	"fmt"
+	"time"
+)
+
+// how long deleted subtrees stay in the trash before they are purged for good
+const trashRetention = 30 * 24 * time.Hour
+
+// trashedBlock is a deleted subtree with the position it is restored to
+type trashedBlock struct {
+	block     block
+	parentId  id
+	index     int
+	deletedAt time.Time
+}
+
+func (trashed trashedBlock) purgeAt() time.Time {
+	return trashed.deletedAt.Add(trashRetention)
+}
+
+// trashSubtree removes the subtree from the tree into the trash, which remembers where it was
+func (st *InMemoryStore) trashSubtree(blockId id) (mutation, error) {
+	removed, err := st.removeSubtree(blockId)
+	if err != nil {
+		return mutation{}, err
+	}
+	return st.addToTrash(removed, removed.parentId, removed.index, time.Time{}), nil
+}
+
+// addToTrash puts a subtree removed from the tree in the trash, to be restored to the given position. Undoing a
+// restore passes when the subtree was deleted, so it goes back where it was in the trash and keeps its retention;
+// a new delete passes the zero time and is deleted now.
+func (st *InMemoryStore) addToTrash(removed mutation, originalParentId id, originalIndex int, deletedAt time.Time) mutation {
+	removed.kind = mutationTrash
+	removed.oldParentId, removed.oldIndex = originalParentId, originalIndex
+	removed.deletedAt = deletedAt
+	if deletedAt.IsZero() {
+		removed.deletedAt = st.now()
+	}
+	at := len(st.trash)
+	for at > 0 && st.trash[at-1].deletedAt.After(removed.deletedAt) {
+		at--
+	}
+	st.trash = append(st.trash[:at], append([]trashedBlock{{
+		block:     removed.block.clone(),
+		parentId:  originalParentId,
+		index:     originalIndex,
+		deletedAt: removed.deletedAt,
+	}}, st.trash[at:]...)...)
+	return removed
+}
+
+// restoreSubtree takes the mutation's subtree out of the trash and inserts it at the mutation's position.
+// Deletes whose subtree was purged since can't be undone any more (see forgetPurged), so the subtree is there.
+func (st *InMemoryStore) restoreSubtree(m mutation) (mutation, error) {
+	inserted, err := st.insertSubtree(m.parentId, m.index, m.block.clone())
+	if err != nil {
+		return mutation{}, err
+	}
+	st.removeFromTrash(m.blockId)
+	m.kind = mutationRestore
+	m.block = inserted.block
+	m.index = inserted.index
+	return m, nil
+}
+
+func (st *InMemoryStore) findInTrash(blockId id) (trashedBlock, bool) {
+	for _, trashed := range st.trash {
+		if trashed.block.id == blockId {
+			return trashed, true
+		}
+	}
+	return trashedBlock{}, false
+}
+
+func (st *InMemoryStore) removeFromTrash(blockId id) {
+	for i, trashed := range st.trash {
+		if trashed.block.id == blockId {
+			st.trash = append(st.trash[:i:i], st.trash[i+1:]...)
+			return
+		}
+	}
+}
+
+// purgeExpiredTrash drops the subtrees deleted longer than the retention period ago. It runs with every operation,
+// so it happens at the same points when the operations are replayed; callers hold the write lock.
+func (st *InMemoryStore) purgeExpiredTrash() {
+	now := st.now()
+	kept := st.trash[:0]
+	purged := make(map[id]bool)
+	for _, trashed := range st.trash {
+		if now.Before(trashed.purgeAt()) {
+			kept = append(kept, trashed)
+		} else {
+			collectIds(trashed.block, purged)
+		}
+	}
+	st.trash = kept
+	st.forgetPurged(purged)
+}
+
+// forgetPurged drops the history the purged blocks could be brought back from, so purging is for good: the operations
+// that can be undone or redone back to the latest one involving them, and the revisions back to the latest one that
+// did. Undo, redo and reading earlier revisions stop there instead of resurrecting the blocks.
+func (st *InMemoryStore) forgetPurged(purged map[id]bool) {
+	if len(purged) == 0 {
+		return
+	}
+	st.history.undoStack = transactionsAfterLastInvolving(st.history.undoStack, purged)
+	st.history.redoStack = transactionsAfterLastInvolving(st.history.redoStack, purged)
+	kept := st.revisions.log
+	for i := len(st.revisions.log) - 1; i >= 0; i-- {
+		if st.revisions.log[i].tx.involves(purged) {
+			kept = st.revisions.log[i+1:]
+			break
+		}
+	}
+	st.revisions.log = append([]revision(nil), kept...)
+}
+
+// transactionsAfterLastInvolving keeps the transactions of an undo or redo stack that come after the last one
+// involving the blocks; those are applied after it, or reverted before it, so they don't need the blocks either
+func transactionsAfterLastInvolving(stack []transaction, blockIds map[id]bool) []transaction {
+	for i := len(stack) - 1; i >= 0; i-- {
+		if stack[i].involves(blockIds) {
+			return append([]transaction(nil), stack[i+1:]...)
+		}
+	}
+	return stack
+}
+
+func collectIds(subtree block, ids map[id]bool) {
+	ids[subtree.id] = true
+	for _, subblock := range subtree.subblocks.OrderedValues() {
+		collectIds(subblock, ids)
+	}
+}
+
+// Trash lists the deleted subtrees that can still be restored, in the order they were deleted
+func (st *InMemoryStore) Trash() []trashedBlock {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+	now := st.now()
+	toReturn := make([]trashedBlock, 0, len(st.trash))
+	for _, trashed := range st.trash {
+		if now.Before(trashed.purgeAt()) { // expired ones are only dropped by the next operation
+			trashed.block = st.resolvedClone(trashed.block)
+			toReturn = append(toReturn, trashed)
+		}
+	}
+	return toReturn
+}
+
+// RestoreFromTrash puts the deleted subtree back where it was deleted from, or under another parent when the
+// payload has one. Restoring to the original position fails with errOriginalParentDoesNotExist once that is gone.
+func (st *InMemoryStore) RestoreFromTrash(blockId id, restorePayload restorePayload) (block, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.purgeExpiredTrash()
+	trashed, ok := st.findInTrash(blockId)
+	if !ok {
+		return block{}, errBlockNotInTrash
+	}
+	parentId, index := trashed.parentId, trashed.index
+	if restorePayload.NewParentId != nil {
+		parentId, index = *restorePayload.NewParentId, restorePayload.Index
+	} else if _, err := st.findMapByParent(parentId); err != nil {
+		return block{}, errOriginalParentDoesNotExist
+	}
+	restored, err := st.restoreSubtree(mutation{
+		blockId:     blockId,
+		block:       trashed.block,
+		parentId:    parentId,
+		index:       index,
+		oldParentId: trashed.parentId,
+		oldIndex:    trashed.index,
+		deletedAt:   trashed.deletedAt,
+	})
+	if err != nil {
+		return block{}, err
+	}
+	st.commit(transaction{mutations: []mutation{restored}}, fmt.Sprintf("restore block %d", blockId))
+	return st.resolvedClone(restored.block), nil
+}
+
+// PurgeTrash deletes the subtrees from the trash for good, along with the history they could be brought back from
+// (see forgetPurged); it purges all of them or, if one isn't in the trash, none
+func (st *InMemoryStore) PurgeTrash(idsToPurge []id) error {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.purgeExpiredTrash()
+	for _, idToPurge := range idsToPurge {
+		if _, ok := st.findInTrash(idToPurge); !ok {
+			return errBlockNotInTrash
+		}
+	}
+	purged := make(map[id]bool)
+	for _, idToPurge := range idsToPurge {
+		trashed, _ := st.findInTrash(idToPurge)
+		collectIds(trashed.block, purged)
+		st.removeFromTrash(idToPurge)
+	}
+	st.forgetPurged(purged)
+	return nil
+}
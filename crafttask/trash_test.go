@@ -0,0 +1,214 @@
+package crafttask
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInMemoryStore_TrashAndRestore(t *testing.T) {
+	store := NewInMemoryStore()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.setClock(func() time.Time { return now })
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{{Content: "Child Block 2"}, {Content: "Child Block 3"}}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 4"}},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, store.DeleteBlocks([]id{3}))
+	require.NoError(t, store.DeleteBlocks([]id{1}))
+	assert.Equal(t, "Block 4\n", store.Export())
+	trash := store.Trash()
+	require.Len(t, trash, 2)
+	assert.Equal(t, id(3), trash[0].block.id)
+	assert.Equal(t, id(1), trash[0].parentId)
+	assert.Equal(t, 1, trash[0].index)
+	assert.Equal(t, now, trash[0].deletedAt)
+	assert.Equal(t, id(1), trash[1].block.id)
+	assert.Equal(t, []id{2}, trash[1].block.subblocks.Keys(), "the child deleted before is in the trash on its own")
+
+	_, err = store.RestoreFromTrash(3, restorePayload{})
+	assert.Equal(t, errOriginalParentDoesNotExist, err)
+	newParentId := id(4)
+	restored, err := store.RestoreFromTrash(3, restorePayload{NewParentId: &newParentId})
+	require.NoError(t, err)
+	assert.Equal(t, "Child Block 3", restored.content)
+	_, err = store.RestoreFromTrash(1, restorePayload{})
+	require.NoError(t, err)
+	assert.Equal(t, "Block 1\n  Child Block 2\nBlock 4\n  Child Block 3\n", store.Export())
+	assert.Empty(t, store.Trash())
+	assertConsistent(t, store)
+
+	require.NoError(t, store.Undo())
+	assert.Equal(t, "Block 4\n  Child Block 3\n", store.Export())
+	trash = store.Trash()
+	require.Len(t, trash, 1)
+	assert.Equal(t, id(root), trash[0].parentId, "undoing a restore keeps the position it is restored to")
+	assert.Equal(t, 0, trash[0].index)
+
+	_, err = store.RestoreFromTrash(42, restorePayload{})
+	assert.Equal(t, errBlockNotInTrash, err)
+	assert.Equal(t, errBlockNotInTrash, store.PurgeTrash([]id{1, 42}))
+	require.Len(t, store.Trash(), 1, "a failed purge purges nothing")
+	require.NoError(t, store.PurgeTrash([]id{1}))
+	assert.Empty(t, store.Trash())
+
+	assert.Equal(t, errNothingToRedo, store.Redo(), "redoing the restore of block 1 would bring it back")
+	_, err = store.AtRevision(5)
+	assert.Equal(t, errRevisionNotAvailable, err, "the revisions with block 1 are gone")
+	require.NoError(t, store.Undo()) // the restore of block 3
+	assert.Equal(t, errNothingToUndo, store.Undo(), "undoing the delete of block 1 would bring it back")
+	assert.Equal(t, "Block 4\n", store.Export())
+	assertConsistent(t, store)
+}
+
+func TestInMemoryStore_TrashRetention(t *testing.T) {
+	store := NewInMemoryStore()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.setClock(func() time.Time { return now })
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBlocks([]id{1}))
+	now = now.Add(trashRetention / 2)
+	require.NoError(t, store.DeleteBlocks([]id{2}))
+
+	now = now.Add(trashRetention / 2)
+	trash := store.Trash()
+	require.Len(t, trash, 1)
+	assert.Equal(t, id(2), trash[0].block.id)
+	_, err = store.RestoreFromTrash(1, restorePayload{})
+	assert.Equal(t, errBlockNotInTrash, err)
+	assert.Len(t, store.trash, 1, "operations purge the expired blocks")
+}
+
+func TestInMemoryStore_UndoRestoreKeepsDeletion(t *testing.T) {
+	store := NewInMemoryStore()
+	deletedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := deletedAt
+	store.setClock(func() time.Time { return now })
+	_, err := store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBlocks([]id{1}))
+	now = now.Add(time.Hour)
+	require.NoError(t, store.DeleteBlocks([]id{2}))
+	now = now.Add(trashRetention / 2)
+	_, err = store.RestoreFromTrash(1, restorePayload{})
+	require.NoError(t, err)
+	require.NoError(t, store.Undo())
+
+	trash := store.Trash()
+	require.Len(t, trash, 2)
+	assert.Equal(t, id(1), trash[0].block.id, "the undone restore goes back where it was in the trash")
+	assert.Equal(t, deletedAt, trash[0].deletedAt)
+
+	now = deletedAt.Add(trashRetention)
+	trash = store.Trash()
+	require.Len(t, trash, 1, "block 1 expires when it would have without the restore")
+	assert.Equal(t, id(2), trash[0].block.id)
+}
+
+func TestFileStore_TrashSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 3})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1"}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 2"}},
+		{ParentBlockId: root, Index: 2, Block: blockRequest{Content: "Block 3"}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBlocks([]id{1}))
+	require.NoError(t, store.DeleteBlocks([]id{2})) // snapshotted here
+	require.NoError(t, store.PurgeTrash([]id{2}))
+	require.NoError(t, store.DeleteBlocks([]id{3}))
+	_, err = store.RestoreFromTrash(1, restorePayload{})
+	require.NoError(t, err)
+	expectedTrash := store.Trash()
+	require.NoError(t, store.Close())
+
+	reopened, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 3})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, "Block 1\n", reopened.Export())
+	assert.Equal(t, expectedTrash, reopened.Trash())
+	_, err = reopened.RestoreFromTrash(3, restorePayload{})
+	require.NoError(t, err)
+	assert.Equal(t, "Block 3\nBlock 1\n", reopened.Export())
+}
+
+func TestAPI_Trash(t *testing.T) {
+	r := newTestRouter()
+	createTestDocument(t, r, "Document 1")
+	doRequest(t, r, "POST", "/documents/1/blocks/bulk-insert", `[{"ParentBlockId":0,"Index":0,"Block":{"Content":"Block 1","Subblocks":[{"Content":"Child Block 2"}]}}]`)
+	doRequest(t, r, "DELETE", "/documents/1/blocks?blockIds=2", "")
+	doRequest(t, r, "DELETE", "/documents/1/blocks?blockIds=1", "")
+
+	response := doRequest(t, r, "GET", "/documents/1/trash", "")
+	require.Equal(t, http.StatusOK, response.Code)
+	var trash []trashedBlockResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&trash))
+	require.Len(t, trash, 2)
+	assert.Equal(t, id(1), trash[0].ParentBlockId)
+	assert.Equal(t, trash[0].DeletedAt.Add(trashRetention), trash[0].PurgeAt)
+
+	response = doRequest(t, r, "POST", "/documents/1/trash/2/restore", "")
+	assert.Equal(t, http.StatusConflict, response.Code)
+	response = doRequest(t, r, "POST", "/documents/1/trash/2/restore", `{"NewParentId":0}`)
+	require.Equal(t, http.StatusOK, response.Code)
+	var restored blockResponse
+	require.NoError(t, json.NewDecoder(response.Body).Decode(&restored))
+	assert.Equal(t, "Child Block 2", restored.Content)
+
+	response = doRequest(t, r, "DELETE", "/documents/1/trash?blockIds=2", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = doRequest(t, r, "DELETE", "/documents/1/trash?blockIds=1", "")
+	assert.Equal(t, http.StatusNoContent, response.Code)
+	response = doRequest(t, r, "POST", "/documents/1/trash/1/restore", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = doRequest(t, r, "GET", "/documents/1/export", "")
+	assert.Equal(t, "Child Block 2\n", response.Body.String())
+}
+
+func TestFileStore_PurgeErasesFromDisk(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 2})
+	require.NoError(t, err)
+	_, err = store.InsertBlocks([]insertOperation{
+		{ParentBlockId: root, Index: 0, Block: blockRequest{Content: "Block 1", Subblocks: []blockRequest{{Content: "Child Block 2"}}}},
+		{ParentBlockId: root, Index: 1, Block: blockRequest{Content: "Block 3"}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, store.DeleteBlocks([]id{1})) // snapshotted here
+	_, err = store.UpdateBlock(3, updatePayload{Content: "Updated Block 3"})
+	require.NoError(t, err)
+	require.NoError(t, store.PurgeTrash([]id{1}))
+	require.NoError(t, store.Close())
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		require.NoError(t, err)
+		assert.NotContains(t, string(content), "Child Block 2", entry.Name())
+	}
+	reopened, err := NewFileStore(dir, FileStoreOptions{SnapshotEvery: 2})
+	require.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, "Updated Block 3\n", reopened.Export())
+	require.NoError(t, reopened.Undo(), "the update after the delete doesn't need block 1")
+	assert.Equal(t, errNothingToUndo, reopened.Undo())
+	assert.Equal(t, "Block 3\n", reopened.Export())
+}
@@ -1,5 +1,10 @@
 package crafttask
 
+import (
+	"encoding/json"
+	"time"
+)
+
 type insertOperation struct {
 	ParentBlockId id
 	Block         blockRequest
@@ -11,13 +16,183 @@ type movePayload struct {
 	Index       int
 }
 
+// batchOperation is one step of a batch. Operation is insert, update, move, delete or duplicate.
+// Blocks created earlier in the same batch are referenced through the Ref their insert or duplicate gave them.
+type batchOperation struct {
+	Operation     string
+	BlockId       id            `json:",omitempty"`
+	BlockRef      string        `json:",omitempty"`
+	ParentBlockId id            `json:",omitempty"`
+	ParentRef     string        `json:",omitempty"`
+	Index         int           `json:",omitempty"`
+	Block         blockRequest  `json:",omitempty"`
+	Update        updatePayload `json:",omitempty"`
+	Ref           string        `json:",omitempty"`
+}
+
+type batchResponse struct {
+	Results []operationResult
+	Refs    map[string]id
+}
+
+// updatePayload replaces the block's content, and its type when Type is set; without it the block keeps its type
+// and type specific fields. With RichText the content is the rich text's plain text, and Content can be left out.
+type updatePayload struct {
+	blockTypeFields
+	Content  string
+	RichText []textRunPayload `json:",omitempty"`
+}
+
+// operationResult is the outcome of one operation of a bulk request, keyed by its position in the request
+type operationResult struct {
+	Index     int
+	Block     *blockResponse `json:",omitempty"`
+	ErrorCode string         `json:",omitempty"`
+	Error     string         `json:",omitempty"`
+}
+
+// lineErrorResponse is a malformed line of an imported text
+type lineErrorResponse struct {
+	Line  int
+	Error string
+}
+
+// blockResponse has the type specific fields of its type only
 type blockResponse struct {
-	Id        id
-	Content   string
-	Subblocks []blockResponse
+	Id       id
+	Type     blockType
+	Level    int    `json:",omitempty"`
+	Checked  *bool  `json:",omitempty"`
+	Language string `json:",omitempty"`
+	Target   id     `json:",omitempty"`
+	// Broken is the error code of why a reference doesn't resolve, e.g. reference_target_not_found
+	Broken string `json:",omitempty"`
+	// Content is the content of the target for references
+	Content string
+	// RichText is left out when the content has no formatting
+	RichText   []textRunPayload           `json:",omitempty"`
+	Properties map[string]propertyPayload `json:",omitempty"`
+	Subblocks  []blockResponse
 }
 
 type blockRequest struct {
-	Content   string
-	Subblocks []blockRequest //not implemented
+	// Id is only used by imports keeping the ids they are given; new blocks get a fresh id otherwise
+	Id id `json:",omitempty"`
+	blockTypeFields
+	Content string
+	// RichText is the content with its formatting; the content is its plain text then, and Content can be left out
+	RichText   []textRunPayload           `json:",omitempty"`
+	Properties map[string]propertyPayload `json:",omitempty"`
+	Subblocks  []blockRequest
+}
+
+// fields is the requested block without its id and subblocks; the request has to be validated first
+func (request blockRequest) fields() block {
+	content, richText, _ := blockContent(request.Content, request.RichText)
+	properties, _ := propertiesFromPayloads(request.Properties)
+	return request.blockTypeFields.applyTo(block{content: content, richText: richText, properties: properties})
+}
+
+// textRunPayload is a run of text with the same formatting: any of the bold, italic, strikethrough and code Marks
+// (code on its own only), and a Link
+type textRunPayload struct {
+	Text  string
+	Marks []string `json:",omitempty"`
+	Link  string   `json:",omitempty"`
+}
+
+// propertyPayload is a property's value as JSON of the property's type, e.g. {"Type":"date","Value":"2006-01-02"}
+type propertyPayload struct {
+	Type  propertyType
+	Value json.RawMessage
+}
+
+type revisionResponse struct {
+	Revision  uint64
+	Timestamp time.Time
+	Summary   string
+}
+
+type blockPositionResponse struct {
+	ParentId id
+	Index    int
+}
+
+type blockChangeResponse struct {
+	Change      string
+	BlockId     id
+	DuplicateOf id                     `json:",omitempty"`
+	OldPosition *blockPositionResponse `json:",omitempty"`
+	NewPosition *blockPositionResponse `json:",omitempty"`
+	OldContent  *string                `json:",omitempty"`
+	NewContent  *string                `json:",omitempty"`
+	// OldRichText and NewRichText are left out when the content had or has no formatting
+	OldRichText []textRunPayload `json:",omitempty"`
+	NewRichText []textRunPayload `json:",omitempty"`
+	OldType     *blockTypeFields `json:",omitempty"`
+	NewType     *blockTypeFields `json:",omitempty"`
+	// OldProperties and NewProperties are left out when the block had or has no properties
+	OldProperties map[string]propertyPayload `json:",omitempty"`
+	NewProperties map[string]propertyPayload `json:",omitempty"`
+}
+
+type diffResponse struct {
+	From    uint64
+	To      uint64
+	Changes []blockChangeResponse
+}
+
+// restorePayload restores a deleted block under NewParentId when set, otherwise where it was deleted from
+type restorePayload struct {
+	NewParentId *id `json:",omitempty"`
+	Index       int `json:",omitempty"`
+}
+
+type trashedBlockResponse struct {
+	Block         blockResponse
+	ParentBlockId id
+	Index         int
+	DeletedAt     time.Time
+	PurgeAt       time.Time
+}
+
+type documentRequest struct {
+	Name string
+}
+
+type documentResponse struct {
+	Id   id
+	Name string
+}
+
+// backlinkResponse is a block linking to the requested one, with the path of blocks down to it: its ancestors,
+// the top level one first
+type backlinkResponse struct {
+	Id      id
+	Type    blockType
+	Content string
+	Path    []breadcrumbResponse
+}
+
+// breadcrumbResponse is one of the blocks on the path down to another one
+type breadcrumbResponse struct {
+	Id      id
+	Content string
+}
+
+// searchHitResponse is a block the search found, with snippets of its content showing the matches and the path of
+// blocks down to it
+type searchHitResponse struct {
+	Id       id
+	Type     blockType
+	Content  string
+	Score    float64
+	Snippets [][]snippetPartResponse
+	Path     []breadcrumbResponse
+}
+
+// snippetPartResponse is a piece of a snippet's text, highlighted when it's a match
+type snippetPartResponse struct {
+	Text        string
+	Highlighted bool `json:",omitempty"`
 }
@@ -0,0 +1,270 @@
+package crafttask
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	walOperationInsert          = "insert"
+	walOperationInsertPartially = "insert-partially"
+	walOperationDelete          = "delete"
+	walOperationDuplicate       = "duplicate"
+	walOperationMove            = "move"
+	walOperationUpdate          = "update"
+	walOperationBatch           = "batch"
+	walOperationUndo            = "undo"
+	walOperationRedo            = "redo"
+	walOperationRestore         = "restore"
+	walOperationPurge           = "purge"
+	walOperationImport          = "import"
+	walOperationSetProperty     = "set-property"
+	walOperationUnsetProperty   = "unset-property"
+)
+
+// every record is framed as [payload length][crc32 of length][crc32 of payload][payload], so a torn write at the tail
+// can be told apart from a corrupt length
+const walHeaderSize = 12
+
+// maxFrameSize bounds the payload of a frame, so a corrupt length in a header can't make reading allocate gigabytes
+const maxFrameSize = 1 << 30
+
+var walChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorruptWalRecord = errors.New("corrupt write-ahead log record")
+var errFrameTooLarge = errors.New("record is too large to be persisted")
+
+type walRecord struct {
+	Sequence  uint64
+	Time      time.Time
+	Operation string
+	Inserts   []insertOperation `json:",omitempty"`
+	BlockIds  []id              `json:",omitempty"`
+	BlockId   id                `json:",omitempty"`
+	Move      *movePayload      `json:",omitempty"`
+	Update    *updatePayload    `json:",omitempty"`
+	Batch     []batchOperation  `json:",omitempty"`
+	Restore   *restorePayload   `json:",omitempty"`
+	KeepIds   bool              `json:",omitempty"`
+	// PropertyName is the property set or unset, and Property the value it is set to
+	PropertyName string           `json:",omitempty"`
+	Property     *propertyPayload `json:",omitempty"`
+}
+
+type writeAheadLog struct {
+	path         string
+	file         *os.File
+	size         int64
+	lastSequence uint64
+}
+
+// openWriteAheadLog opens (or creates) the log and reads back every intact record.
+// A partially written record at the end of the file is what a crash in the middle of an append leaves behind,
+// so the file is truncated back to the last intact record instead of failing. A damaged record with more records
+// after it can't come from a crash though, so that fails with errCorruptWalRecord rather than dropping the later ones.
+func openWriteAheadLog(path string) (*writeAheadLog, []walRecord, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+	records, validSize, err := readWalRecords(file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if err := file.Truncate(validSize); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	wal := &writeAheadLog{path: path, file: file, size: validSize}
+	if len(records) > 0 {
+		wal.lastSequence = records[len(records)-1].Sequence
+	}
+	return wal, records, nil
+}
+
+// readWalRecords reads the records of the log from its start, and how many bytes of it they take up
+func readWalRecords(file *os.File) ([]walRecord, int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	records := make([]walRecord, 0)
+	var validSize int64
+	for {
+		payload, err := readFrame(file, info.Size()-validSize)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return records, validSize, nil // a torn write at the tail
+		}
+		frameEnd := validSize + int64(walHeaderSize+len(payload))
+		if errors.Is(err, errCorruptWalRecord) && frameEnd == info.Size() {
+			return records, validSize, nil // the tail was written in full, but not its content
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		var record walRecord
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return nil, 0, errCorruptWalRecord // the checksum matched, so this isn't from a torn write
+		}
+		records = append(records, record)
+		validSize = frameEnd
+	}
+}
+
+// readFrame reads a single checksummed frame out of the available bytes; also used for snapshots.
+// A length that doesn't match its checksum is errCorruptWalRecord. An intact length beyond the available bytes is
+// from a torn write of the last frame and reads as io.ErrUnexpectedEOF, without allocating anything. A frame whose
+// payload doesn't match its checksum is returned along with errCorruptWalRecord.
+func readFrame(reader io.Reader, available int64) ([]byte, error) {
+	header := make([]byte, walHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	if crc32.Checksum(header[0:4], walChecksumTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		return nil, errCorruptWalRecord
+	}
+	checksum := binary.LittleEndian.Uint32(header[8:12])
+	if int64(length) > available-walHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	if length > maxFrameSize {
+		return nil, errCorruptWalRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(payload, walChecksumTable) != checksum {
+		return payload, errCorruptWalRecord
+	}
+	return payload, nil
+}
+
+// encodeFrame frames the payload, which has to fit in maxFrameSize to be read back
+func encodeFrame(payload []byte) ([]byte, error) {
+	if len(payload) > maxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	frame := make([]byte, walHeaderSize+len(payload))
+	copy(frame, frameHeader(uint32(len(payload)), crc32.Checksum(payload, walChecksumTable)))
+	copy(frame[walHeaderSize:], payload)
+	return frame, nil
+}
+
+func frameHeader(length uint32, payloadChecksum uint32) []byte {
+	header := make([]byte, walHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], length)
+	binary.LittleEndian.PutUint32(header[4:8], crc32.Checksum(header[0:4], walChecksumTable))
+	binary.LittleEndian.PutUint32(header[8:12], payloadChecksum)
+	return header
+}
+
+func encodeWalRecord(record walRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	return encodeFrame(payload)
+}
+
+// append assigns the record the next sequence number and durably writes it;
+// it only returns once the record is synced to disk
+func (l *writeAheadLog) append(record walRecord) error {
+	record.Sequence = l.lastSequence + 1
+	frame, err := encodeWalRecord(record)
+	if err != nil {
+		return err
+	}
+	if _, err := l.file.Write(frame); err != nil {
+		l.rollback()
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		l.rollback()
+		return err
+	}
+	l.size += int64(len(frame))
+	l.lastSequence = record.Sequence
+	return nil
+}
+
+// rollback drops a partially written frame so later appends don't land behind garbage
+func (l *writeAheadLog) rollback() {
+	l.file.Truncate(l.size)
+	l.file.Seek(l.size, io.SeekStart)
+}
+
+// compact rewrites the log so it only holds the records after the given sequence number.
+// The new log is written next to the old one and renamed over it, so a crash leaves one of the two intact.
+func (l *writeAheadLog) compact(keepAfter uint64) error {
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	records, _, err := readWalRecords(l.file)
+	if err != nil {
+		return err
+	}
+	tempPath := l.path + ".compact"
+	tempFile, err := os.OpenFile(tempPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, record := range records {
+		if record.Sequence <= keepAfter {
+			continue
+		}
+		frame, err := encodeWalRecord(record)
+		if err != nil {
+			tempFile.Close()
+			return err
+		}
+		if _, err := tempFile.Write(frame); err != nil {
+			tempFile.Close()
+			return err
+		}
+		size += int64(len(frame))
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := os.Rename(tempPath, l.path); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := syncDir(filepath.Dir(l.path)); err != nil {
+		tempFile.Close()
+		return err
+	}
+	l.file.Close()
+	l.file = tempFile
+	l.size = size
+	_, err = l.file.Seek(size, io.SeekStart)
+	return err
+}
+
+func (l *writeAheadLog) close() error {
+	return l.file.Close()
+}
+
+func syncDir(dir string) error {
+	dirFile, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer dirFile.Close()
+	return dirFile.Sync()
+}
@@ -1,31 +1,39 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"local/CraftTask/crafttask"
+	"log"
 	"net/http"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
 
-// these all should be prefixed for the document, but since there is only one, there is no need now (most apparent on the export)
 func main() {
+	dataDir := flag.String("data-dir", "", "directory to persist the documents in; kept only in memory when empty")
+	flag.Parse()
+
 	r := mux.NewRouter()
 
-	server := crafttask.NewAPI(crafttask.NewInMemoryStore())
+	documents := crafttask.NewInMemoryDocuments()
+	if *dataDir != "" {
+		fileDocuments, err := crafttask.NewFileDocuments(*dataDir, crafttask.FileStoreOptions{})
+		if err != nil {
+			log.Fatalf("opening documents in %s: %v", *dataDir, err)
+		}
+		documents = fileDocuments
+	}
+	defer documents.Close()
+	server := crafttask.NewAPI(documents)
 
-	r.HandleFunc("/blocks/bulk-insert", server.InsertBlocks).Methods("POST")
-	r.HandleFunc("/blocks", server.DeleteBlocks).Methods("DELETE")
-	r.HandleFunc("/blocks", server.FetchBlocksByID).Methods("GET")
-	r.HandleFunc("/blocks/{id}/duplicate", server.DuplicateBlock).Methods("POST")
-	r.HandleFunc("/blocks/{id}/move", server.MoveBlock).Methods("POST")
-	r.HandleFunc("/export", server.ExportDocument).Methods("GET")
+	server.RegisterRoutes(r)
 
 	// Use the cors middleware
 	handler := cors.AllowAll().Handler(r)
 	http.Handle("/", handler)
 
 	fmt.Println("Server listening on :8080")
-	http.ListenAndServe(":8080", nil)
+	crafttask.NewHTTPServer(":8080", nil).ListenAndServe()
 }